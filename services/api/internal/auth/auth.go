@@ -160,7 +160,9 @@ const MaxSessionsPerUser = 5
 // SessionTokenBytes is the entropy for session tokens (384 bits = quantum resistant)
 const SessionTokenBytes = 48
 
-func CreateSession(db *sql.DB, userID int) (string, error) {
+// CreateSession mints a session token for userID, recording the client IP
+// and User-Agent so the sessions list can show where each login came from
+func CreateSession(db *sql.DB, userID int, ip, userAgent string) (string, error) {
 	var oldSessionIDs []int
 	rows, err := db.Query(`
 		SELECT id FROM sessions 
@@ -188,8 +190,8 @@ func CreateSession(db *sql.DB, userID int) (string, error) {
 	tokenHash := hex.EncodeToString(hash[:])
 
 	expiry := time.Now().Add(12 * time.Hour)
-	_, err = db.Exec("INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
-		tokenHash, userID, time.Now(), expiry)
+	_, err = db.Exec("INSERT INTO sessions (token_hash, user_id, created_at, expires_at, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?)",
+		tokenHash, userID, time.Now(), expiry, ip, userAgent)
 
 	return token, err
 }
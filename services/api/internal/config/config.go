@@ -5,12 +5,14 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
 	DBPath          string
 	Port            string
 	MasterKeyPath   string
+	WGInterface     string
 	WGConfigPath    string
 	WGPublicKeyPath string
 	TriggerFile     string
@@ -20,11 +22,13 @@ type Config struct {
 var globalConfig *Config
 
 func Load() *Config {
+	iface := getEnv("WG_INTERFACE", "wg0")
 	globalConfig = &Config{
 		DBPath:          getEnv("SAMNET_DB_PATH", "/var/lib/samnet-wg/samnet.db"),
 		Port:            getEnv("PORT", "8766"),
 		MasterKeyPath:   getEnv("MASTER_KEY_PATH", "/var/lib/samnet-wg/master.key"),
-		WGConfigPath:    getEnv("WG_CONFIG_PATH", "/etc/wireguard/wg0.conf"),
+		WGInterface:     iface,
+		WGConfigPath:    getEnv("WG_CONFIG_PATH", "/etc/wireguard/"+iface+".conf"),
 		WGPublicKeyPath: getEnv("WG_PUBKEY_PATH", "/etc/wireguard/publickey"),
 		TriggerFile:     getEnv("TRIGGER_FILE", "/var/lib/samnet-wg/reconcile.trigger"),
 		ClientsDir:      getEnv("CLIENTS_DIR", "/opt/samnet/clients"),
@@ -50,6 +54,10 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid port: %s (must be 1-65535)", c.Port)
 	}
 
+	if c.WGInterface == "" || strings.ContainsAny(c.WGInterface, "/ \t") {
+		return fmt.Errorf("invalid WG_INTERFACE: %q", c.WGInterface)
+	}
+
 	return nil
 }
 
@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -99,83 +100,294 @@ func CleanupOldAuditLogs(db *sql.DB) error {
 	return err
 }
 
+// CleanupOldTrafficHistory trims traffic samples past the retention window,
+// configurable via the traffic_retention_days config key (default 30 days)
+func CleanupOldTrafficHistory(db *sql.DB) error {
+	days := 30
+	var v string
+	if err := db.QueryRow("SELECT value FROM system_config WHERE key = 'traffic_retention_days'").Scan(&v); err == nil {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			days = n
+		}
+	}
+	_, err := db.Exec("DELETE FROM traffic_history WHERE timestamp < datetime('now', ?)", fmt.Sprintf("-%d days", days))
+	return err
+}
+
 // RunMaintenance performs DB maintenance tasks
 func RunMaintenance(db *sql.DB) {
 	CleanupOldSessions(db)
 	CleanupOldAuditLogs(db)
+	CleanupOldTrafficHistory(db)
 	db.Exec("PRAGMA optimize;")
 	db.Exec("PRAGMA wal_checkpoint(TRUNCATE);")
 }
 
 // RunMigrations applies SQL migrations from migrations directory incrementally
 func RunMigrations(dbPath string) error {
+	return MigrateTo(dbPath, 0)
+}
+
+// MigrationInfo describes one migration file and whether its version has
+// been applied
+type MigrationInfo struct {
+	Version int
+	File    string
+	Applied bool
+}
+
+// openMigrationDB opens the DB and ensures the schema_version table exists
+func openMigrationDB(dbPath string) (*sql.DB, error) {
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
-		return fmt.Errorf("failed to open DB for migrations: %w", err)
+		return nil, fmt.Errorf("failed to open DB for migrations: %w", err)
 	}
-	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, applied_at DATETIME DEFAULT CURRENT_TIMESTAMP)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+	return db, nil
+}
 
-	// Ensure schema_version table exists
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, applied_at DATETIME DEFAULT CURRENT_TIMESTAMP)`)
+// migrationsDir is where every runner (SQLite and Postgres) looks for
+// migration files, relative to the service working directory
+const migrationsDir = "migrations"
+
+// listMigrations returns up-migrations (NNN_name.sql, excluding *_down.sql)
+// in filename order
+func listMigrations() ([]string, error) {
+	migrationFiles, err := filepath.Glob(filepath.Join(migrationsDir, "*.sql"))
 	if err != nil {
-		return fmt.Errorf("failed to create schema_version table: %w", err)
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+	var ups []string
+	for _, file := range migrationFiles {
+		if strings.HasSuffix(file, "_down.sql") {
+			continue
+		}
+		ups = append(ups, file)
 	}
+	return ups, nil
+}
 
+func currentSchemaVersion(db *sql.DB) (int, error) {
 	var currentVersion int
-	err = db.QueryRow("SELECT version FROM schema_version ORDER BY version DESC LIMIT 1").Scan(&currentVersion)
+	err := db.QueryRow("SELECT version FROM schema_version ORDER BY version DESC LIMIT 1").Scan(&currentVersion)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			currentVersion = 0
-		} else {
-			return fmt.Errorf("failed to check current schema version: %w", err)
+			return 0, nil
 		}
+		return 0, fmt.Errorf("failed to check current schema version: %w", err)
+	}
+	return currentVersion, nil
+}
+
+// MigrationStatus lists all migrations with their applied state, without
+// running anything
+func MigrationStatus(dbPath string) ([]MigrationInfo, error) {
+	db, err := openMigrationDB(dbPath)
+	if err != nil {
+		return nil, err
 	}
+	defer db.Close()
 
-	migrationFiles, err := filepath.Glob("migrations/*.sql")
+	currentVersion, err := currentSchemaVersion(db)
 	if err != nil {
-		return fmt.Errorf("failed to list migrations: %w", err)
+		return nil, err
 	}
 
-	for _, file := range migrationFiles {
+	files, err := listMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []MigrationInfo
+	for _, file := range files {
 		base := filepath.Base(file)
 		var fileVersion int
 		fmt.Sscanf(base, "%d", &fileVersion)
+		infos = append(infos, MigrationInfo{
+			Version: fileVersion,
+			File:    base,
+			Applied: fileVersion <= currentVersion,
+		})
+	}
+	return infos, nil
+}
 
-		if fileVersion > currentVersion {
-			slog.Info("Applying migration", "file", base, "version", fileVersion)
-			sqlBytes, err := os.ReadFile(file)
-			if err != nil {
-				return fmt.Errorf("failed to read migration %s: %w", base, err)
-			}
+// MigrateTo migrates up to the given target version (0 = latest). A target
+// below the current version rolls back using NNN_down.sql files where
+// provided.
+func MigrateTo(dbPath string, target int) error {
+	db, err := openMigrationDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
 
-			tx, err := db.Begin()
-			if err != nil {
-				return err
-			}
+	currentVersion, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if target > 0 && target < currentVersion {
+		return migrateDown(db, currentVersion, target)
+	}
+	return migrateUp(db, currentVersion, target)
+}
+
+// MigrateSteps applies N migrations up (positive) or rolls N back (negative)
+func MigrateSteps(dbPath string, steps int) error {
+	db, err := openMigrationDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	currentVersion, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if steps < 0 {
+		target := currentVersion + steps
+		if target < 0 {
+			target = 0
+		}
+		return migrateDown(db, currentVersion, target)
+	}
 
-			if _, err := tx.Exec(string(sqlBytes)); err != nil {
-				// Ignore "duplicate column name" errors - these mean the column already exists
-				// This makes migrations idempotent (safe to run multiple times)
-				if !strings.Contains(err.Error(), "duplicate column name") {
-					tx.Rollback()
-					return fmt.Errorf("failed to apply migration %s: %w", base, err)
-				}
-				// Column already exists, continue with migration tracking
+	files, err := listMigrations()
+	if err != nil {
+		return err
+	}
+	// Find the version reached after N pending versions
+	target := currentVersion
+	remaining := steps
+	for _, file := range files {
+		var fileVersion int
+		fmt.Sscanf(filepath.Base(file), "%d", &fileVersion)
+		if fileVersion > target {
+			target = fileVersion
+			remaining--
+			if remaining == 0 {
+				break
 			}
+		}
+	}
+	return migrateUp(db, currentVersion, target)
+}
+
+func migrateUp(db *sql.DB, currentVersion, target int) error {
+	files, err := listMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		base := filepath.Base(file)
+		var fileVersion int
+		fmt.Sscanf(base, "%d", &fileVersion)
 
-			if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES (?)", fileVersion); err != nil {
+		if fileVersion <= currentVersion {
+			continue
+		}
+		if target > 0 && fileVersion > target {
+			continue
+		}
+
+		slog.Info("Applying migration", "file", base, "version", fileVersion)
+		sqlBytes, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read migration %s: %w", base, err)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(string(sqlBytes)); err != nil {
+			// Ignore "duplicate column name" errors - these mean the column already exists
+			// This makes migrations idempotent (safe to run multiple times)
+			if !strings.Contains(err.Error(), "duplicate column name") {
 				tx.Rollback()
-				return fmt.Errorf("failed to update schema version for %s: %w", base, err)
+				return fmt.Errorf("failed to apply migration %s: %w", base, err)
 			}
+			// Column already exists, continue with migration tracking
+		}
 
-			if err := tx.Commit(); err != nil {
-				return err
-			}
+		// OR IGNORE: two files may legitimately share a version number
+		// (e.g. 002_data_limits and 002_feature_expansion); only one row
+		// per version is tracked
+		if _, err := tx.Exec("INSERT OR IGNORE INTO schema_version (version) VALUES (?)", fileVersion); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to update schema version for %s: %w", base, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateDown rolls back applied versions above target, newest first, using
+// migrations/NNN_down.sql. Missing down files abort the rollback before any
+// damage is done.
+func migrateDown(db *sql.DB, currentVersion, target int) error {
+	rows, err := db.Query("SELECT version FROM schema_version WHERE version > ? ORDER BY version DESC", target)
+	if err != nil {
+		return err
+	}
+	var versions []int
+	for rows.Next() {
+		var v int
+		if rows.Scan(&v) == nil {
+			versions = append(versions, v)
+		}
+	}
+	rows.Close()
+
+	// Verify every down file exists before touching anything
+	for _, v := range versions {
+		if _, err := os.Stat(downMigrationPath(v)); err != nil {
+			return fmt.Errorf("no down migration for version %d (expected %s)", v, downMigrationPath(v))
+		}
+	}
+
+	for _, v := range versions {
+		file := downMigrationPath(v)
+		slog.Info("Rolling back migration", "file", filepath.Base(file), "version", v)
+		sqlBytes, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read down migration %s: %w", file, err)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(sqlBytes)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to roll back version %d: %w", v, err)
+		}
+		if _, err := tx.Exec("DELETE FROM schema_version WHERE version = ?", v); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to update schema version for rollback %d: %w", v, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
+
+func downMigrationPath(version int) string {
+	return filepath.Join(migrationsDir, fmt.Sprintf("%03d_down.sql", version))
+}
 // ValidateSchema ensures all required tables exist and are accessible
 func ValidateSchema(db *sql.DB) error {
 	requiredTables := []string{
@@ -27,6 +27,7 @@ type Driver interface {
 	Begin() (*sql.Tx, error)
 
 	GetWriteMetrics() WriteMetrics
+	StartMetricsReset(ctx context.Context)
 	RawDB() *sql.DB
 }
 
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -95,8 +96,10 @@ func (m *ScalingMonitor) triggerAlert(metrics WriteMetrics) {
 		"peak_wps", metrics.PeakWrites,
 	)
 
+	// Raw insert (not handler.WriteAudit): the db package sits below handler
+	// and must not depend on it
 	if db := m.driver.RawDB(); db != nil {
-		db.Exec(`INSERT INTO audit_logs (user_id, action, target, details, ip_address) 
+		db.Exec(`INSERT INTO audit_logs (user_id, action, target, details, ip_address)
 			VALUES (0, 'HIGH_LOAD_ALERT', 'database', ?, 'system')`,
 			fmt.Sprintf("Write load: %.2f wps (threshold: %d)",
 				metrics.WritesPerSecond, m.threshold))
@@ -107,8 +110,15 @@ func (m *ScalingMonitor) triggerAlert(metrics WriteMetrics) {
 	}
 }
 
-// NewMonitorDriver creates a SQLite driver and connects
+// NewMonitorDriver creates the configured driver and connects.
+// DB_BACKEND=postgres with DB_DSN selects Postgres (migrations included,
+// since the SQLite runner in db.go doesn't apply there); it needs a binary
+// built with -tags postgres. Default is SQLite at path.
 func NewMonitorDriver(path string) (Driver, error) {
+	if os.Getenv("DB_BACKEND") == "postgres" {
+		return newPostgresBackend(os.Getenv("DB_DSN"))
+	}
+
 	driver := NewSQLiteDriver(path)
 	if err := driver.Connect(); err != nil {
 		return nil, err
@@ -126,6 +136,11 @@ func LoadConfigFromEnv() Config {
 	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
 		cfg.RedisURL = redisURL
 	}
+	if t := os.Getenv("DB_WRITE_THRESHOLD"); t != "" {
+		if n, err := strconv.Atoi(t); err == nil && n > 0 {
+			cfg.WriteThreshold = n
+		}
+	}
 
 	return cfg
 }
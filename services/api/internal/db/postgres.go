@@ -0,0 +1,255 @@
+//go:build postgres
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// PostgresDriver implements Driver for PostgreSQL. It is the scale-out
+// backend: when the ScalingMonitor reports sustained write load above the
+// threshold, deployments move here via DB_BACKEND=postgres + DB_DSN, running
+// a binary built with -tags postgres, which compiles this file and the pgx
+// driver it registers.
+//
+// Status: experimental. Queries issued through the Driver interface get
+// their `?` placeholders rewritten to $N, and migrations are translated by
+// translateToPostgres. Code that reaches the raw *sql.DB via RawDB() still
+// speaks SQLite dialect (INSERT OR REPLACE, strftime), so those call sites
+// must be ported before this backend can serve the full API; until then it
+// is only suitable for Driver-interface consumers.
+type PostgresDriver struct {
+	db      *sql.DB
+	dsn     string
+	counter *WriteCounter
+}
+
+// NewPostgresDriver creates a new Postgres driver for the given DSN
+func NewPostgresDriver(dsn string) *PostgresDriver {
+	return &PostgresDriver{
+		dsn:     dsn,
+		counter: NewWriteCounter(),
+	}
+}
+
+// newPostgresBackend is the DB_BACKEND=postgres path behind NewMonitorDriver:
+// connect, then bring the schema up to date from the shared migrations dir
+func newPostgresBackend(dsn string) (Driver, error) {
+	pg := NewPostgresDriver(dsn)
+	if err := pg.Connect(); err != nil {
+		return nil, err
+	}
+	if err := pg.RunMigrations(migrationsDir); err != nil {
+		pg.Close()
+		return nil, err
+	}
+	return pg, nil
+}
+
+func (d *PostgresDriver) Connect() error {
+	if d.dsn == "" {
+		return fmt.Errorf("postgres backend selected but DB_DSN is empty")
+	}
+
+	db, err := sql.Open("pgx", d.dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open postgres database: %w", err)
+	}
+
+	db.SetMaxOpenConns(MaxOpenConns)
+	db.SetMaxIdleConns(MaxIdleConns)
+	db.SetConnMaxLifetime(ConnMaxLifetime)
+
+	// sql.Open is lazy for registered drivers; verify the DSN now so a bad
+	// config fails at startup instead of on the first query
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	d.db = db
+	return nil
+}
+
+func (d *PostgresDriver) Close() error {
+	if d.db != nil {
+		return d.db.Close()
+	}
+	return nil
+}
+
+func (d *PostgresDriver) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+func (d *PostgresDriver) Query(query string, args ...any) (*sql.Rows, error) {
+	return d.db.Query(translatePlaceholders(query), args...)
+}
+
+func (d *PostgresDriver) QueryRow(query string, args ...any) *sql.Row {
+	return d.db.QueryRow(translatePlaceholders(query), args...)
+}
+
+func (d *PostgresDriver) Exec(query string, args ...any) (sql.Result, error) {
+	d.counter.Increment()
+	return d.db.Exec(translatePlaceholders(query), args...)
+}
+
+func (d *PostgresDriver) Begin() (*sql.Tx, error) {
+	return d.db.Begin()
+}
+
+func (d *PostgresDriver) GetWriteMetrics() WriteMetrics {
+	return d.counter.GetMetrics()
+}
+
+func (d *PostgresDriver) RawDB() *sql.DB {
+	return d.db
+}
+
+// StartMetricsReset resets window every minute for accurate WPS
+func (d *PostgresDriver) StartMetricsReset(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.counter.ResetWindow()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// RunMigrations applies the SQLite migration files from migrationsDir,
+// translated to Postgres dialect, tracked in the same schema_version table
+func (d *PostgresDriver) RunMigrations(migrationsDir string) error {
+	if _, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`); err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	var currentVersion int
+	err := d.db.QueryRow("SELECT version FROM schema_version ORDER BY version DESC LIMIT 1").Scan(&currentVersion)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to check current schema version: %w", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(migrationsDir, "*.sql"))
+	if err != nil {
+		return fmt.Errorf("failed to list migrations: %w", err)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		if strings.HasSuffix(file, "_down.sql") {
+			continue
+		}
+		version, err := strconv.Atoi(strings.SplitN(filepath.Base(file), "_", 2)[0])
+		if err != nil || version <= currentVersion {
+			continue
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read migration %s: %w", file, err)
+		}
+
+		for _, stmt := range splitStatements(string(content)) {
+			if _, err := d.db.Exec(translateToPostgres(stmt)); err != nil {
+				return fmt.Errorf("migration %s failed: %w", file, err)
+			}
+		}
+
+		if _, err := d.db.Exec("INSERT INTO schema_version (version) VALUES ($1)", version); err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+// translatePlaceholders rewrites SQLite's `?` bind markers into the $1..$N
+// form Postgres expects, leaving question marks inside string literals alone
+func translatePlaceholders(query string) string {
+	var b strings.Builder
+	n := 0
+	inString := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			inString = !inString
+			b.WriteByte(c)
+		case c == '?' && !inString:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// splitStatements breaks a migration file into individual statements.
+// Fine for our migrations: none embed semicolons in strings or use triggers.
+func splitStatements(content string) []string {
+	var stmts []string
+	for _, s := range strings.Split(content, ";") {
+		// Drop comment-only lines so a trailing "-- note" doesn't become
+		// a statement of its own
+		var lines []string
+		for _, line := range strings.Split(s, "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "--") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		s = strings.TrimSpace(strings.Join(lines, "\n"))
+		if s != "" {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
+
+var (
+	pgAutoincrementRe = regexp.MustCompile(`(?i)INTEGER\s+PRIMARY\s+KEY\s+AUTOINCREMENT`)
+	pgDatetimeTypeRe  = regexp.MustCompile(`(?i)\bDATETIME\b`)
+	pgDatetimeNowRe   = regexp.MustCompile(`(?i)datetime\s*\(\s*'now'\s*\)`)
+	pgInsertIgnoreRe  = regexp.MustCompile(`(?i)^INSERT\s+OR\s+IGNORE\s+INTO`)
+	pgBlobRe          = regexp.MustCompile(`(?i)\bBLOB\b`)
+)
+
+// translateToPostgres rewrites the SQLite-isms our migrations use into
+// Postgres dialect. It is not a general SQL translator; new migrations
+// that stray beyond these constructs need a matching rule here.
+func translateToPostgres(stmt string) string {
+	if strings.HasPrefix(strings.ToUpper(stmt), "PRAGMA") {
+		return "SELECT 1" // no Postgres equivalent, harmless no-op
+	}
+
+	stmt = pgAutoincrementRe.ReplaceAllString(stmt, "BIGSERIAL PRIMARY KEY")
+	stmt = pgDatetimeTypeRe.ReplaceAllString(stmt, "TIMESTAMP")
+	stmt = pgDatetimeNowRe.ReplaceAllString(stmt, "CURRENT_TIMESTAMP")
+	stmt = pgBlobRe.ReplaceAllString(stmt, "BYTEA")
+
+	if pgInsertIgnoreRe.MatchString(stmt) {
+		stmt = pgInsertIgnoreRe.ReplaceAllString(stmt, "INSERT INTO")
+		stmt += " ON CONFLICT DO NOTHING"
+	}
+
+	return stmt
+}
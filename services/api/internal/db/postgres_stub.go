@@ -0,0 +1,13 @@
+//go:build !postgres
+
+package db
+
+import "fmt"
+
+// newPostgresBackend without the postgres build tag: fail at startup with an
+// actionable message instead of database/sql's cryptic "unknown driver". The
+// real implementation (and the pgx driver it registers) is in postgres.go,
+// compiled only with -tags postgres.
+func newPostgresBackend(dsn string) (Driver, error) {
+	return nil, fmt.Errorf("DB_BACKEND=postgres requires a binary built with -tags postgres (bundles the PostgreSQL driver)")
+}
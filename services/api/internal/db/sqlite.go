@@ -55,6 +55,12 @@ func (d *SQLiteDriver) Connect() error {
 		return fmt.Errorf("failed to enable foreign keys: %w", err)
 	}
 
+	// Same index bootstrap as db.Connect, so main can open via the driver
+	// without losing it
+	if err := ensureIndexes(db); err != nil {
+		return fmt.Errorf("failed to ensure indexes: %w", err)
+	}
+
 	d.db = db
 	return nil
 }
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// Server-side per-peer ACLs. Unlike the client-controlled AllowedIPs (which a
+// peer can freely rewrite in its own config), these are enforced on the
+// server with nftables rules keyed on the peer's /32 tunnel address, so a
+// "monitoring" peer really can be limited to the metrics subnet. Rules are
+// evaluated first-match-wins; traffic matching no rule is accepted, so an
+// allow-list ends with an explicit deny 0.0.0.0/0.
+
+// ACLRule is one allow/deny entry in a peer's server-side ACL
+type ACLRule struct {
+	Action string `json:"action"` // "allow" or "deny"
+	CIDR   string `json:"cidr"`   // destination the rule covers
+}
+
+const nftTable = "samnet_acl"
+
+// runNFT executes an nft command; a no-op in mock mode like runWGSet
+func runNFT(args ...string) error {
+	if mockWG {
+		slog.Debug("Mock nft", "args", args)
+		return nil
+	}
+	out, err := exec.Command("nft", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft %s: %v (%s)", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// peerACLChain names the per-peer base chain; one chain per peer keeps
+// teardown a flush+delete with no jump-rule bookkeeping
+func peerACLChain(peerID string) string {
+	return "peer_" + peerID
+}
+
+// loadPeerACL returns a peer's rules in evaluation order
+func loadPeerACL(db *sql.DB, peerID string) ([]ACLRule, error) {
+	rows, err := db.Query("SELECT action, cidr FROM peer_acls WHERE peer_id = ? ORDER BY position, id", peerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]ACLRule, 0)
+	for rows.Next() {
+		var rule ACLRule
+		if rows.Scan(&rule.Action, &rule.CIDR) == nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// applyPeerACL (re)installs the nftables chain for one peer from the DB.
+// Disabled peers and peers without rules end up with no chain at all.
+func applyPeerACL(db *sql.DB, peerID string) error {
+	var allowedIPs string
+	var disabled int
+	if err := db.QueryRow("SELECT allowed_ips, COALESCE(disabled, 0) FROM peers WHERE id = ?", peerID).Scan(&allowedIPs, &disabled); err != nil {
+		return err
+	}
+	rules, err := loadPeerACL(db, peerID)
+	if err != nil {
+		return err
+	}
+
+	teardownPeerACL(peerID)
+	if disabled == 1 || len(rules) == 0 {
+		return nil
+	}
+
+	peerIP := strings.Split(allowedIPs, "/")[0] + "/32"
+	chain := peerACLChain(peerID)
+
+	runNFT("add", "table", "inet", nftTable) // idempotent
+	if err := runNFT("add", "chain", "inet", nftTable, chain,
+		"{", "type", "filter", "hook", "forward", "priority", "0", ";", "policy", "accept", ";", "}"); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		verdict := "accept"
+		if rule.Action == "deny" {
+			verdict = "drop"
+		}
+		if err := runNFT("add", "rule", "inet", nftTable, chain,
+			"ip", "saddr", peerIP, "ip", "daddr", rule.CIDR, verdict); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownPeerACL removes a peer's chain; absent chains are not an error
+func teardownPeerACL(peerID string) {
+	chain := peerACLChain(peerID)
+	if err := runNFT("flush", "chain", "inet", nftTable, chain); err != nil {
+		return // chain doesn't exist
+	}
+	runNFT("delete", "chain", "inet", nftTable, chain)
+}
+
+// GetPeerACL returns a peer's rules and whether they're currently enforced
+func GetPeerACL(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		var disabled int
+		if err := db.QueryRow("SELECT COALESCE(disabled, 0) FROM peers WHERE id = ?", id).Scan(&disabled); err != nil {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+
+		rules, err := loadPeerACL(db, id)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rules":    rules,
+			"enforced": disabled == 0 && len(rules) > 0,
+		})
+	}
+}
+
+// UpdatePeerACL replaces a peer's ACL wholesale and re-applies the nftables
+// chain immediately when the peer is enabled
+func UpdatePeerACL(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		var name string
+		if err := db.QueryRow("SELECT name FROM peers WHERE id = ?", id).Scan(&name); err != nil {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+
+		var req struct {
+			Rules []ACLRule `json:"rules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		for i := range req.Rules {
+			if req.Rules[i].Action != "allow" && req.Rules[i].Action != "deny" {
+				http.Error(w, "Invalid action (must be allow or deny)", http.StatusBadRequest)
+				return
+			}
+			// Accept bare IPs as /32 for convenience
+			if !strings.Contains(req.Rules[i].CIDR, "/") {
+				req.Rules[i].CIDR += "/32"
+			}
+			if _, _, err := net.ParseCIDR(req.Rules[i].CIDR); err != nil {
+				http.Error(w, "Invalid CIDR: "+req.Rules[i].CIDR, http.StatusBadRequest)
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		tx.Exec("DELETE FROM peer_acls WHERE peer_id = ?", id)
+		for i, rule := range req.Rules {
+			if _, err := tx.Exec("INSERT INTO peer_acls (peer_id, position, action, cidr) VALUES (?, ?, ?, ?)",
+				id, i, rule.Action, rule.CIDR); err != nil {
+				http.Error(w, "Failed to store ACL", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		nftApplied := true
+		if err := applyPeerACL(db, id); err != nil {
+			nftApplied = false
+			slog.Warn("nftables ACL apply failed", "peer", name, "error", err)
+		}
+
+		WriteAudit(db, r, "ACL_UPDATE", name, fmt.Sprintf("%d ACL rules set", len(req.Rules)))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":      "updated",
+			"rules":       req.Rules,
+			"nft_applied": nftApplied,
+		})
+	}
+}
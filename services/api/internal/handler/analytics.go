@@ -1,141 +1,365 @@
-package handler
-
-import (
-	"database/sql"
-	"encoding/json"
-	"io"
-	"net/http"
-)
-
-// GeoIPData represents geolocation data for a peer
-type GeoIPData struct {
-	PeerID    int     `json:"peer_id"`
-	PeerName  string  `json:"peer_name"`
-	IP        string  `json:"ip"`
-	Country   string  `json:"country"`
-	City      string  `json:"city"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
-}
-
-// GetPeerGeoIP returns geolocation data for all connected peers
-func GetPeerGeoIP(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query(`
-			SELECT p.id, p.name, p.last_endpoint 
-			FROM peers p 
-			WHERE p.last_endpoint IS NOT NULL AND p.last_endpoint != ''
-		`)
-		if err != nil {
-			http.Error(w, "DB Error", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		var results []GeoIPData
-		for rows.Next() {
-			var id int
-			var name, endpoint string
-			if err := rows.Scan(&id, &name, &endpoint); err != nil {
-				continue
-			}
-
-
-			
-			ip := endpoint
-			if idx := len(endpoint) - 1; idx > 0 {
-				for i := len(endpoint) - 1; i >= 0; i-- {
-					if endpoint[i] == ':' {
-						ip = endpoint[:i]
-						break
-					}
-				}
-			}
-
-			// Lookup geo data (using ip-api.com free tier)
-			geo := lookupGeoIP(ip)
-			geo.PeerID = id
-			geo.PeerName = name
-			geo.IP = ip
-			results = append(results, geo)
-		}
-
-		json.NewEncoder(w).Encode(results)
-	}
-}
-
-func lookupGeoIP(ip string) GeoIPData {
-	resp, err := http.Get("http://ip-api.com/json/" + ip)
-	if err != nil {
-		return GeoIPData{}
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	var data struct {
-		Country string  `json:"country"`
-		City    string  `json:"city"`
-		Lat     float64 `json:"lat"`
-		Lon     float64 `json:"lon"`
-	}
-	json.Unmarshal(body, &data)
-
-	return GeoIPData{
-		Country:   data.Country,
-		City:      data.City,
-		Latitude:  data.Lat,
-		Longitude: data.Lon,
-	}
-}
-
-// TrafficStats represents traffic data for graphing
-type TrafficStats struct {
-	PeerID    int    `json:"peer_id"`
-	PeerName  string `json:"peer_name"`
-	Timestamp string `json:"timestamp"`
-	RXBytes   int64  `json:"rx_bytes"`
-	TXBytes   int64  `json:"tx_bytes"`
-}
-
-// GetTrafficHistory returns historical traffic data for charts
-func GetTrafficHistory(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		peerID := r.URL.Query().Get("peer_id")
-		
-		var rows *sql.Rows
-		var err error
-		
-		if peerID != "" {
-			// Use parameterized query to prevent SQL injection
-			rows, err = db.Query(`
-				SELECT peer_id, timestamp, rx_bytes, tx_bytes 
-				FROM traffic_history 
-				WHERE timestamp > datetime('now', '-24 hours')
-				AND peer_id = ?
-				ORDER BY timestamp ASC
-			`, peerID)
-		} else {
-			rows, err = db.Query(`
-				SELECT peer_id, timestamp, rx_bytes, tx_bytes 
-				FROM traffic_history 
-				WHERE timestamp > datetime('now', '-24 hours')
-				ORDER BY timestamp ASC
-			`)
-		}
-		
-		if err != nil {
-			http.Error(w, "DB Error", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		var stats []TrafficStats
-		for rows.Next() {
-			var s TrafficStats
-			rows.Scan(&s.PeerID, &s.Timestamp, &s.RXBytes, &s.TXBytes)
-			stats = append(stats, s)
-		}
-
-		json.NewEncoder(w).Encode(stats)
-	}
-}
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// GeoIPData represents geolocation data for a peer
+type GeoIPData struct {
+	PeerID    int     `json:"peer_id"`
+	PeerName  string  `json:"peer_name"`
+	IP        string  `json:"ip"`
+	Country   string  `json:"country"`
+	City      string  `json:"city"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// GetPeerGeoIP returns geolocation data for all connected peers
+func GetPeerGeoIP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`
+			SELECT p.id, p.name, p.last_endpoint 
+			FROM peers p 
+			WHERE p.last_endpoint IS NOT NULL AND p.last_endpoint != ''
+		`)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		var results []GeoIPData
+		for rows.Next() {
+			var id int
+			var name, endpoint string
+			if err := rows.Scan(&id, &name, &endpoint); err != nil {
+				continue
+			}
+
+
+			
+			ip := endpoint
+			if idx := len(endpoint) - 1; idx > 0 {
+				for i := len(endpoint) - 1; i >= 0; i-- {
+					if endpoint[i] == ':' {
+						ip = endpoint[:i]
+						break
+					}
+				}
+			}
+
+			// Lookup geo data (using ip-api.com free tier); anonymized IPs
+			// still geolocate to subnet precision
+			ip = AnonymizeIP(ip)
+			geo := lookupGeoIP(ip)
+			if geo.Country == "" {
+				// Lookup failed with nothing cached; omit the peer rather
+				// than plot a zero struct at 0,0
+				continue
+			}
+			geo.PeerID = id
+			geo.PeerName = name
+			geo.IP = ip
+			results = append(results, geo)
+		}
+
+		json.NewEncoder(w).Encode(results)
+	}
+}
+
+// geoIPClient bounds how long a single lookup can hold up the analytics
+// endpoint
+var geoIPClient = &http.Client{Timeout: 3 * time.Second}
+
+// Circuit breaker for the external GeoIP service: after a few consecutive
+// failures we stop calling out and return empty geo data for a cooldown,
+// so an ip-api.com outage can't stall every peer in the response.
+const (
+	geoIPFailureThreshold = 3
+	geoIPCooldown         = 5 * time.Minute
+)
+
+// Successful lookups are cached per IP so a dashboard refresh doesn't burn
+// through ip-api.com's 45 req/min free tier; peers rarely move continents
+// inside the TTL
+const geoIPCacheTTL = 6 * time.Hour
+
+type geoIPCacheEntry struct {
+	data GeoIPData
+	at   time.Time
+}
+
+var (
+	geoIPMu        sync.Mutex
+	geoIPFailures  int
+	geoIPOpenUntil time.Time
+	geoIPCache     = map[string]geoIPCacheEntry{}
+	geoIPInflight  = map[string]chan struct{}{} // dedupes concurrent lookups per IP
+)
+
+// geoIPAllowed reports whether the breaker permits an outbound call
+func geoIPAllowed() bool {
+	geoIPMu.Lock()
+	defer geoIPMu.Unlock()
+	return time.Now().After(geoIPOpenUntil)
+}
+
+func geoIPRecordResult(ok bool) {
+	geoIPMu.Lock()
+	defer geoIPMu.Unlock()
+	if ok {
+		geoIPFailures = 0
+		return
+	}
+	geoIPFailures++
+	if geoIPFailures >= geoIPFailureThreshold {
+		geoIPOpenUntil = time.Now().Add(geoIPCooldown)
+		geoIPFailures = 0
+		slog.Warn("GeoIP service failing, circuit opened", "cooldown", geoIPCooldown)
+	}
+}
+
+// lookupGeoIP serves from the cache when fresh, joins an in-flight lookup for
+// the same IP instead of duplicating it, and falls back to stale cached data
+// when the upstream call fails
+func lookupGeoIP(ip string) GeoIPData {
+	geoIPMu.Lock()
+	if e, ok := geoIPCache[ip]; ok && time.Since(e.at) < geoIPCacheTTL {
+		geoIPMu.Unlock()
+		return e.data
+	}
+	if ch, ok := geoIPInflight[ip]; ok {
+		// Another request is already resolving this IP; wait for it and
+		// take whatever it cached
+		geoIPMu.Unlock()
+		<-ch
+		geoIPMu.Lock()
+		defer geoIPMu.Unlock()
+		return geoIPCache[ip].data
+	}
+	ch := make(chan struct{})
+	geoIPInflight[ip] = ch
+	geoIPMu.Unlock()
+
+	data, ok := fetchGeoIP(ip)
+
+	geoIPMu.Lock()
+	defer geoIPMu.Unlock()
+	if ok {
+		geoIPCache[ip] = geoIPCacheEntry{data: data, at: time.Now()}
+	} else if stale, exists := geoIPCache[ip]; exists {
+		data = stale.data // stale beats empty
+	}
+	delete(geoIPInflight, ip)
+	close(ch)
+	return data
+}
+
+// geoIPLocalDB is the optional MaxMind GeoLite2 reader, loaded once at
+// startup from GEOIP_DB_PATH; its lookups never leave the box, so it always
+// beats the HTTP API when present. The reader only reads an immutable byte
+// slice, making concurrent lookups safe without a lock.
+var geoIPLocalDB *mmdbReader
+
+// InitGeoIPDB loads the local GeoIP database if one is configured
+func InitGeoIPDB() {
+	path := os.Getenv("GEOIP_DB_PATH")
+	if path == "" {
+		return
+	}
+	r, err := openMMDB(path)
+	if err != nil {
+		slog.Warn("Could not load local GeoIP database, falling back to ip-api.com", "path", path, "error", err)
+		return
+	}
+	geoIPLocalDB = r
+	slog.Info("Local GeoIP database loaded", "path", path)
+}
+
+// lookupGeoIPLocal resolves ip against the local MaxMind DB
+func lookupGeoIPLocal(ip string) (GeoIPData, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return GeoIPData{}, false
+	}
+	record, ok := geoIPLocalDB.lookup(parsed)
+	if !ok {
+		return GeoIPData{}, false
+	}
+
+	englishName := func(section string) string {
+		m, _ := record[section].(map[string]interface{})
+		names, _ := m["names"].(map[string]interface{})
+		s, _ := names["en"].(string)
+		return s
+	}
+	var lat, lon float64
+	if loc, ok := record["location"].(map[string]interface{}); ok {
+		lat, _ = loc["latitude"].(float64)
+		lon, _ = loc["longitude"].(float64)
+	}
+
+	data := GeoIPData{
+		Country:   englishName("country"),
+		City:      englishName("city"),
+		Latitude:  lat,
+		Longitude: lon,
+	}
+	return data, data.Country != ""
+}
+
+// fetchGeoIP prefers the local database and otherwise calls the upstream
+// API, gated by the circuit breaker
+func fetchGeoIP(ip string) (GeoIPData, bool) {
+	if geoIPLocalDB != nil {
+		if data, ok := lookupGeoIPLocal(ip); ok {
+			return data, true
+		}
+		// Local DB has no entry; still try upstream, it may know more
+	}
+	if !geoIPAllowed() {
+		return GeoIPData{}, false
+	}
+
+	resp, err := geoIPClient.Get("https://ip-api.com/json/" + ip)
+	if err != nil {
+		geoIPRecordResult(false)
+		return GeoIPData{}, false
+	}
+	geoIPRecordResult(resp.StatusCode < 500)
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	var data struct {
+		Country string  `json:"country"`
+		City    string  `json:"city"`
+		Lat     float64 `json:"lat"`
+		Lon     float64 `json:"lon"`
+	}
+	json.Unmarshal(body, &data)
+
+	return GeoIPData{
+		Country:   data.Country,
+		City:      data.City,
+		Latitude:  data.Lat,
+		Longitude: data.Lon,
+	}, data.Country != ""
+}
+
+// GeoIPCountry resolves just the country for an IP through the shared GeoIP
+// cache; empty string when unknown. Used by workers for notification context.
+func GeoIPCountry(ip string) string {
+	return lookupGeoIP(ip).Country
+}
+
+// TrafficStats represents traffic data for graphing
+type TrafficStats struct {
+	PeerID    int    `json:"peer_id"`
+	PeerName  string `json:"peer_name"`
+	Timestamp string `json:"timestamp"`
+	RXBytes   int64  `json:"rx_bytes"`
+	TXBytes   int64  `json:"tx_bytes"`
+}
+
+// BandwidthBucket is one aggregated rollup row for a peer
+type BandwidthBucket struct {
+	Bucket  string `json:"bucket"`
+	RXBytes int64  `json:"rx_bytes"`
+	TXBytes int64  `json:"tx_bytes"`
+}
+
+// GetPeerBandwidth returns a peer's aggregated bandwidth rollups for
+// long-term graphs. ?period=hour reads bandwidth_hourly (default, last 7
+// days), ?period=day reads bandwidth_daily (last 90 days).
+func GetPeerBandwidth(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		var query string
+		switch r.URL.Query().Get("period") {
+		case "", "hour":
+			query = `
+				SELECT bucket, rx_bytes, tx_bytes FROM bandwidth_hourly
+				WHERE peer_id = ? AND bucket > datetime('now', '-7 days')
+				ORDER BY bucket ASC`
+		case "day":
+			query = `
+				SELECT bucket, rx_bytes, tx_bytes FROM bandwidth_daily
+				WHERE peer_id = ? AND bucket > date('now', '-90 days')
+				ORDER BY bucket ASC`
+		default:
+			http.Error(w, "Invalid period (use hour or day)", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := db.Query(query, id)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		buckets := []BandwidthBucket{}
+		for rows.Next() {
+			var b BandwidthBucket
+			if err := rows.Scan(&b.Bucket, &b.RXBytes, &b.TXBytes); err != nil {
+				continue
+			}
+			buckets = append(buckets, b)
+		}
+
+		json.NewEncoder(w).Encode(buckets)
+	}
+}
+
+// GetTrafficHistory returns historical traffic data for charts
+func GetTrafficHistory(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peerID := r.URL.Query().Get("peer_id")
+		
+		var rows *sql.Rows
+		var err error
+		
+		if peerID != "" {
+			// Use parameterized query to prevent SQL injection
+			rows, err = db.Query(`
+				SELECT peer_id, timestamp, rx_bytes, tx_bytes 
+				FROM traffic_history 
+				WHERE timestamp > datetime('now', '-24 hours')
+				AND peer_id = ?
+				ORDER BY timestamp ASC
+			`, peerID)
+		} else {
+			rows, err = db.Query(`
+				SELECT peer_id, timestamp, rx_bytes, tx_bytes 
+				FROM traffic_history 
+				WHERE timestamp > datetime('now', '-24 hours')
+				ORDER BY timestamp ASC
+			`)
+		}
+		
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		var stats []TrafficStats
+		for rows.Next() {
+			var s TrafficStats
+			rows.Scan(&s.PeerID, &s.Timestamp, &s.RXBytes, &s.TXBytes)
+			stats = append(stats, s)
+		}
+
+		json.NewEncoder(w).Encode(stats)
+	}
+}
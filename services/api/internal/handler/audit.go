@@ -0,0 +1,302 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/middleware"
+)
+
+// ANONYMIZE_IPS=true truncates client IPs at every capture point (audit logs,
+// GeoIP lookups) for GDPR-style deployments: IPv4 keeps the /24, IPv6 the /48.
+var anonymizeIPs = os.Getenv("ANONYMIZE_IPS") == "true"
+
+// AnonymizeIP applies the configured truncation; without the toggle (or for
+// unparseable input) the address passes through unchanged
+func AnonymizeIP(ipStr string) string {
+	if !anonymizeIPs || ipStr == "" {
+		return ipStr
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return ipStr
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return net.IPv4(v4[0], v4[1], v4[2], 0).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// AuditEntry is the audit row shape mirrored to the webhook
+type AuditEntry struct {
+	UserID    int    `json:"user_id"`
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+	Details   string `json:"details"`
+	IPAddress string `json:"ip_address,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// WriteAudit inserts an audit row and mirrors it to the configured webhook.
+// Pass the request so user ID, client IP and request ID are captured
+// consistently; r may be nil for worker/startup contexts.
+func WriteAudit(db *sql.DB, r *http.Request, action, target, details string) {
+	userID := 0
+	if r != nil {
+		userID = middleware.GetUserID(r)
+	}
+	WriteAuditAs(db, r, userID, action, target, details)
+}
+
+// WriteAuditAs is WriteAudit with an explicit user ID, for call sites where
+// the acting user isn't in the request context yet (login, token flows)
+func WriteAuditAs(db *sql.DB, r *http.Request, userID int, action, target, details string) {
+	entry := AuditEntry{
+		UserID:    userID,
+		Action:    action,
+		Target:    target,
+		Details:   details,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if r != nil {
+		entry.IPAddress = AnonymizeIP(middleware.GetClientIP(r))
+		entry.RequestID = middleware.GetRequestID(r)
+	}
+
+	_, err := db.Exec("INSERT INTO audit_logs (user_id, action, target, details, ip_address, request_id) VALUES (?, ?, ?, ?, ?, ?)",
+		entry.UserID, entry.Action, entry.Target, entry.Details, entry.IPAddress, entry.RequestID)
+	if err != nil {
+		slog.Error("Audit insert failed", "action", action, "err", err)
+	}
+
+	go dispatchAuditWebhook(db, entry)
+}
+
+// parseAuditTime accepts RFC3339, "2006-01-02 15:04:05" or a bare date and
+// returns the UTC form audit_logs.created_at is stored in
+func parseAuditTime(raw string) (string, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t.UTC().Format("2006-01-02 15:04:05"), nil
+		}
+	}
+	return "", fmt.Errorf("unrecognized timestamp %q (use RFC3339 or YYYY-MM-DD)", raw)
+}
+
+// QueryAuditLogs searches the audit trail with ?action=, ?user_id=, ?from=/
+// ?to= and page/page_size. Every filter is a bound parameter; the total count
+// reflects the filtered set so pagination works during an investigation.
+func QueryAuditLogs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		page := 1
+		pageSize := DefaultPageSize
+		if p := q.Get("page"); p != "" {
+			if v, err := strconv.Atoi(p); err == nil && v > 0 {
+				page = v
+			}
+		}
+		if ps := q.Get("page_size"); ps != "" {
+			if v, err := strconv.Atoi(ps); err == nil && v > 0 && v <= MaxPageSize {
+				pageSize = v
+			}
+		}
+
+		var conds []string
+		args := []interface{}{}
+		if action := q.Get("action"); action != "" {
+			conds = append(conds, "a.action = ?")
+			args = append(args, action)
+		}
+		if uid := q.Get("user_id"); uid != "" {
+			v, err := strconv.Atoi(uid)
+			if err != nil {
+				http.Error(w, "Invalid user_id", http.StatusBadRequest)
+				return
+			}
+			conds = append(conds, "a.user_id = ?")
+			args = append(args, v)
+		}
+		if from := q.Get("from"); from != "" {
+			ts, err := parseAuditTime(from)
+			if err != nil {
+				http.Error(w, "Invalid from: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			conds = append(conds, "a.created_at >= ?")
+			args = append(args, ts)
+		}
+		if to := q.Get("to"); to != "" {
+			ts, err := parseAuditTime(to)
+			if err != nil {
+				http.Error(w, "Invalid to: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			conds = append(conds, "a.created_at <= ?")
+			args = append(args, ts)
+		}
+
+		where := ""
+		if len(conds) > 0 {
+			where = " WHERE " + strings.Join(conds, " AND ")
+		}
+
+		var total int
+		db.QueryRow("SELECT COUNT(*) FROM audit_logs a"+where, args...).Scan(&total)
+
+		query := `SELECT a.created_at, a.user_id, COALESCE(u.username, 'system'),
+			a.action, COALESCE(a.target, ''), COALESCE(a.details, ''),
+			COALESCE(a.ip_address, ''), COALESCE(a.request_id, '')
+			FROM audit_logs a
+			LEFT JOIN users u ON a.user_id = u.id` + where + `
+			ORDER BY a.created_at DESC, a.id DESC LIMIT ? OFFSET ?`
+		rows, err := db.Query(query, append(args, pageSize, (page-1)*pageSize)...)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		logs := []map[string]interface{}{}
+		for rows.Next() {
+			var createdAt, username, action, target, details, ip, requestID string
+			var userID int
+			if rows.Scan(&createdAt, &userID, &username, &action, &target, &details, &ip, &requestID) != nil {
+				continue
+			}
+			logs = append(logs, map[string]interface{}{
+				"created_at": createdAt,
+				"user_id":    userID,
+				"username":   username,
+				"action":     action,
+				"target":     target,
+				"details":    details,
+				"ip_address": ip,
+				"request_id": requestID,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"logs":        logs,
+			"total":       total,
+			"page":        page,
+			"page_size":   pageSize,
+			"total_pages": (total + pageSize - 1) / pageSize,
+		})
+	}
+}
+
+// Dedicated client for audit delivery: short timeout, TLS 1.2+
+var auditWebhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	},
+}
+
+// validateAuditWebhookURL blocks loopback/link-local/private destinations
+// so a compromised admin account can't aim the webhook at internal services
+func validateAuditWebhookURL(urlStr string) error {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("invalid scheme")
+	}
+
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() {
+			return fmt.Errorf("local/private IP blocked: %s", ip.String())
+		}
+	}
+	return nil
+}
+
+// dispatchAuditWebhook sends the entry to the SIEM webhook if the action is
+// in the configured set. Delivery is best-effort: failures are logged, never
+// surfaced to the request that triggered the audit.
+func dispatchAuditWebhook(db *sql.DB, entry AuditEntry) {
+	var webhookURL, actions string
+	db.QueryRow("SELECT value FROM system_config WHERE key='audit_webhook_url'").Scan(&webhookURL)
+	if webhookURL == "" {
+		return
+	}
+
+	db.QueryRow("SELECT value FROM system_config WHERE key='audit_webhook_actions'").Scan(&actions)
+	if actions != "" && actions != "*" {
+		matched := false
+		for _, a := range strings.Split(actions, ",") {
+			if strings.TrimSpace(a) == entry.Action {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return
+		}
+	}
+
+	if err := validateAuditWebhookURL(webhookURL); err != nil {
+		slog.Warn("Audit webhook blocked", "err", err)
+		return
+	}
+
+	body, _ := json.Marshal(entry)
+
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var secret string
+	db.QueryRow("SELECT value FROM system_config WHERE key='audit_webhook_secret'").Scan(&secret)
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Audit-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := auditWebhookClient.Do(req)
+	if err != nil {
+		slog.Warn("Audit webhook delivery failed", "action", entry.Action, "err", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		slog.Warn("Audit webhook rejected", "action", entry.Action, "status", resp.Status)
+	}
+}
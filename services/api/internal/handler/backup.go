@@ -10,7 +10,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
 )
 
 // BackupConfig represents S3/Backblaze configuration
@@ -18,20 +22,46 @@ type BackupConfig struct {
 	Provider        string `json:"provider"` // s3, backblaze, local
 	Endpoint        string `json:"endpoint"`
 	Bucket          string `json:"bucket"`
-	AccessKeyID     string `json:"access_key_id"`
-	SecretAccessKey string `json:"secret_access_key"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
 	Region          string `json:"region"`
+	HasCredentials  bool   `json:"has_credentials"`
+}
+
+// healBackupSecrets encrypts any plaintext credentials left over from older
+// installs in place, mirroring the peer key self-healing in
+// syncPeersWithFiles
+func healBackupSecrets(db *sql.DB) {
+	for _, key := range []string{"backup_access_key", "backup_secret_key"} {
+		var value string
+		db.QueryRow("SELECT value FROM system_config WHERE key=?", key).Scan(&value)
+		if value == "" {
+			continue
+		}
+		if _, err := auth.Decrypt(value); err != nil {
+			if enc, encErr := auth.Encrypt(value); encErr == nil {
+				db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES (?, ?)", key, enc)
+			}
+		}
+	}
 }
 
 // GetBackupConfig returns current backup settings
 func GetBackupConfig(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		healBackupSecrets(db)
+
 		var cfg BackupConfig
 		db.QueryRow("SELECT value FROM system_config WHERE key='backup_provider'").Scan(&cfg.Provider)
 		db.QueryRow("SELECT value FROM system_config WHERE key='backup_endpoint'").Scan(&cfg.Endpoint)
 		db.QueryRow("SELECT value FROM system_config WHERE key='backup_bucket'").Scan(&cfg.Bucket)
 		db.QueryRow("SELECT value FROM system_config WHERE key='backup_region'").Scan(&cfg.Region)
-		// Don't return secrets
+
+		// Don't return secrets - just whether they're set
+		var accessKey string
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_access_key'").Scan(&accessKey)
+		cfg.HasCredentials = accessKey != ""
+
 		json.NewEncoder(w).Encode(cfg)
 	}
 }
@@ -50,11 +80,16 @@ func UpdateBackupConfig(db *sql.DB) http.HandlerFunc {
 		db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('backup_bucket', ?)", cfg.Bucket)
 		db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('backup_region', ?)", cfg.Region)
 		
+		// Credentials are encrypted at rest; uploads decrypt on use
 		if cfg.AccessKeyID != "" {
-			db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('backup_access_key', ?)", cfg.AccessKeyID)
+			if enc, err := auth.Encrypt(cfg.AccessKeyID); err == nil {
+				db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('backup_access_key', ?)", enc)
+			}
 		}
 		if cfg.SecretAccessKey != "" {
-			db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('backup_secret_key', ?)", cfg.SecretAccessKey)
+			if enc, err := auth.Encrypt(cfg.SecretAccessKey); err == nil {
+				db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('backup_secret_key', ?)", enc)
+			}
 		}
 
 		w.WriteHeader(http.StatusOK)
@@ -62,6 +97,70 @@ func UpdateBackupConfig(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// TestBackupDestination validates the configured backup destination without
+// creating a real backup: a test PUT+DELETE for S3/Backblaze, a writability
+// and free-space check for local
+func TestBackupDestination(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cfg BackupConfig
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_provider'").Scan(&cfg.Provider)
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_endpoint'").Scan(&cfg.Endpoint)
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_bucket'").Scan(&cfg.Bucket)
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_region'").Scan(&cfg.Region)
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_access_key'").Scan(&cfg.AccessKeyID)
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_secret_key'").Scan(&cfg.SecretAccessKey)
+
+		detail := ""
+		var err error
+		switch cfg.Provider {
+		case "s3", "backblaze":
+			err = testBackupS3(cfg)
+			if err == nil {
+				detail = "test object written and deleted in bucket " + cfg.Bucket
+			}
+		default: // local
+			detail, err = testLocalBackupDir("/tmp")
+		}
+
+		if err != nil {
+			WriteAudit(db, r, "BACKUP_TEST_FAIL", cfg.Provider, err.Error())
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":   "failed",
+				"provider": cfg.Provider,
+				"error":    err.Error(),
+			})
+			return
+		}
+
+		WriteAudit(db, r, "BACKUP_TEST", cfg.Provider, detail)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":   "ok",
+			"provider": cfg.Provider,
+			"detail":   detail,
+		})
+	}
+}
+
+// testLocalBackupDir confirms the backup directory accepts writes and reports
+// the free space left on its filesystem
+func testLocalBackupDir(dir string) (string, error) {
+	f, err := os.CreateTemp(dir, "samnet-backup-test-*")
+	if err != nil {
+		return "", fmt.Errorf("backup directory %s not writable: %w", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err == nil {
+		free := int64(st.Bavail) * st.Bsize
+		return fmt.Sprintf("%s writable, %s free", dir, formatBytes(free)), nil
+	}
+	return dir + " writable", nil
+}
+
 // CreateBackup creates a backup archive and optionally uploads to configured provider
 func CreateBackup(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -86,7 +185,8 @@ func CreateBackup(db *sql.DB) http.HandlerFunc {
 		addFileToTar(tarWriter, "/var/lib/samnet-wg/samnet.db", "samnet.db")
 		addFileToTar(tarWriter, "/var/lib/samnet-wg/master.key", "master.key")
 		
-		addFileToTar(tarWriter, "/etc/wireguard/wg0.conf", "wg0.conf")
+		wgConf := config.Get().WGConfigPath
+		addFileToTar(tarWriter, wgConf, filepath.Base(wgConf))
 		addFileToTar(tarWriter, "/etc/wireguard/privatekey", "privatekey")
 		addFileToTar(tarWriter, "/etc/wireguard/publickey", "publickey")
 
@@ -94,11 +194,23 @@ func CreateBackup(db *sql.DB) http.HandlerFunc {
 		gzWriter.Close()
 		file.Close()
 
-		var provider string
-		db.QueryRow("SELECT value FROM system_config WHERE key='backup_provider'").Scan(&provider)
+		var cfg BackupConfig
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_provider'").Scan(&cfg.Provider)
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_endpoint'").Scan(&cfg.Endpoint)
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_bucket'").Scan(&cfg.Bucket)
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_region'").Scan(&cfg.Region)
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_access_key'").Scan(&cfg.AccessKeyID)
+		db.QueryRow("SELECT value FROM system_config WHERE key='backup_secret_key'").Scan(&cfg.SecretAccessKey)
 
-		if provider == "s3" || provider == "backblaze" {
-			db.Exec("INSERT INTO audit_logs (action, details) VALUES ('BACKUP_CREATE', ?)", backupPath)
+		objectKey := ""
+		if cfg.Provider == "s3" || cfg.Provider == "backblaze" {
+			objectKey = fmt.Sprintf("samnet-backup-%s.tar.gz", timestamp)
+			if err := uploadBackupS3(cfg, backupPath, objectKey); err != nil {
+				WriteAudit(db, r, "BACKUP_UPLOAD_FAIL", objectKey, err.Error())
+				http.Error(w, "Backup created locally but upload failed: "+err.Error(), http.StatusBadGateway)
+				return
+			}
+			WriteAudit(db, r, "BACKUP_UPLOAD", objectKey, "Uploaded to "+cfg.Provider+" bucket "+cfg.Bucket)
 		}
 
 		// Return the backup file or success
@@ -107,10 +219,15 @@ func CreateBackup(db *sql.DB) http.HandlerFunc {
 			w.Header().Set("Content-Type", "application/gzip")
 			http.ServeFile(w, r, backupPath)
 		} else {
-			json.NewEncoder(w).Encode(map[string]string{
+			resp := map[string]string{
 				"status": "created",
 				"path":   backupPath,
-			})
+			}
+			if objectKey != "" {
+				resp["status"] = "uploaded"
+				resp["object_key"] = objectKey
+			}
+			json.NewEncoder(w).Encode(resp)
 		}
 	}
 }
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ClientConfigParams holds everything needed to render a client .conf.
+// PrivateKey may be a placeholder when rendering previews.
+type ClientConfigParams struct {
+	PrivateKey         string
+	Address            string // client address with subnet mask, e.g. 10.100.0.5/24
+	DNSProfile         string // "" or a dns_profiles name (adblock/family seeded)
+	AllowedIPsOverride string // per-peer routing override, beats split/full tunnel
+	Endpoint           string // host:port
+	SplitTunnel        *bool  // nil = use the global split_tunnel setting
+	TunnelMode         string // per-peer "full"/"split"; ""/"inherit" falls through
+}
+
+// BuildClientConfig renders the client config text from the given parameters
+// plus the global settings (MTU, split tunnel, obfuscation) in system_config.
+// Download, QR and preview all funnel through here so they can't drift apart.
+func BuildClientConfig(db *sql.DB, p ClientConfigParams) string {
+	dns := defaultDNSServers(db)
+	if servers := dnsProfileServers(db, p.DNSProfile); servers != "" {
+		dns = servers
+	}
+
+	// Use 1380 for better compatibility with PPPoE, tunnels, etc.
+	mtu := "1380"
+	db.QueryRow("SELECT value FROM system_config WHERE key='mtu'").Scan(&mtu)
+
+	var subnetCIDR string
+	db.QueryRow("SELECT value FROM system_config WHERE key='subnet_cidr'").Scan(&subnetCIDR)
+	if subnetCIDR == "" {
+		subnetCIDR = "10.100.0.0/24"
+	}
+
+	// Per-peer tunnel mode pinned at creation beats everything; "inherit"
+	// keeps following the global flag so existing peers are unaffected
+	split := false
+	if p.TunnelMode == "full" {
+		// split stays false
+	} else if p.TunnelMode == "split" {
+		split = true
+	} else if p.SplitTunnel != nil {
+		split = *p.SplitTunnel
+	} else {
+		var splitTunnel string
+		db.QueryRow("SELECT value FROM system_config WHERE key='split_tunnel'").Scan(&splitTunnel)
+		split = splitTunnel == "true"
+	}
+
+	cfg := "[Interface]\n"
+	cfg += "PrivateKey = " + p.PrivateKey + "\n"
+	cfg += "Address = " + p.Address + "\n"
+	cfg += "MTU = " + mtu + "\n"
+	cfg += obfuscationLines(db)
+	cfg += "DNS = " + dns + "\n\n"
+	cfg += "[Peer]\n"
+	cfg += "PublicKey = " + GetServerPublicKey() + "\n"
+
+	if p.AllowedIPsOverride != "" {
+		cfg += "AllowedIPs = " + p.AllowedIPsOverride + "\n"
+	} else if split {
+		// Split tunnel: Only route VPN subnet and private ranges
+		cfg += fmt.Sprintf("AllowedIPs = %s, 192.168.0.0/16, 172.16.0.0/12, 10.0.0.0/8\n", subnetCIDR)
+	} else {
+		// Full tunnel: Route everything
+		cfg += "AllowedIPs = 0.0.0.0/0, ::/0\n"
+	}
+
+	cfg += "Endpoint = " + p.Endpoint + "\n"
+	cfg += "PersistentKeepalive = 25\n"
+	return cfg
+}
+
+// ConfigPreview renders the exact config a peer would get if created with the
+// proposed settings, with a placeholder private key and no side effects. The
+// candidate IP comes from the normal allocator inside a rolled-back
+// transaction so the preview matches what creation would actually pick.
+func ConfigPreview(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name               string `json:"name"`
+			IP                 string `json:"ip,omitempty"`
+			DNSProfile         string `json:"dns_profile,omitempty"`
+			AllowedIPsOverride string `json:"allowed_ips_override,omitempty"`
+			ServerPort         int    `json:"server_port,omitempty"`
+			SplitTunnel        *bool  `json:"split_tunnel,omitempty"`
+			Endpoint           string `json:"endpoint,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if req.AllowedIPsOverride != "" {
+			if err := validateAllowedIPsOverride(req.AllowedIPsOverride); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+			return
+		}
+		nextIP, err := AllocateIP(tx, req.IP)
+		tx.Rollback()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		endpoint, err := resolveEndpointHost(db, req.Endpoint)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		port := "51820"
+		db.QueryRow("SELECT value FROM system_config WHERE key='listen_port'").Scan(&port)
+		if req.ServerPort > 0 {
+			port = strconv.Itoa(req.ServerPort)
+		}
+
+		cfg := BuildClientConfig(db, ClientConfigParams{
+			PrivateKey:         "<GENERATED_ON_CREATE>",
+			Address:            nextIP,
+			DNSProfile:         req.DNSProfile,
+			AllowedIPsOverride: req.AllowedIPsOverride,
+			Endpoint:           endpoint + ":" + port,
+			SplitTunnel:        req.SplitTunnel,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"name":    req.Name,
+			"address": nextIP,
+			"config":  cfg,
+		})
+	}
+}
+
+// subnetMaskBits returns the prefix length of the configured subnet
+func subnetMaskBits(db *sql.DB) int {
+	var subnetCIDR string
+	db.QueryRow("SELECT value FROM system_config WHERE key='subnet_cidr'").Scan(&subnetCIDR)
+	if subnetCIDR == "" {
+		subnetCIDR = "10.100.0.0/24"
+	}
+	_, ipNet, err := net.ParseCIDR(subnetCIDR)
+	if err != nil {
+		return 24
+	}
+	ones, _ := ipNet.Mask.Size()
+	return ones
+}
+
+// clientAddressFor converts a stored allowed_ips value into the client
+// Address form carrying the subnet masks (both families when dual-stack)
+func clientAddressFor(db *sql.DB, allowedIPs string) string {
+	var parts []string
+	for _, p := range splitAddrList(allowedIPs) {
+		ipStr := strings.Split(p, "/")[0]
+		if strings.Contains(ipStr, ":") {
+			ones := 64
+			if cidrV6 := getSubnetV6(db); cidrV6 != "" {
+				if _, ipNet, err := net.ParseCIDR(cidrV6); err == nil {
+					ones, _ = ipNet.Mask.Size()
+				}
+			}
+			parts = append(parts, fmt.Sprintf("%s/%d", ipStr, ones))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s/%d", ipStr, subnetMaskBits(db)))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// DNSProfile maps a profile name peers can reference (peer_settings.dns_profile)
+// to the resolver list rendered into their configs
+type DNSProfile struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Servers     string `json:"servers"` // comma-separated resolver IPs
+	Description string `json:"description,omitempty"`
+}
+
+var dnsProfileNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// dnsProfileServers resolves a profile name to its server list. The table
+// wins; the pre-table built-ins remain as fallback so configs keep rendering
+// on a DB that missed the seed migration. Empty string means "no profile" -
+// callers keep their own default.
+func dnsProfileServers(db *sql.DB, profile string) string {
+	if profile == "" {
+		return ""
+	}
+	var servers string
+	if err := db.QueryRow("SELECT servers FROM dns_profiles WHERE name = ?", profile).Scan(&servers); err == nil && servers != "" {
+		return servers
+	}
+	switch profile {
+	case "adblock":
+		return "94.140.14.14"
+	case "family":
+		return "1.1.1.3"
+	}
+	return ""
+}
+
+// ListDNSProfiles returns every defined profile
+func ListDNSProfiles(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT id, name, servers, COALESCE(description, '') FROM dns_profiles ORDER BY name")
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		profiles := []DNSProfile{}
+		for rows.Next() {
+			var p DNSProfile
+			if rows.Scan(&p.ID, &p.Name, &p.Servers, &p.Description) == nil {
+				profiles = append(profiles, p)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profiles)
+	}
+}
+
+// CreateDNSProfile adds or updates a profile. Upsert by name so admins can
+// repoint a profile (e.g. swap adblock to a local Pi-hole) without peers
+// having to change anything.
+func CreateDNSProfile(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name        string `json:"name"`
+			Servers     string `json:"servers"`
+			Description string `json:"description"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if !dnsProfileNameRe.MatchString(req.Name) {
+			http.Error(w, "Invalid profile name (1-32 chars, alphanumeric plus _-)", http.StatusBadRequest)
+			return
+		}
+		servers := []string{}
+		for _, s := range strings.Split(req.Servers, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if net.ParseIP(s) == nil {
+				http.Error(w, "Invalid DNS server IP: "+s, http.StatusBadRequest)
+				return
+			}
+			servers = append(servers, s)
+		}
+		if len(servers) == 0 {
+			http.Error(w, "At least one DNS server required", http.StatusBadRequest)
+			return
+		}
+		normalized := strings.Join(servers, ", ")
+
+		_, err := db.Exec(`INSERT INTO dns_profiles (name, servers, description) VALUES (?, ?, ?)
+			ON CONFLICT(name) DO UPDATE SET servers = excluded.servers, description = excluded.description`,
+			req.Name, normalized, req.Description)
+		if err != nil {
+			http.Error(w, "Failed to save profile", http.StatusInternalServerError)
+			return
+		}
+
+		WriteAudit(db, r, "DNS_PROFILE_SET", req.Name, "Servers: "+normalized)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "saved",
+			"name":    req.Name,
+			"servers": normalized,
+		})
+	}
+}
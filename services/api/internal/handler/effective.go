@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// EffectiveSetting is one resolved value plus the layer it came from:
+// "peer-override", "group", "global" or "default". The group layer carries
+// nothing yet, but the shape anticipates group-level settings so clients
+// don't have to change when they land.
+type EffectiveSetting struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// GetEffectiveSettings resolves the final value of every layered setting for
+// one peer, mirroring the precedence BuildClientConfig and the workers apply
+// (peer override beats global beats hardcoded default). It answers "why does
+// this peer have this DNS?" without reverse-engineering a generated config.
+func GetEffectiveSettings(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		var name string
+		var dataLimitGB int
+		var expiresAt sql.NullInt64
+		var dnsProfile, allowedOverride, tunnelMode sql.NullString
+		var serverPort sql.NullInt64
+		err := db.QueryRow(`
+			SELECT p.name, COALESCE(p.data_limit_gb, 0), p.expires_at,
+				ps.dns_profile, ps.allowed_ips_override, ps.server_port, ps.tunnel_mode
+			FROM peers p
+			LEFT JOIN peer_settings ps ON p.id = ps.peer_id
+			WHERE p.id = ?`, id).Scan(&name, &dataLimitGB, &expiresAt, &dnsProfile, &allowedOverride, &serverPort, &tunnelMode)
+		if err != nil {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+
+		settings := map[string]EffectiveSetting{}
+
+		// DNS: the profile is a peer override; the resolved servers match
+		// what BuildClientConfig renders for that profile
+		if servers := dnsProfileServers(db, dnsProfile.String); servers != "" {
+			settings["dns"] = EffectiveSetting{servers, "peer-override"}
+		} else {
+			settings["dns"] = EffectiveSetting{"1.1.1.1, 8.8.8.8", "default"}
+		}
+
+		mtu := ""
+		db.QueryRow("SELECT value FROM system_config WHERE key='mtu'").Scan(&mtu)
+		if mtu != "" {
+			settings["mtu"] = EffectiveSetting{mtu, "global"}
+		} else {
+			settings["mtu"] = EffectiveSetting{"1380", "default"}
+		}
+
+		// Client routing: per-peer override, then the pinned tunnel mode,
+		// then the global split-tunnel toggle, then full tunnel
+		if allowedOverride.String != "" {
+			settings["allowed_ips"] = EffectiveSetting{allowedOverride.String, "peer-override"}
+		} else {
+			var splitTunnel, subnetCIDR string
+			db.QueryRow("SELECT value FROM system_config WHERE key='split_tunnel'").Scan(&splitTunnel)
+			split := splitTunnel == "true"
+			source := "global"
+			switch tunnelMode.String {
+			case "full":
+				split = false
+				source = "peer-override"
+			case "split":
+				split = true
+				source = "peer-override"
+			}
+			if split {
+				db.QueryRow("SELECT value FROM system_config WHERE key='subnet_cidr'").Scan(&subnetCIDR)
+				if subnetCIDR == "" {
+					subnetCIDR = "10.100.0.0/24"
+				}
+				settings["allowed_ips"] = EffectiveSetting{
+					fmt.Sprintf("%s, 192.168.0.0/16, 172.16.0.0/12, 10.0.0.0/8", subnetCIDR), source}
+			} else if source == "peer-override" {
+				settings["allowed_ips"] = EffectiveSetting{"0.0.0.0/0, ::/0", source}
+			} else {
+				settings["allowed_ips"] = EffectiveSetting{"0.0.0.0/0, ::/0", "default"}
+			}
+		}
+
+		if serverPort.Valid && serverPort.Int64 > 0 {
+			settings["server_port"] = EffectiveSetting{strconv.FormatInt(serverPort.Int64, 10), "peer-override"}
+		} else {
+			port := ""
+			db.QueryRow("SELECT value FROM system_config WHERE key='listen_port'").Scan(&port)
+			if port != "" {
+				settings["server_port"] = EffectiveSetting{port, "global"}
+			} else {
+				settings["server_port"] = EffectiveSetting{"51820", "default"}
+			}
+		}
+
+		if dataLimitGB > 0 {
+			settings["data_limit_gb"] = EffectiveSetting{dataLimitGB, "peer-override"}
+		} else {
+			settings["data_limit_gb"] = EffectiveSetting{0, "default"} // unlimited
+		}
+
+		if expiresAt.Valid {
+			settings["expires_at"] = EffectiveSetting{expiresAt.Int64, "peer-override"}
+		} else {
+			settings["expires_at"] = EffectiveSetting{nil, "default"} // permanent
+		}
+
+		var scheduleCount int
+		db.QueryRow("SELECT COUNT(*) FROM peer_schedules WHERE peer_id = ?", id).Scan(&scheduleCount)
+		if scheduleCount > 0 {
+			settings["schedule"] = EffectiveSetting{fmt.Sprintf("%d window(s)", scheduleCount), "peer-override"}
+		} else {
+			settings["schedule"] = EffectiveSetting{"always on", "default"}
+		}
+
+		settings["persistent_keepalive"] = EffectiveSetting{25, "default"}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"peer_id":  id,
+			"name":     name,
+			"settings": settings,
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"regexp"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// SMTPConfig holds the outbound mail settings stored in system_config
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// getSMTPConfig loads SMTP settings; returns false if not configured
+func getSMTPConfig(db *sql.DB) (SMTPConfig, bool) {
+	var cfg SMTPConfig
+	db.QueryRow("SELECT value FROM system_config WHERE key='smtp_host'").Scan(&cfg.Host)
+	db.QueryRow("SELECT value FROM system_config WHERE key='smtp_port'").Scan(&cfg.Port)
+	db.QueryRow("SELECT value FROM system_config WHERE key='smtp_user'").Scan(&cfg.Username)
+	db.QueryRow("SELECT value FROM system_config WHERE key='smtp_pass'").Scan(&cfg.Password)
+	db.QueryRow("SELECT value FROM system_config WHERE key='smtp_from'").Scan(&cfg.From)
+
+	if cfg.Host == "" || cfg.From == "" {
+		return cfg, false
+	}
+	if cfg.Port == "" {
+		cfg.Port = "587"
+	}
+	return cfg, true
+}
+
+// isValidEmail does a sanity check on the recipient address
+func isValidEmail(email string) bool {
+	match, _ := regexp.MatchString(`^[^@\s]+@[^@\s]+\.[^@\s]+$`, email)
+	return match
+}
+
+// SendPeerOnboardingEmail mails the client config as an attachment with an inline QR code.
+// The recipient is exactly the address the admin supplied on peer creation - private keys
+// are never sent anywhere else.
+func SendPeerOnboardingEmail(db *sql.DB, peerName, recipient, clientConf string) error {
+	cfg, ok := getSMTPConfig(db)
+	if !ok {
+		return fmt.Errorf("SMTP not configured")
+	}
+	if !isValidEmail(recipient) {
+		return fmt.Errorf("invalid recipient address")
+	}
+
+	qrPNG, err := qrcode.Encode(clientConf, qrcode.Medium, 256)
+	if err != nil {
+		return fmt.Errorf("QR generation failed: %w", err)
+	}
+
+	boundary := "samnet-onboarding-boundary"
+	var msg strings.Builder
+	msg.WriteString("From: " + cfg.From + "\r\n")
+	msg.WriteString("To: " + recipient + "\r\n")
+	msg.WriteString("Subject: Your VPN access is ready (" + peerName + ")\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: multipart/mixed; boundary=" + boundary + "\r\n\r\n")
+
+	// Part 1: onboarding instructions with inline QR
+	msg.WriteString("--" + boundary + "\r\n")
+	msg.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n")
+	msg.WriteString("<p>Your WireGuard peer <b>" + peerName + "</b> has been created.</p>")
+	msg.WriteString("<p>Install the WireGuard app, then either scan the QR code below from the mobile app " +
+		"or import the attached <code>" + peerName + ".conf</code> file on desktop.</p>")
+	msg.WriteString(`<img src="cid:peer-qr" alt="WireGuard QR code"/>`)
+	msg.WriteString("<p>Keep this email private: the config contains your personal VPN key.</p>\r\n")
+
+	// Part 2: inline QR image
+	msg.WriteString("--" + boundary + "\r\n")
+	msg.WriteString("Content-Type: image/png\r\n")
+	msg.WriteString("Content-Transfer-Encoding: base64\r\n")
+	msg.WriteString("Content-ID: <peer-qr>\r\n")
+	msg.WriteString("Content-Disposition: inline; filename=" + peerName + "-qr.png\r\n\r\n")
+	msg.WriteString(base64.StdEncoding.EncodeToString(qrPNG) + "\r\n")
+
+	// Part 3: the .conf attachment
+	msg.WriteString("--" + boundary + "\r\n")
+	msg.WriteString("Content-Type: application/octet-stream\r\n")
+	msg.WriteString("Content-Transfer-Encoding: base64\r\n")
+	msg.WriteString("Content-Disposition: attachment; filename=" + peerName + ".conf\r\n\r\n")
+	msg.WriteString(base64.StdEncoding.EncodeToString([]byte(clientConf)) + "\r\n")
+	msg.WriteString("--" + boundary + "--\r\n")
+
+	addr := cfg.Host + ":" + cfg.Port
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+
+	if err := smtp.SendMail(addr, auth, cfg.From, []string{recipient}, []byte(msg.String())); err != nil {
+		return err
+	}
+
+	slog.Info("Onboarding email sent", "peer", peerName, "recipient", recipient)
+	WriteAudit(db, nil, "PEER_EMAIL_SENT", peerName, "Onboarding config emailed to "+recipient)
+	return nil
+}
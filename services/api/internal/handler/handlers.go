@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/middleware"
 )
 
 // Global metrics counters
@@ -28,6 +30,24 @@ func HealthLive(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// healthRedis is the optional Redis dependency; registered from main when
+// REDIS_URL is configured so readiness reflects it as a hard dependency
+var healthRedis interface{ Ping(context.Context) error }
+
+// SetHealthRedis registers a Redis connection for the readiness check
+func SetHealthRedis(r interface{ Ping(context.Context) error }) {
+	healthRedis = r
+}
+
+// writeMetricsSource reports DB write load (total, per-second, peak);
+// registered from main so Metrics doesn't depend on the driver type
+var writeMetricsSource func() (total int64, perSecond float64, peak int64)
+
+// SetWriteMetricsSource registers the driver's write metrics for /metrics
+func SetWriteMetricsSource(fn func() (int64, float64, int64)) {
+	writeMetricsSource = fn
+}
+
 // HealthReady checks actual backend health before returning 200
 func HealthReady(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -38,10 +58,24 @@ func HealthReady(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// Redis is only a dependency when configured, but then it's a hard one
+		// (sessions/rate limits live there) - fail readiness if it's down
+		if healthRedis != nil {
+			ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+			defer cancel()
+			if err := healthRedis.Ping(ctx); err != nil {
+				apiErrors.Add(1)
+				http.Error(w, "Redis unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
 		// WireGuard check is best-effort - log but don't fail
 		// Container may not have access to host WireGuard interface
 		status := "READY"
-		if _, err := exec.Command("wg", "show", "wg0").Output(); err != nil {
+		if MockWGEnabled() {
+			status = "READY (mock WireGuard backend)"
+		} else if _, err := exec.Command("wg", "show", wgInterface()).Output(); err != nil {
 			status = "READY (WireGuard inaccessible from container)"
 		}
 
@@ -53,6 +87,7 @@ func HealthReady(db *sql.DB) http.HandlerFunc {
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	MFACode  string `json:"mfa_code,omitempty"` // TOTP or recovery code when MFA is enabled
 }
 
 // Lockout configuration (can be overridden via env)
@@ -109,8 +144,6 @@ func GetAuditIP(r *http.Request) string {
 
 func Login(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		clientIP := GetAuditIP(r)
-
 		var req LoginRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Bad Request", http.StatusBadRequest)
@@ -132,8 +165,7 @@ func Login(db *sql.DB) http.HandlerFunc {
 		if !userExists {
 			loginFailures.Add(1)
 			// Log failed attempt with IP (for analysis, not blocking)
-			db.Exec("INSERT INTO audit_logs (user_id, action, target, details, ip_address) VALUES (0, 'LOGIN_FAIL', ?, 'User not found', ?)",
-				req.Username, clientIP)
+			WriteAuditAs(db, r, 0, "LOGIN_FAIL", req.Username, "User not found")
 			http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
 			return
 		}
@@ -147,8 +179,7 @@ func Login(db *sql.DB) http.HandlerFunc {
 			loginFailures.Add(1)
 			failedAttempts++
 
-			db.Exec("INSERT INTO audit_logs (user_id, action, target, details, ip_address) VALUES (?, 'LOGIN_FAIL', ?, 'Wrong password', ?)",
-				id, req.Username, clientIP)
+			WriteAuditAs(db, r, id, "LOGIN_FAIL", req.Username, "Wrong password")
 
 			if failedAttempts >= MaxFailedAttempts {
 				lockout := time.Now().Add(LockoutDuration)
@@ -161,18 +192,39 @@ func Login(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// MFA step: accept a TOTP code or burn a single-use recovery code
+		mfaEnabled, totpSecret, _ := auth.GetUserMFAStatus(db, id)
+		if mfaEnabled && totpSecret != "" {
+			if req.MFACode == "" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"status": "mfa_required"}`))
+				return
+			}
+			if auth.VerifyTOTP(totpSecret, req.MFACode) {
+				// TOTP accepted
+			} else if consumeRecoveryCode(db, id, req.MFACode) {
+				WriteAuditAs(db, r, id, "MFA_RECOVERY_USED", req.Username, "Login via single-use recovery code")
+			} else {
+				loginFailures.Add(1)
+				WriteAuditAs(db, r, id, "LOGIN_FAIL", req.Username, "Invalid MFA code")
+				http.Error(w, "Invalid MFA code", http.StatusUnauthorized)
+				return
+			}
+		}
+
 		loginSuccesses.Add(1)
 		db.Exec("UPDATE users SET failed_attempts = 0, lockout_until = NULL WHERE id = ?", id)
 
-		db.Exec("INSERT INTO audit_logs (user_id, action, target, details, ip_address) VALUES (?, 'LOGIN_SUCCESS', ?, 'Login successful', ?)",
-			id, req.Username, clientIP)
+		WriteAuditAs(db, r, id, "LOGIN_SUCCESS", req.Username, "Login successful")
 
-		token, err := auth.CreateSession(db, id)
+		token, err := auth.CreateSession(db, id, middleware.GetClientIP(r), r.Header.Get("User-Agent"))
 		if err != nil {
 			apiErrors.Add(1)
 			http.Error(w, "Server Error", http.StatusInternalServerError)
 			return
 		}
+		middleware.CacheSession(auth.HashToken(token), id, role, time.Now().Add(12*time.Hour))
 
 		// Auto-detect HTTPS for Secure flag
 		isSecure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" || os.Getenv("INSECURE_HTTP") != "true"
@@ -198,7 +250,7 @@ func Login(db *sql.DB) http.HandlerFunc {
 			HttpOnly: false, // Must be readable by JS
 			Secure:   isSecure,
 			SameSite: http.SameSiteStrictMode,
-			MaxAge:   86400, // 24 hours
+			MaxAge:   43200, // Aligned with session lifetime (12 hours)
 		})
 
 		w.Header().Set("Content-Type", "application/json")
@@ -212,6 +264,7 @@ func Logout(db *sql.DB) http.HandlerFunc {
 		if err == nil {
 			tokenHash := auth.HashToken(c.Value)
 			db.Exec("DELETE FROM sessions WHERE token_hash = ?", tokenHash)
+			middleware.DropCachedSession(tokenHash)
 		}
 
 		http.SetCookie(w, &http.Cookie{
@@ -255,6 +308,22 @@ func Metrics(db *sql.DB) http.HandlerFunc {
 
 		fmt.Fprintf(w, "samnet_up 1\n")
 
+		// DB write load (feeds the scale-out decision)
+		if writeMetricsSource != nil {
+			total, wps, peak := writeMetricsSource()
+			fmt.Fprintf(w, "# HELP samnet_db_writes_total Total database writes since start\n")
+			fmt.Fprintf(w, "# TYPE samnet_db_writes_total counter\n")
+			fmt.Fprintf(w, "samnet_db_writes_total %d\n", total)
+
+			fmt.Fprintf(w, "# HELP samnet_db_writes_per_second Database writes per second over the current window\n")
+			fmt.Fprintf(w, "# TYPE samnet_db_writes_per_second gauge\n")
+			fmt.Fprintf(w, "samnet_db_writes_per_second %f\n", wps)
+
+			fmt.Fprintf(w, "# HELP samnet_db_writes_peak Peak writes per second observed\n")
+			fmt.Fprintf(w, "# TYPE samnet_db_writes_peak gauge\n")
+			fmt.Fprintf(w, "samnet_db_writes_peak %d\n", peak)
+		}
+
 		// Error rate metrics
 		fmt.Fprintf(w, "# HELP samnet_login_failures_total Total login failures\n")
 		fmt.Fprintf(w, "# TYPE samnet_login_failures_total counter\n")
@@ -268,6 +337,17 @@ func Metrics(db *sql.DB) http.HandlerFunc {
 		fmt.Fprintf(w, "# TYPE samnet_api_errors_total counter\n")
 		fmt.Fprintf(w, "samnet_api_errors_total %d\n", apiErrors.Load())
 
+		// Notification queue health
+		var queueDepth, queueFailed int
+		db.QueryRow("SELECT COUNT(*) FROM notification_queue WHERE sent = 0 AND COALESCE(failed, 0) = 0").Scan(&queueDepth)
+		db.QueryRow("SELECT COUNT(*) FROM notification_queue WHERE COALESCE(failed, 0) = 1").Scan(&queueFailed)
+		fmt.Fprintf(w, "# HELP samnet_notification_queue_depth Notifications waiting to be sent\n")
+		fmt.Fprintf(w, "# TYPE samnet_notification_queue_depth gauge\n")
+		fmt.Fprintf(w, "samnet_notification_queue_depth %d\n", queueDepth)
+		fmt.Fprintf(w, "# HELP samnet_notifications_failed_total Notifications abandoned after max retries\n")
+		fmt.Fprintf(w, "# TYPE samnet_notifications_failed_total gauge\n")
+		fmt.Fprintf(w, "samnet_notifications_failed_total %d\n", queueFailed)
+
 		// Per-Peer Metrics
 		rows, err := db.Query("SELECT name, last_handshake, rx_bytes, tx_bytes FROM peers")
 		if err == nil {
@@ -294,7 +374,7 @@ func Metrics(db *sql.DB) http.HandlerFunc {
 		if subnetCIDR == "" {
 			subnetCIDR = "10.100.0.0/24"
 		}
-		maxPeers := CalculateMaxPeers(subnetCIDR)
+		maxPeers := CalculateMaxPeersDual(db, subnetCIDR)
 		usagePercent := float64(peerCount) / float64(maxPeers) * 100
 
 		fmt.Fprintf(w, "# HELP samnet_subnet_capacity_max Maximum peers in configured subnet\n")
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
+)
+
+// WGInterfaceInfo is one managed WireGuard interface (tunnel). Separate
+// tunnels (e.g. staff vs guests) each get a row; peers are scoped to one
+// via peers.interface_id.
+type WGInterfaceInfo struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	ConfigPath string `json:"config_path"`
+	Subnet     string `json:"subnet,omitempty"`
+	ListenPort int    `json:"listen_port,omitempty"`
+	PeerCount  int    `json:"peer_count"`
+	Primary    bool   `json:"primary"` // the WG_INTERFACE default
+}
+
+// Kernel interface names: up to 15 chars, no slash or whitespace
+var ifaceNameRe = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+
+// EnsurePrimaryInterface registers the configured WG_INTERFACE in the
+// interfaces table and adopts any peers that predate interface scoping.
+// Called once at startup, after migrations.
+func EnsurePrimaryInterface(db *sql.DB) {
+	cfg := config.Get()
+	db.Exec(`INSERT INTO interfaces (name, config_path) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET config_path = excluded.config_path`,
+		cfg.WGInterface, cfg.WGConfigPath)
+	db.Exec(`UPDATE peers SET interface_id = (SELECT id FROM interfaces WHERE name = ?)
+		WHERE interface_id IS NULL`, cfg.WGInterface)
+}
+
+// resolveInterface returns the interface named by ?interface=, defaulting to
+// the primary. The error is sql.ErrNoRows for an unregistered name.
+func resolveInterface(db *sql.DB, r *http.Request) (WGInterfaceInfo, error) {
+	name := r.URL.Query().Get("interface")
+	if name == "" {
+		name = config.Get().WGInterface
+	}
+
+	var in WGInterfaceInfo
+	var subnet sql.NullString
+	var port sql.NullInt64
+	err := db.QueryRow("SELECT id, name, config_path, subnet, listen_port FROM interfaces WHERE name = ?", name).
+		Scan(&in.ID, &in.Name, &in.ConfigPath, &subnet, &port)
+	in.Subnet = subnet.String
+	in.ListenPort = int(port.Int64)
+	in.Primary = in.Name == config.Get().WGInterface
+	return in, err
+}
+
+// ListWGInterfaces returns every registered tunnel with its peer count
+func ListWGInterfaces(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`
+			SELECT i.id, i.name, i.config_path, i.subnet, i.listen_port,
+			       (SELECT COUNT(*) FROM peers p WHERE p.interface_id = i.id)
+			FROM interfaces i ORDER BY i.id`)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		primary := config.Get().WGInterface
+		interfaces := []WGInterfaceInfo{}
+		for rows.Next() {
+			var in WGInterfaceInfo
+			var subnet sql.NullString
+			var port sql.NullInt64
+			if err := rows.Scan(&in.ID, &in.Name, &in.ConfigPath, &subnet, &port, &in.PeerCount); err != nil {
+				continue
+			}
+			in.Subnet = subnet.String
+			in.ListenPort = int(port.Int64)
+			in.Primary = in.Name == primary
+			interfaces = append(interfaces, in)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(interfaces)
+	}
+}
+
+// CreateWGInterface registers an additional tunnel. This only records it for
+// peer scoping and config generation - provisioning the interface itself
+// (wg-quick config, keys, systemd unit) stays with the host tooling.
+func CreateWGInterface(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name       string `json:"name"`
+			ConfigPath string `json:"config_path"`
+			Subnet     string `json:"subnet"`
+			ListenPort int    `json:"listen_port"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if !ifaceNameRe.MatchString(req.Name) {
+			http.Error(w, "Invalid interface name (1-15 chars, alphanumeric plus _=+.-)", http.StatusBadRequest)
+			return
+		}
+		if req.ListenPort < 0 || req.ListenPort > 65535 {
+			http.Error(w, "Invalid listen_port (must be 1-65535)", http.StatusBadRequest)
+			return
+		}
+		if req.Subnet != "" {
+			if verr := ValidateSubnet(req.Subnet); verr != nil {
+				http.Error(w, "Invalid subnet: "+verr.Message, http.StatusBadRequest)
+				return
+			}
+		}
+		if req.ConfigPath == "" {
+			req.ConfigPath = "/etc/wireguard/" + req.Name + ".conf"
+		}
+
+		res, err := db.Exec(`INSERT INTO interfaces (name, config_path, subnet, listen_port)
+			VALUES (?, ?, NULLIF(?, ''), NULLIF(?, 0))`,
+			req.Name, req.ConfigPath, req.Subnet, req.ListenPort)
+		if err != nil {
+			http.Error(w, "Interface already registered", http.StatusConflict)
+			return
+		}
+		id, _ := res.LastInsertId()
+
+		WriteAudit(db, r, "IFACE_CREATE", req.Name, "Registered WireGuard interface")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "created",
+			"id":     id,
+			"name":   req.Name,
+		})
+	}
+}
+
+// statsInterfaces lists the interface names to poll for stats. Falls back to
+// the primary when the table is empty (fresh DB before the first boot pass).
+func statsInterfaces(db *sql.DB) []string {
+	names := []string{}
+	if db != nil {
+		rows, err := db.Query("SELECT name FROM interfaces ORDER BY id")
+		if err == nil {
+			defer rows.Close()
+			for rows.Next() {
+				var n string
+				if rows.Scan(&n) == nil {
+					names = append(names, n)
+				}
+			}
+		}
+	}
+	if len(names) == 0 {
+		names = []string{wgInterface()}
+	}
+	return names
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// rowQuerier lets the v6 helpers work inside or outside a transaction
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// getSubnetV6 returns the optional IPv6 ULA subnet (subnet_cidr_v6), "" when
+// the deployment is v4-only
+func getSubnetV6(q rowQuerier) string {
+	var cidr string
+	q.QueryRow("SELECT value FROM system_config WHERE key='subnet_cidr_v6'").Scan(&cidr)
+	if cidr == "" {
+		return ""
+	}
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		return ""
+	}
+	return cidr
+}
+
+// deriveV6Host computes the v6 host address at the given offset into the v6
+// subnet. Using the same offset as the v4 allocation keeps the two pools in
+// lockstep, so v4 uniqueness guarantees v6 uniqueness.
+func deriveV6Host(cidrV6 string, offset uint32) string {
+	ip, ipNet, err := net.ParseCIDR(cidrV6)
+	if err != nil || ip.To4() != nil {
+		return ""
+	}
+	v6 := make(net.IP, 16)
+	copy(v6, ipNet.IP.To16())
+	low := binary.BigEndian.Uint64(v6[8:])
+	binary.BigEndian.PutUint64(v6[8:], low+uint64(offset))
+	return v6.String()
+}
+
+// withV6 appends the parallel v6 address (with prefix) to an allocated v4
+// value when dual-stack is configured
+func withV6(q rowQuerier, v4WithMask string, offset uint32) string {
+	cidrV6 := getSubnetV6(q)
+	if cidrV6 == "" {
+		return v4WithMask
+	}
+	host := deriveV6Host(cidrV6, offset)
+	if host == "" {
+		return v4WithMask
+	}
+	_, ipNet, _ := net.ParseCIDR(cidrV6)
+	ones, _ := ipNet.Mask.Size()
+	return v4WithMask + ", " + fmt.Sprintf("%s/%d", host, ones)
+}
+
+// splitAddrList splits a stored allowed_ips value ("v4/nn" or "v4/nn, v6/nn")
+func splitAddrList(allowed string) []string {
+	var parts []string
+	for _, p := range strings.Split(allowed, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// ServerAllowedIPs converts a stored allowed_ips value into the server-side
+// routing form: /32 per v4 host, /128 per v6 host, comma-joined for wg(8)
+func ServerAllowedIPs(allowed string) string {
+	var parts []string
+	for _, p := range splitAddrList(allowed) {
+		ipStr := strings.Split(p, "/")[0]
+		if strings.Contains(ipStr, ":") {
+			parts = append(parts, ipStr+"/128")
+		} else {
+			parts = append(parts, ipStr+"/32")
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// CalculateMaxPeersDual clamps the v4 pool to the v6 pool when dual-stack is
+// configured (a tiny v6 prefix must not oversell capacity)
+func CalculateMaxPeersDual(q rowQuerier, cidr string) int {
+	maxPeers := CalculateMaxPeers(cidr)
+	cidrV6 := getSubnetV6(q)
+	if cidrV6 == "" {
+		return maxPeers
+	}
+	_, ipNet, err := net.ParseCIDR(cidrV6)
+	if err != nil {
+		return maxPeers
+	}
+	ones, bits := ipNet.Mask.Size()
+	hostBits := bits - ones
+	if hostBits >= 32 {
+		return maxPeers // v6 pool dwarfs any v4 subnet
+	}
+	v6Pool := (1 << hostBits) - 2
+	if v6Pool < maxPeers {
+		return v6Pool
+	}
+	return maxPeers
+}
@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/middleware"
+	"github.com/skip2/go-qrcode"
+)
+
+const totpIssuer = "SamNet-WG"
+
+// SetupMFA generates a new TOTP secret for the logged-in user and returns
+// the provisioning URI plus a QR code. The secret is stored unconfirmed
+// (mfa_enabled stays 0) so a mistyped authenticator can't lock the user out —
+// it only becomes active after VerifyMFA sees a valid code.
+func SetupMFA(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := middleware.GetUserID(r)
+		if userID == 0 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var username string
+		var enabled bool
+		if err := db.QueryRow("SELECT username, mfa_enabled FROM users WHERE id = ?", userID).Scan(&username, &enabled); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if enabled {
+			http.Error(w, "MFA already enabled. Disable it first to re-enroll.", http.StatusConflict)
+			return
+		}
+
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+			return
+		}
+
+		// Store pending secret without flipping mfa_enabled
+		if _, err := db.Exec("UPDATE users SET totp_secret = ?, mfa_enabled = 0 WHERE id = ?", secret, userID); err != nil {
+			http.Error(w, "Failed to store secret", http.StatusInternalServerError)
+			return
+		}
+
+		uri := auth.GetTOTPProvisioningURI(username, secret, totpIssuer)
+		png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+		if err != nil {
+			http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "pending_verification",
+			"secret":  secret,
+			"uri":     uri,
+			"qr_png":  base64.StdEncoding.EncodeToString(png),
+		})
+	}
+}
+
+// VerifyMFA confirms a pending TOTP secret. Only a valid code from the
+// enrolled authenticator activates MFA.
+func VerifyMFA(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := middleware.GetUserID(r)
+		if userID == 0 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		enabled, secret, err := auth.GetUserMFAStatus(db, userID)
+		if err != nil || secret == "" {
+			http.Error(w, "No pending MFA setup. Call /users/mfa/setup first.", http.StatusBadRequest)
+			return
+		}
+		if enabled {
+			http.Error(w, "MFA already enabled", http.StatusConflict)
+			return
+		}
+
+		if !auth.VerifyTOTP(secret, req.Code) {
+			http.Error(w, "Invalid code", http.StatusForbidden)
+			return
+		}
+
+		if err := auth.EnableMFA(db, userID, secret); err != nil {
+			http.Error(w, "Failed to enable MFA", http.StatusInternalServerError)
+			return
+		}
+
+		codes, err := issueRecoveryCodes(db, userID)
+		if err != nil {
+			slog.Error("Failed to issue MFA recovery codes", "user_id", userID, "error", err)
+		}
+
+		WriteAudit(db, r, "MFA_ENABLED", "", "TOTP enrollment confirmed")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":         "mfa_enabled",
+			"recovery_codes": codes,
+		})
+	}
+}
+
+const recoveryCodeCount = 10
+
+// issueRecoveryCodes replaces any existing recovery codes for the user with a
+// fresh set. Only Argon2 hashes are stored; the plaintext codes returned here
+// are the one and only time they're visible.
+func issueRecoveryCodes(db *sql.DB, userID int) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw))
+		codes = append(codes, code[:4]+"-"+code[4:])
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		hash, err := auth.HashPassword(code)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// consumeRecoveryCode burns a single-use recovery code if it matches one of
+// the user's unused hashes. Returns true when a code was accepted.
+func consumeRecoveryCode(db *sql.DB, userID int, code string) bool {
+	if code == "" {
+		return false
+	}
+	rows, err := db.Query("SELECT id, code_hash FROM mfa_recovery_codes WHERE user_id = ? AND used = 0", userID)
+	if err != nil {
+		return false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var hash string
+		if rows.Scan(&id, &hash) != nil {
+			continue
+		}
+		if valid, _ := auth.CheckPassword(hash, code); valid {
+			db.Exec("UPDATE mfa_recovery_codes SET used = 1 WHERE id = ?", id)
+			return true
+		}
+	}
+	return false
+}
+
+// RegenerateRecoveryCodes invalidates all existing recovery codes and issues
+// a new set. Requires the current password so a hijacked session can't mint
+// itself a fresh recovery path.
+func RegenerateRecoveryCodes(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := middleware.GetUserID(r)
+		if userID == 0 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		var storedHash string
+		var enabled bool
+		if err := db.QueryRow("SELECT password_hash, mfa_enabled FROM users WHERE id = ?", userID).Scan(&storedHash, &enabled); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if !enabled {
+			http.Error(w, "MFA is not enabled", http.StatusBadRequest)
+			return
+		}
+		valid, err := auth.CheckPassword(storedHash, req.Password)
+		if err != nil || !valid {
+			http.Error(w, "Password is incorrect", http.StatusForbidden)
+			return
+		}
+
+		codes, err := issueRecoveryCodes(db, userID)
+		if err != nil {
+			http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+			return
+		}
+
+		WriteAudit(db, r, "MFA_RECOVERY_REGENERATED", "", "Recovery codes reissued, old set invalidated")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":         "regenerated",
+			"recovery_codes": codes,
+		})
+	}
+}
+
+// DisableMFA turns MFA off for the logged-in user. Requires the current
+// password so a hijacked session alone can't weaken the account.
+func DisableMFA(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := middleware.GetUserID(r)
+		if userID == 0 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		var storedHash string
+		if err := db.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&storedHash); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		valid, err := auth.CheckPassword(storedHash, req.Password)
+		if err != nil || !valid {
+			http.Error(w, "Password is incorrect", http.StatusForbidden)
+			return
+		}
+
+		if _, err := db.Exec("UPDATE users SET totp_secret = NULL, mfa_enabled = 0 WHERE id = ?", userID); err != nil {
+			http.Error(w, "Failed to disable MFA", http.StatusInternalServerError)
+			return
+		}
+
+		WriteAudit(db, r, "MFA_DISABLED", "", "MFA disabled by user")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "mfa_disabled"}`))
+	}
+}
@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// Minimal MaxMind DB (.mmdb) reader covering what the GeoIP endpoint needs:
+// binary search tree traversal plus decoding of maps, strings, numbers and
+// pointers from the data section. Pulling in a full client library for one
+// country/city lookup is not worth the dependency; the format is stable and
+// documented (https://maxmind.github.io/MaxMind-DB/).
+
+// mmdbMetadataMarker separates the data section from the metadata map
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+type mmdbReader struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	treeSize   uint // bytes occupied by the search tree
+	dataStart  uint // tree + 16-byte separator
+}
+
+// openMMDB maps the database into memory and decodes its metadata. The
+// returned reader only ever reads the byte slice, so it is safe for
+// concurrent lookups without locking.
+func openMMDB(path string) (*mmdbReader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := bytes.LastIndex(data, mmdbMetadataMarker)
+	if idx < 0 {
+		return nil, fmt.Errorf("not a MaxMind DB file (metadata marker missing)")
+	}
+
+	r := &mmdbReader{data: data}
+	meta, _, err := r.decodeValue(uint(idx + len(mmdbMetadataMarker)))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt metadata: %w", err)
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("corrupt metadata: not a map")
+	}
+
+	r.nodeCount = uint(toInt64(m["node_count"]))
+	r.recordSize = uint(toInt64(m["record_size"]))
+	r.ipVersion = uint(toInt64(m["ip_version"]))
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	r.treeSize = r.nodeCount * r.recordSize / 4 // 2 records of recordSize bits
+	r.dataStart = r.treeSize + 16
+	if uint(len(data)) < r.dataStart {
+		return nil, fmt.Errorf("file shorter than search tree")
+	}
+	return r, nil
+}
+
+// lookup walks the search tree for ip and decodes the record it lands on;
+// ok is false when the database has no entry for the address
+func (r *mmdbReader) lookup(ip net.IP) (map[string]interface{}, bool) {
+	addr := ip.To16()
+	if addr == nil {
+		return nil, false
+	}
+	bits := 128
+	if v4 := ip.To4(); v4 != nil {
+		if r.ipVersion == 6 {
+			// IPv4 lives under ::/96 in an IPv6 tree
+			addr = make(net.IP, 16)
+			copy(addr[12:], v4)
+		} else {
+			addr = v4
+			bits = 32
+		}
+	} else if r.ipVersion == 4 {
+		return nil, false
+	}
+
+	node := uint(0)
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		bit := (addr[i>>3] >> (7 - uint(i&7))) & 1
+		node = r.readNode(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, false
+	}
+
+	val, _, err := r.decodeValue(r.treeSize + (node - r.nodeCount))
+	if err != nil {
+		return nil, false
+	}
+	m, ok := val.(map[string]interface{})
+	return m, ok
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of a tree node
+func (r *mmdbReader) readNode(node uint, bit byte) uint {
+	switch r.recordSize {
+	case 24:
+		base := node * 6
+		if bit == 1 {
+			base += 3
+		}
+		return uint(r.data[base])<<16 | uint(r.data[base+1])<<8 | uint(r.data[base+2])
+	case 28:
+		base := node * 7
+		if bit == 0 {
+			return uint(r.data[base+3]>>4)<<24 | uint(r.data[base])<<16 | uint(r.data[base+1])<<8 | uint(r.data[base+2])
+		}
+		return uint(r.data[base+3]&0x0f)<<24 | uint(r.data[base+4])<<16 | uint(r.data[base+5])<<8 | uint(r.data[base+6])
+	default: // 32
+		base := node * 8
+		if bit == 1 {
+			base += 4
+		}
+		return uint(binary.BigEndian.Uint32(r.data[base : base+4]))
+	}
+}
+
+// decodeValue decodes one value at offset, returning it and the offset of
+// the next value
+func (r *mmdbReader) decodeValue(offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(r.data)) {
+		return nil, 0, fmt.Errorf("offset %d past end of data", offset)
+	}
+	ctrl := r.data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	// Pointers encode their own size bits and resolve into the data section
+	if typ == 1 {
+		ss := uint(ctrl>>3) & 0x3
+		vv := uint(ctrl & 0x7)
+		var p uint
+		switch ss {
+		case 0:
+			p = vv<<8 | uint(r.data[offset])
+		case 1:
+			p = (vv<<16 | uint(r.data[offset])<<8 | uint(r.data[offset+1])) + 2048
+		case 2:
+			p = (vv<<24 | uint(r.data[offset])<<16 | uint(r.data[offset+1])<<8 | uint(r.data[offset+2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(r.data[offset : offset+4]))
+		}
+		val, _, err := r.decodeValue(r.dataStart + p)
+		return val, offset + ss + 1, err
+	}
+
+	if typ == 0 { // extended type
+		typ = uint(r.data[offset]) + 7
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	switch size {
+	case 29:
+		size = 29 + uint(r.data[offset])
+		offset++
+	case 30:
+		size = 285 + uint(r.data[offset])<<8 + uint(r.data[offset+1])
+		offset += 2
+	case 31:
+		size = 65821 + uint(r.data[offset])<<16 + uint(r.data[offset+1])<<8 + uint(r.data[offset+2])
+		offset += 3
+	}
+
+	switch typ {
+	case 2: // UTF-8 string
+		return string(r.data[offset : offset+size]), offset + size, nil
+	case 3: // double
+		return math.Float64frombits(binary.BigEndian.Uint64(r.data[offset : offset+8])), offset + 8, nil
+	case 4: // bytes
+		return r.data[offset : offset+size], offset + size, nil
+	case 5, 6, 8, 9: // uint16, uint32, int32, uint64: all big-endian, variable width
+		var n uint64
+		for i := uint(0); i < size; i++ {
+			n = n<<8 | uint64(r.data[offset+i])
+		}
+		return n, offset + size, nil
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := r.decodeValue(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			ks, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("non-string map key")
+			}
+			val, after, err := r.decodeValue(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[ks] = val
+			offset = after
+		}
+		return m, offset, nil
+	case 11: // array
+		arr := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			val, next, err := r.decodeValue(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			arr = append(arr, val)
+			offset = next
+		}
+		return arr, offset, nil
+	case 14: // bool, value lives in the size bits
+		return size != 0, offset, nil
+	case 15: // float
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(r.data[offset : offset+4]))), offset + 4, nil
+	case 10, 12: // uint128 / container: skip, nothing in GeoLite2 needs them
+		return nil, offset + size, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported mmdb type %d", typ)
+	}
+}
+
+// toInt64 normalizes the numeric types the decoder can emit
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case uint64:
+		return int64(n)
+	case float64:
+		return int64(n)
+	default:
+		return 0
+	}
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -8,7 +9,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
 )
 
 // NetworkSettings represents exit node and split tunnel config
@@ -80,40 +85,321 @@ func UpdateGlobalSettings(db *sql.DB) http.HandlerFunc {
 		db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('mtu', ?)", req.MTU)
 		db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('dns_server', ?)", req.DNSServer)
 
-		// 2. S0246: Propagate to ALL existing client configs
-		clientDir := "/opt/samnet/clients"
+		// 2. S0246: Propagate to ALL existing client configs.
+		// Runs in the background so a large fleet doesn't time out the request;
+		// progress is queryable via GET /network/propagation-status
+		started := startPropagation(db, req.MTU, req.DNSServer)
+
+		w.WriteHeader(http.StatusOK)
+		if started {
+			w.Write([]byte(`{"status": "updated", "propagation": "started"}`))
+		} else {
+			w.Write([]byte(`{"status": "updated", "propagation": "already_running"}`))
+		}
+	}
+}
+
+// PropagationStatus reports progress of the background config rewrite
+type PropagationStatus struct {
+	Running    bool  `json:"running"`
+	Total      int   `json:"total"`
+	Done       int   `json:"done"`
+	Skipped    int   `json:"skipped"` // Files that already had the target values
+	Failed     int   `json:"failed"`
+	StartedAt  int64 `json:"started_at,omitempty"`
+	FinishedAt int64 `json:"finished_at,omitempty"`
+}
+
+var (
+	propagationMu    sync.Mutex
+	propagationState PropagationStatus
+)
+
+// startPropagation rewrites MTU/DNS in every client config in a background
+// goroutine. Each file is checked before writing, so an interrupted run can be
+// resumed by re-posting the settings: already-updated files are skipped.
+// Returns false if a propagation is already in flight.
+func startPropagation(db *sql.DB, mtu, dnsServer string) bool {
+	propagationMu.Lock()
+	if propagationState.Running {
+		propagationMu.Unlock()
+		return false
+	}
+	propagationState = PropagationStatus{Running: true, StartedAt: time.Now().Unix()}
+	propagationMu.Unlock()
+
+	go func() {
+		clientDir := config.Get().ClientsDir
 		files, _ := os.ReadDir(clientDir)
+
+		var confs []string
 		for _, f := range files {
 			if !f.IsDir() && strings.HasSuffix(f.Name(), ".conf") {
-				path := filepath.Join(clientDir, f.Name())
-				content, err := os.ReadFile(path)
-				if err != nil {
-					continue
-				}
+				confs = append(confs, filepath.Join(clientDir, f.Name()))
+			}
+		}
+
+		propagationMu.Lock()
+		propagationState.Total = len(confs)
+		propagationMu.Unlock()
 
-				newContent := string(content)
-				// Update MTU
-				mtuRegex := regexp.MustCompile(`(?i)MTU\s*=\s*[0-9]+`)
-				newContent = mtuRegex.ReplaceAllString(newContent, "MTU = "+req.MTU)
+		mtuRegex := regexp.MustCompile(`(?i)MTU\s*=\s*[0-9]+`)
+		dnsRegex := regexp.MustCompile(`(?i)DNS\s*=\s*[0-9\.,\s]+`)
 
-				// Update DNS
-				dnsRegex := regexp.MustCompile(`(?i)DNS\s*=\s*[0-9\.,\s]+`)
-				newContent = dnsRegex.ReplaceAllString(newContent, "DNS = "+req.DNSServer)
+		for _, path := range confs {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				propagationMu.Lock()
+				propagationState.Failed++
+				propagationMu.Unlock()
+				continue
+			}
+
+			newContent := mtuRegex.ReplaceAllString(string(content), "MTU = "+mtu)
+			newContent = dnsRegex.ReplaceAllString(newContent, "DNS = "+dnsServer)
 
-				os.WriteFile(path, []byte(newContent), 0600)
+			propagationMu.Lock()
+			if newContent == string(content) {
+				propagationState.Skipped++
+			} else if err := os.WriteFile(path, []byte(newContent), 0600); err != nil {
+				propagationState.Failed++
+			} else {
+				propagationState.Done++
 			}
+			propagationMu.Unlock()
+		}
+
+		propagationMu.Lock()
+		propagationState.Running = false
+		propagationState.FinishedAt = time.Now().Unix()
+		snapshot, _ := json.Marshal(propagationState)
+		propagationMu.Unlock()
+
+		// Persist the final result so it survives restarts
+		db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('last_propagation', ?)", string(snapshot))
+	}()
+	return true
+}
+
+// GetPropagationStatus returns the in-flight propagation progress, or the
+// last completed run if nothing is running
+func GetPropagationStatus(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		propagationMu.Lock()
+		state := propagationState
+		propagationMu.Unlock()
+
+		if !state.Running && state.StartedAt == 0 {
+			// Nothing this process lifetime - fall back to the persisted result
+			var saved string
+			db.QueryRow("SELECT value FROM system_config WHERE key='last_propagation'").Scan(&saved)
+			if saved != "" {
+				json.Unmarshal([]byte(saved), &state)
+			}
+		}
+
+		json.NewEncoder(w).Encode(state)
+	}
+}
+
+// GetEndpointHostname returns the configured endpoint hostname along with
+// the last successful DNS resolution, so the UI can flag a stale hostname
+func GetEndpointHostname(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var hostname, resolved, resolvedAt string
+		db.QueryRow("SELECT value FROM system_config WHERE key='endpoint_hostname'").Scan(&hostname)
+		db.QueryRow("SELECT value FROM system_config WHERE key='endpoint_hostname_resolved'").Scan(&resolved)
+		db.QueryRow("SELECT value FROM system_config WHERE key='endpoint_hostname_resolved_at'").Scan(&resolvedAt)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"hostname":         hostname,
+			"last_resolved":    resolved,
+			"last_resolved_at": resolvedAt,
+		})
+	}
+}
+
+// UpdateEndpointHostname validates and stores the hostname baked into client
+// configs. Bad syntax is a hard 400 (it would never work); a hostname that
+// doesn't currently resolve is stored anyway with a warning, since DNS may
+// just not have propagated yet. The last successful resolution is persisted.
+func UpdateEndpointHostname(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Hostname string `json:"hostname"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		req.Hostname = strings.TrimSpace(req.Hostname)
+
+		if req.Hostname == "" {
+			// Clear: configs fall back to the detected WAN IP
+			db.Exec("DELETE FROM system_config WHERE key='endpoint_hostname'")
+			WriteAudit(db, r, "ENDPOINT_HOSTNAME_SET", "", "Endpoint hostname cleared")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status": "cleared"}`))
+			return
+		}
+
+		if !isValidHostname(req.Hostname) {
+			http.Error(w, "Invalid hostname", http.StatusBadRequest)
+			return
+		}
+
+		db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('endpoint_hostname', ?)", req.Hostname)
+
+		resp := map[string]interface{}{
+			"status":   "updated",
+			"hostname": req.Hostname,
+		}
+		if addrs, err := net.LookupHost(req.Hostname); err == nil && len(addrs) > 0 {
+			db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('endpoint_hostname_resolved', ?)", addrs[0])
+			db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('endpoint_hostname_resolved_at', datetime('now'))")
+			resp["resolved"] = addrs
+		} else {
+			resp["warning"] = "Hostname does not currently resolve; clients won't connect until DNS is fixed"
+		}
+
+		WriteAudit(db, r, "ENDPOINT_HOSTNAME_SET", req.Hostname, "Endpoint hostname updated")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// GetFailoverEndpoints returns the named server endpoints for manual failover
+func GetFailoverEndpoints(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var endpointsJSON string
+		db.QueryRow("SELECT value FROM system_config WHERE key='failover_endpoints'").Scan(&endpointsJSON)
+		endpoints := make(map[string]string)
+		if endpointsJSON != "" {
+			json.Unmarshal([]byte(endpointsJSON), &endpoints)
+		}
+		json.NewEncoder(w).Encode(endpoints)
+	}
+}
+
+// UpdateFailoverEndpoints saves the named endpoint map (e.g. primary/backup WAN hosts)
+func UpdateFailoverEndpoints(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
 		}
 
+		endpointsJSON, _ := json.Marshal(req)
+		db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('failover_endpoints', ?)", string(endpointsJSON))
+
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status": "updated_and_propagated"}`))
+		w.Write([]byte(`{"status": "updated"}`))
+	}
+}
+
+// InterfaceStats answers "how busy is the VPN right now?" in one cheap call:
+// one wg dump parse plus the interface's own /proc/net/dev counters. Distinct
+// from /system/stats (host) and /peers (per-peer).
+func InterfaceStats(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := map[string]interface{}{
+			"interface":       wgInterface(),
+			"up":              false,
+			"peer_count":      0,
+			"connected_peers": 0,
+			"total_rx_bytes":  int64(0),
+			"total_tx_bytes":  int64(0),
+		}
+
+		out, err := exec.Command("wg", "show", wgInterface(), "dump").Output()
+		if err == nil {
+			stats["up"] = true
+			now := time.Now().Unix()
+			peerCount, connected := 0, 0
+			var totalRx, totalTx int64
+			for i, line := range strings.Split(string(out), "\n") {
+				if i == 0 || line == "" { // First line is the interface itself
+					continue
+				}
+				fields := strings.Split(line, "\t")
+				if len(fields) < 7 {
+					continue
+				}
+				peerCount++
+				handshake, _ := strconv.ParseInt(fields[4], 10, 64)
+				// "Connected" = handshake within the last 3 minutes
+				if handshake > 0 && now-handshake < 180 {
+					connected++
+				}
+				rx, _ := strconv.ParseInt(fields[5], 10, 64)
+				tx, _ := strconv.ParseInt(fields[6], 10, 64)
+				totalRx += rx
+				totalTx += tx
+			}
+			stats["peer_count"] = peerCount
+			stats["connected_peers"] = connected
+			stats["total_rx_bytes"] = totalRx
+			stats["total_tx_bytes"] = totalTx
+		}
+
+		// Kernel-side counters include traffic from before the current peers'
+		// counters were reset, so report them separately
+		if devRx, devTx, ok := readNetDevCounters(wgInterface()); ok {
+			stats["dev_rx_bytes"] = devRx
+			stats["dev_tx_bytes"] = devTx
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
 	}
 }
 
+// readNetDevCounters pulls the interface rx/tx byte counters from /proc/net/dev
+func readNetDevCounters(iface string) (rx, tx int64, ok bool) {
+	content, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		return 0, 0, false
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, iface+":") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, iface+":"))
+		// Format: rx bytes,packets,errs,... then tx bytes at index 8
+		if len(fields) < 9 {
+			return 0, 0, false
+		}
+		rx, _ = strconv.ParseInt(fields[0], 10, 64)
+		tx, _ = strconv.ParseInt(fields[8], 10, 64)
+		return rx, tx, true
+	}
+	return 0, 0, false
+}
+
 // WakeOnLAN sends a magic packet to wake a device
 type WoLRequest struct {
-	MAC string `json:"mac"` // Format: AA:BB:CC:DD:EE:FF
+	MAC       string `json:"mac"`                 // AA:BB:CC:DD:EE:FF or AA-BB-CC-DD-EE-FF
+	Broadcast string `json:"broadcast,omitempty"` // directed broadcast, e.g. 192.168.1.255
+}
+
+// buildMagicPacket renders the WoL payload: 6 bytes of 0xFF followed by the
+// target MAC repeated 16 times
+func buildMagicPacket(mac net.HardwareAddr) []byte {
+	packet := make([]byte, 0, 6+16*len(mac))
+	for i := 0; i < 6; i++ {
+		packet = append(packet, 0xFF)
+	}
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+	return packet
 }
 
+// WakeOnLAN builds and broadcasts the magic packet natively - no dependency
+// on wakeonlan/etherwake being installed in the container
 func WakeOnLAN(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req WoLRequest
@@ -122,22 +408,41 @@ func WakeOnLAN(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// net.ParseMAC accepts both : and - separators
+		mac, err := net.ParseMAC(req.MAC)
+		if err != nil || len(mac) != 6 {
+			http.Error(w, "Invalid MAC address", http.StatusBadRequest)
+			return
+		}
 
+		target := "255.255.255.255"
+		if req.Broadcast != "" {
+			if net.ParseIP(req.Broadcast) == nil {
+				http.Error(w, "Invalid broadcast address", http.StatusBadRequest)
+				return
+			}
+			target = req.Broadcast
+		}
 
-		if len(req.MAC) != 17 {
-			http.Error(w, "Invalid MAC address", http.StatusBadRequest)
+		conn, err := net.Dial("udp", net.JoinHostPort(target, "9"))
+		if err != nil {
+			http.Error(w, "Failed to open broadcast socket: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		defer conn.Close()
 
-		// Use wakeonlan command (or implement magic packet directly)
-		cmd := exec.Command("wakeonlan", req.MAC)
-		if err := cmd.Run(); err != nil {
-			// Fallback: use etherwake
-			exec.Command("etherwake", req.MAC).Run()
+		if _, err := conn.Write(buildMagicPacket(mac)); err != nil {
+			http.Error(w, "Failed to send magic packet: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status": "magic_packet_sent"}`))
+		WriteAudit(db, r, "WAKE_ON_LAN", req.MAC, "Magic packet sent to "+target)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":    "magic_packet_sent",
+			"mac":       mac.String(),
+			"broadcast": target,
+		})
 	}
 }
 
@@ -154,33 +459,76 @@ func GetPiholeSettings(db *sql.DB) http.HandlerFunc {
 		var settings PiholeSettings
 		db.QueryRow("SELECT value FROM system_config WHERE key='pihole_enabled'").Scan(&settings.Enabled)
 		db.QueryRow("SELECT value FROM system_config WHERE key='pihole_server'").Scan(&settings.ServerIP)
-		
+
 		json.NewEncoder(w).Encode(settings)
 	}
 }
 
-// UpdatePiholeSettings configures Pi-hole as DNS
+// defaultDNSServers is what peers without a DNS profile get: the Pi-hole
+// server when that integration is on, otherwise the configured dns_server,
+// otherwise the public defaults. Every config generator goes through this so
+// toggling Pi-hole actually changes what clients download.
+func defaultDNSServers(db *sql.DB) string {
+	var enabled string
+	db.QueryRow("SELECT value FROM system_config WHERE key='pihole_enabled'").Scan(&enabled)
+	if enabled == "true" || enabled == "1" {
+		var pihole string
+		db.QueryRow("SELECT value FROM system_config WHERE key='pihole_server'").Scan(&pihole)
+		if pihole != "" {
+			return pihole
+		}
+	}
+	dns := "1.1.1.1, 8.8.8.8"
+	db.QueryRow("SELECT value FROM system_config WHERE key='dns_server'").Scan(&dns)
+	return dns
+}
+
+// UpdatePiholeSettings configures Pi-hole as DNS. Enabling verifies the
+// server actually answers on port 53 first; with "propagate": true the DNS
+// line in every existing client config is rewritten as well (same background
+// mechanism as UpdateGlobalSettings).
 func UpdatePiholeSettings(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var req PiholeSettings
+		var req struct {
+			PiholeSettings
+			Propagate bool `json:"propagate"`
+		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Bad Request", http.StatusBadRequest)
 			return
 		}
 
+		if req.Enabled {
+			if net.ParseIP(req.ServerIP) == nil {
+				http.Error(w, "Valid server_ip required to enable Pi-hole", http.StatusBadRequest)
+				return
+			}
+			// A DNS server that doesn't answer on 53 would take every
+			// client offline the moment their config updates
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(req.ServerIP, "53"), 3*time.Second)
+			if err != nil {
+				http.Error(w, "Pi-hole server unreachable on port 53: "+err.Error(), http.StatusBadGateway)
+				return
+			}
+			conn.Close()
+		}
+
 		db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('pihole_enabled', ?)", req.Enabled)
 		db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('pihole_server', ?)", req.ServerIP)
 
-
-
-		if req.Enabled && req.ServerIP != "" {
-			db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('default_dns', ?)", req.ServerIP)
-		} else {
-			db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('default_dns', '1.1.1.1')")
+		resp := map[string]string{"status": "pihole_configured"}
+		if req.Propagate {
+			mtu := "1380"
+			db.QueryRow("SELECT value FROM system_config WHERE key='mtu'").Scan(&mtu)
+			if startPropagation(db, mtu, defaultDNSServers(db)) {
+				resp["propagation"] = "started"
+			} else {
+				resp["propagation"] = "already_running"
+			}
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status": "pihole_configured"}`))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
 	}
 }
 
@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/middleware"
 )
 
 // OAuthConfig holds OAuth provider settings
@@ -122,7 +124,8 @@ func OAuthCallback(db *sql.DB, provider string) http.HandlerFunc {
 
 		// Create session
 		sessionToken := generateRandomState()
-		db.Exec("INSERT INTO sessions (user_id, token_hash, created_at, expires_at) VALUES (?, ?, datetime('now'), datetime('now', '+7 days'))", userID, sessionToken)
+		db.Exec("INSERT INTO sessions (user_id, token_hash, created_at, expires_at, ip, user_agent) VALUES (?, ?, datetime('now'), datetime('now', '+7 days'), ?, ?)",
+			userID, sessionToken, middleware.GetClientIP(r), r.Header.Get("User-Agent"))
 
 		http.SetCookie(w, &http.Cookie{
 			Name:     "session_token",
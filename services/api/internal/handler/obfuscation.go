@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
+)
+
+// ObfuscationConfig holds AmneziaWG DPI-evasion parameters injected into the
+// [Interface] section of server and client configs when enabled
+type ObfuscationConfig struct {
+	Enabled bool `json:"enabled"`
+	Jc      int  `json:"jc"`   // Junk packet count
+	Jmin    int  `json:"jmin"` // Junk packet min size
+	Jmax    int  `json:"jmax"` // Junk packet max size
+	S1      int  `json:"s1"`   // Init packet junk size
+	S2      int  `json:"s2"`   // Response packet junk size
+	H1      int  `json:"h1"`   // Init packet magic header
+	H2      int  `json:"h2"`   // Response packet magic header
+	H3      int  `json:"h3"`   // Underload packet magic header
+	H4      int  `json:"h4"`   // Transport packet magic header
+}
+
+func getObfuscationConfig(db *sql.DB) ObfuscationConfig {
+	var cfg ObfuscationConfig
+	var raw string
+	db.QueryRow("SELECT value FROM system_config WHERE key='obfuscation'").Scan(&raw)
+	if raw != "" {
+		json.Unmarshal([]byte(raw), &cfg)
+	}
+	return cfg
+}
+
+// amneziaCapable probes for an AmneziaWG-patched stack: either the awg
+// userspace tool or the kernel module
+func amneziaCapable() bool {
+	if _, err := exec.LookPath("awg"); err == nil {
+		return true
+	}
+	if _, err := os.Stat("/sys/module/amneziawg"); err == nil {
+		return true
+	}
+	return false
+}
+
+// obfuscationLines returns the extra [Interface] lines for client configs,
+// or "" when obfuscation is disabled
+func obfuscationLines(db *sql.DB) string {
+	cfg := getObfuscationConfig(db)
+	if !cfg.Enabled {
+		return ""
+	}
+	return fmt.Sprintf("Jc = %d\nJmin = %d\nJmax = %d\nS1 = %d\nS2 = %d\nH1 = %d\nH2 = %d\nH3 = %d\nH4 = %d\n",
+		cfg.Jc, cfg.Jmin, cfg.Jmax, cfg.S1, cfg.S2, cfg.H1, cfg.H2, cfg.H3, cfg.H4)
+}
+
+// GetObfuscation returns the stored config plus whether this host can
+// actually run AmneziaWG
+func GetObfuscation(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getObfuscationConfig(db)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"config":  cfg,
+			"capable": amneziaCapable(),
+		})
+	}
+}
+
+// UpdateObfuscation stores the config and rewrites the server [Interface]
+// section. Enabling requires the AmneziaWG capability, otherwise the server
+// would hand out parameters it can't honor.
+func UpdateObfuscation(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ObfuscationConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if req.Enabled && !amneziaCapable() {
+			http.Error(w, "AmneziaWG not available on this host (need awg binary or amneziawg kernel module)", http.StatusBadRequest)
+			return
+		}
+
+		// Sane defaults matching the AmneziaWG documentation examples
+		if req.Enabled {
+			if req.Jc == 0 {
+				req.Jc = 4
+			}
+			if req.Jmin == 0 {
+				req.Jmin = 40
+			}
+			if req.Jmax == 0 {
+				req.Jmax = 70
+			}
+		}
+
+		raw, _ := json.Marshal(req)
+		db.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('obfuscation', ?)", string(raw))
+
+		if err := applyServerObfuscation(db, req); err != nil {
+			http.Error(w, "Saved, but server config update failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		WriteAudit(db, r, "OBFUSCATION_UPDATE", "system", fmt.Sprintf("AmneziaWG enabled=%v", req.Enabled))
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status": "updated"}`))
+	}
+}
+
+// applyServerObfuscation rewrites the Amnezia lines in wg0.conf's [Interface]
+// section, using the same cross-process lock as peer writes
+func applyServerObfuscation(db *sql.DB, cfg ObfuscationConfig) error {
+	wg0Path := config.Get().WGConfigPath
+	lockPath := filepath.Dir(wg0Path) + "/.wg0.lock"
+
+	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	content, err := os.ReadFile(wg0Path)
+	if err != nil {
+		return err
+	}
+
+	amneziaKeys := map[string]bool{
+		"Jc": true, "Jmin": true, "Jmax": true, "S1": true, "S2": true,
+		"H1": true, "H2": true, "H3": true, "H4": true,
+	}
+
+	var out []string
+	inInterface := false
+	for _, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			inInterface = trimmed == "[Interface]"
+		}
+		// Strip any existing Amnezia params; they're re-added below if enabled
+		if inInterface {
+			key := strings.TrimSpace(strings.SplitN(trimmed, "=", 2)[0])
+			if amneziaKeys[key] {
+				continue
+			}
+		}
+		out = append(out, line)
+
+		if trimmed == "[Interface]" && cfg.Enabled {
+			out = append(out, strings.TrimSuffix(fmt.Sprintf("Jc = %d\nJmin = %d\nJmax = %d\nS1 = %d\nS2 = %d\nH1 = %d\nH2 = %d\nH3 = %d\nH4 = %d",
+				cfg.Jc, cfg.Jmin, cfg.Jmax, cfg.S1, cfg.S2, cfg.H1, cfg.H2, cfg.H3, cfg.H4), "\n"))
+		}
+	}
+
+	return os.WriteFile(wg0Path, []byte(strings.Join(out, "\n")), 0600)
+}
@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/middleware"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// One-time onboarding tokens let users self-provision a peer without an
+// account: an admin mints a token bound to a name prefix, optional group and
+// data limit, hands out the link, and the user redeems it once before it
+// expires. Only the SHA-256 of the token is stored (the sessions scheme), so
+// a leaked database cannot mint valid links, and the parameters live on the
+// server-side row so the token itself carries nothing to tamper with.
+
+var namePrefixRe = regexp.MustCompile("^[a-zA-Z0-9_-]{1,48}$")
+
+// OnboardingTokenRequest is the admin-side mint request
+type OnboardingTokenRequest struct {
+	NamePrefix  string `json:"name_prefix"`
+	GroupID     int    `json:"group_id,omitempty"`
+	ExpiresIn   int    `json:"expires_in_hours,omitempty"` // default 24, max 720
+	DataLimitGB int    `json:"data_limit_gb,omitempty"`
+}
+
+// CreateOnboardingToken mints a single-use onboarding token (admin only,
+// enforced at the route). The raw token is returned exactly once.
+func CreateOnboardingToken(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req OnboardingTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if !namePrefixRe.MatchString(req.NamePrefix) {
+			http.Error(w, "Invalid name_prefix (1-48 alphanumeric chars)", http.StatusBadRequest)
+			return
+		}
+		if req.ExpiresIn <= 0 {
+			req.ExpiresIn = 24
+		}
+		if req.ExpiresIn > 720 {
+			http.Error(w, "expires_in_hours too large (max 720)", http.StatusBadRequest)
+			return
+		}
+		if req.DataLimitGB < 0 {
+			http.Error(w, "Invalid data_limit_gb", http.StatusBadRequest)
+			return
+		}
+		var groupID interface{}
+		if req.GroupID > 0 {
+			var exists int
+			db.QueryRow("SELECT 1 FROM peer_groups WHERE id = ?", req.GroupID).Scan(&exists)
+			if exists != 1 {
+				http.Error(w, "Group not found", http.StatusNotFound)
+				return
+			}
+			groupID = req.GroupID
+		}
+
+		tokenBytes := make([]byte, 32)
+		rand.Read(tokenBytes)
+		token := hex.EncodeToString(tokenBytes)
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresIn) * time.Hour).UTC()
+
+		_, err := db.Exec(`INSERT INTO onboarding_tokens (token_hash, name_prefix, group_id, data_limit_gb, expires_at, created_by)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			auth.HashToken(token), req.NamePrefix, groupID, req.DataLimitGB,
+			expiresAt.Format("2006-01-02 15:04:05"), middleware.GetUserID(r))
+		if err != nil {
+			http.Error(w, "Failed to store token", http.StatusInternalServerError)
+			return
+		}
+
+		WriteAudit(db, r, "ONBOARDING_TOKEN_CREATE", req.NamePrefix,
+			fmt.Sprintf("Onboarding token minted (expires in %dh)", req.ExpiresIn))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     "created",
+			"token":      token,
+			"url":        "/api/v1/onboarding?token=" + token,
+			"expires_at": expiresAt.Format(time.RFC3339),
+		})
+	}
+}
+
+// RedeemOnboardingToken handles the public (unauthenticated, rate-limited)
+// half of the flow: validate and atomically burn the token, create the peer
+// through the same creation core as POST /peers so every side effect
+// (allocation, client .conf, wg0.conf, live wg set, reconcile) behaves
+// identically, then hand the config back as JSON or, with ?format=qr, as a PNG.
+func RedeemOnboardingToken(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			http.Error(w, "Missing token", http.StatusBadRequest)
+			return
+		}
+		tokenHash := auth.HashToken(token)
+
+		// Claim atomically so two concurrent redemptions can't both win
+		res, err := db.Exec(`UPDATE onboarding_tokens SET used = 1, used_at = CURRENT_TIMESTAMP
+			WHERE token_hash = ? AND used = 0 AND expires_at > CURRENT_TIMESTAMP`, tokenHash)
+		if err != nil {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			WriteAudit(db, r, "ONBOARDING_REJECT", "", "Invalid, expired or already-used onboarding token")
+			http.Error(w, "Invalid or expired token", http.StatusForbidden)
+			return
+		}
+
+		var namePrefix string
+		var groupID sql.NullInt64
+		var dataLimitGB int
+		db.QueryRow("SELECT name_prefix, group_id, COALESCE(data_limit_gb, 0) FROM onboarding_tokens WHERE token_hash = ?",
+			tokenHash).Scan(&namePrefix, &groupID, &dataLimitGB)
+
+		// Pick a free name under the prefix; collisions are astronomically
+		// unlikely but cheap to retry
+		var peerName string
+		for attempt := 0; attempt < 5; attempt++ {
+			suffix := make([]byte, 3)
+			rand.Read(suffix)
+			candidate := namePrefix + "-" + hex.EncodeToString(suffix)
+			var exists int
+			db.QueryRow("SELECT 1 FROM peers WHERE name = ?", candidate).Scan(&exists)
+			if exists != 1 {
+				peerName = candidate
+				break
+			}
+		}
+		if peerName == "" {
+			releaseOnboardingToken(db, tokenHash)
+			http.Error(w, "Could not allocate peer name", http.StatusInternalServerError)
+			return
+		}
+
+		// Create through the same core as POST /peers so this path can never
+		// drift from the API one. The caller is unauthenticated, so the
+		// detailed failure stays in the log and they only learn that it failed.
+		iface, err := resolveInterface(db, r)
+		if err != nil {
+			releaseOnboardingToken(db, tokenHash)
+			slog.Warn("Onboarding peer creation failed", "peer", peerName, "error", err)
+			http.Error(w, "Peer creation failed", http.StatusInternalServerError)
+			return
+		}
+		conf, cerr := createPeerCore(db, NewPeerRequest{Name: peerName}, iface)
+		if cerr != nil {
+			releaseOnboardingToken(db, tokenHash)
+			slog.Warn("Onboarding peer creation failed", "peer", peerName, "status", cerr.Status, "error", cerr.Message)
+			http.Error(w, "Peer creation failed", http.StatusInternalServerError)
+			return
+		}
+
+		var peerID int
+		db.QueryRow("SELECT id FROM peers WHERE name = ?", peerName).Scan(&peerID)
+		if groupID.Valid {
+			db.Exec("INSERT OR IGNORE INTO peer_group_members (group_id, peer_id) VALUES (?, ?)", groupID.Int64, peerID)
+		}
+		if dataLimitGB > 0 {
+			db.Exec("UPDATE peers SET data_limit_gb = ? WHERE id = ?", dataLimitGB, peerID)
+			os.WriteFile(filepath.Join(config.Get().ClientsDir, peerName+".conf.limit"),
+				[]byte(fmt.Sprintf("%d", dataLimitGB)), 0644)
+		}
+		db.Exec("UPDATE onboarding_tokens SET used_peer = ? WHERE token_hash = ?", peerName, tokenHash)
+
+		WriteAudit(db, r, "ONBOARDING_REDEEM", peerName, "Peer self-provisioned via onboarding token")
+
+		if r.URL.Query().Get("format") == "qr" {
+			png, err := qrcode.Encode(conf, qrcode.Medium, 256)
+			if err != nil {
+				http.Error(w, "QR generation failed", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "created",
+			"name":   peerName,
+			"config": conf,
+		})
+	}
+}
+
+// releaseOnboardingToken un-burns a claimed token after a failed redemption
+// so the user can retry with the same link
+func releaseOnboardingToken(db *sql.DB, tokenHash string) {
+	db.Exec("UPDATE onboarding_tokens SET used = 0, used_at = NULL WHERE token_hash = ?", tokenHash)
+}
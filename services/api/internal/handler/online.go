@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OnlinePeer is one currently-connected peer in the live view
+type OnlinePeer struct {
+	ID                    int    `json:"id"`
+	Name                  string `json:"name"`
+	Endpoint              string `json:"endpoint,omitempty"`
+	Rx                    string `json:"rx"`
+	Tx                    string `json:"tx"`
+	RxBytes               int64  `json:"rx_bytes"`
+	TxBytes               int64  `json:"tx_bytes"`
+	SecondsSinceHandshake int64  `json:"seconds_since_handshake"`
+}
+
+// OnlinePeers returns peers with a handshake inside the threshold (default
+// 180s, tunable with ?threshold=), sourced from the cached WG stats so a
+// "currently connected" widget can poll it cheaply
+func OnlinePeers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		threshold := int64(180)
+		if v := r.URL.Query().Get("threshold"); v != "" {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 && n <= 86400 {
+				threshold = n
+			}
+		}
+
+		var wgStats map[string]WireGuardStats
+		if r.URL.Query().Get("fresh") == "true" {
+			wgStats = RefreshWireGuardStats()
+		} else {
+			wgStats = GetWireGuardStats()
+		}
+
+		now := time.Now().Unix()
+		online := make([]OnlinePeer, 0)
+		for pub, stats := range wgStats {
+			if stats.HandshakeUnix <= 0 || now-stats.HandshakeUnix > threshold {
+				continue
+			}
+
+			var id int
+			var name string
+			if db.QueryRow("SELECT id, name FROM peers WHERE public_key = ?", pub).Scan(&id, &name) != nil {
+				continue // in wg but not in DB; the orphan check covers those
+			}
+
+			endpoint := stats.Endpoint
+			if endpoint == "" {
+				db.QueryRow("SELECT COALESCE(last_endpoint, '') FROM peers WHERE id = ?", id).Scan(&endpoint)
+			}
+
+			online = append(online, OnlinePeer{
+				ID:                    id,
+				Name:                  name,
+				Endpoint:              endpoint,
+				Rx:                    stats.Rx,
+				Tx:                    stats.Tx,
+				RxBytes:               stats.RxBytes,
+				TxBytes:               stats.TxBytes,
+				SecondsSinceHandshake: now - stats.HandshakeUnix,
+			})
+		}
+
+		// Most recently active first
+		sort.Slice(online, func(i, j int) bool {
+			return online[i].SecondsSinceHandshake < online[j].SecondsSinceHandshake
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		resp := map[string]interface{}{
+			"peers":             online,
+			"count":             len(online),
+			"threshold_seconds": threshold,
+		}
+		if at := WireGuardStatsUpdatedAt(); !at.IsZero() {
+			resp["stats_updated_at"] = at.UTC().Format(time.RFC3339)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -1,17 +1,22 @@
 package handler
 
 import (
+	"bytes"
 	"database/sql"
 	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
 	"log/slog"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
 	"github.com/skip2/go-qrcode"
 )
 
@@ -24,18 +29,21 @@ func GetPeerQR(db *sql.DB) http.HandlerFunc {
 		}
 
 		var name, encPrivKey, allowedIPs string
-		var dnsProfile sql.NullString
+		var dnsProfile, allowedOverride, tunnelMode sql.NullString
+		var serverPort sql.NullInt64
 
 		err := db.QueryRow(`
-			SELECT p.name, p.encrypted_private_key, p.allowed_ips, ps.dns_profile 
-			FROM peers p 
-			LEFT JOIN peer_settings ps ON p.id = ps.peer_id 
-			WHERE p.id = ?`, id).Scan(&name, &encPrivKey, &allowedIPs, &dnsProfile)
+			SELECT p.name, p.encrypted_private_key, p.allowed_ips, ps.dns_profile, ps.allowed_ips_override, ps.server_port, ps.tunnel_mode
+			FROM peers p
+			LEFT JOIN peer_settings ps ON p.id = ps.peer_id
+			WHERE p.id = ?`, id).Scan(&name, &encPrivKey, &allowedIPs, &dnsProfile, &allowedOverride, &serverPort, &tunnelMode)
 		if err != nil {
 			http.Error(w, "Peer not found", http.StatusNotFound)
 			return
 		}
 
+		recordPeerPlatform(db, id, r)
+
 		var privateKey string
 		
 		// Only attempt decryption if there's actually something to decrypt
@@ -53,7 +61,7 @@ func GetPeerQR(db *sql.DB) http.HandlerFunc {
 		
 		// Fallback to file system if decryption failed or key was empty/CLI_MANAGED
 		if privateKey == "" {
-			clientConfPath := filepath.Join("/opt/samnet/clients", name+".conf")
+			clientConfPath := filepath.Join(config.Get().ClientsDir, name+".conf")
 			slog.Info("Decryption failed or key empty, attempting file fallback", "peer", name, "path", clientConfPath)
 			
 			content, fileErr := os.ReadFile(clientConfPath)
@@ -86,15 +94,11 @@ func GetPeerQR(db *sql.DB) http.HandlerFunc {
 			}
 		}
 
-		dns := "1.1.1.1, 8.8.8.8" // Match CLI format
-		db.QueryRow("SELECT value FROM system_config WHERE key='dns_server'").Scan(&dns)
+		dns := defaultDNSServers(db)
 		
 		if dnsProfile.Valid {
-			switch dnsProfile.String {
-			case "adblock":
-				dns = "94.140.14.14"
-			case "family":
-				dns = "1.1.1.3"
+			if servers := dnsProfileServers(db, dnsProfile.String); servers != "" {
+				dns = servers
 			}
 		}
 
@@ -107,18 +111,17 @@ func GetPeerQR(db *sql.DB) http.HandlerFunc {
 		}
 		db.QueryRow("SELECT value FROM system_config WHERE key='split_tunnel'").Scan(&splitTunnel)
 		
-		var customHost string
-		db.QueryRow("SELECT value FROM system_config WHERE key='endpoint_hostname'").Scan(&customHost)
-		
-		wanIP := ""
-		if customHost != "" {
-			wanIP = customHost
-		} else {
-			wanIP = getValidWanIP(db)
+		wanIP, err := resolveEndpointHost(db, r.URL.Query().Get("endpoint"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		
+
 		port := "51820"
 		db.QueryRow("SELECT value FROM system_config WHERE key='listen_port'").Scan(&port)
+		if serverPort.Valid && serverPort.Int64 > 0 {
+			port = strconv.FormatInt(serverPort.Int64, 10)
+		}
 		
 		// Handle IPv6 literal in endpoint (shouldn't happen with getValidWanIP but safety)
 		endpoint := fmt.Sprintf("%s:%s", wanIP, port)
@@ -127,10 +130,7 @@ func GetPeerQR(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Fix: Use subnet mask for Address (e.g., /24) instead of /32
-		_, ipNet, _ := net.ParseCIDR(subnetCIDR)
-		ones, _ := ipNet.Mask.Size()
-		if ones == 0 { ones = 24 } // Fallback safety
-		clientAddr := strings.Split(allowedIPs, "/")[0] + fmt.Sprintf("/%d", ones)
+		clientAddr := clientAddressFor(db, allowedIPs)
 
 		serverPub := GetServerPublicKey()
 		
@@ -138,10 +138,12 @@ func GetPeerQR(db *sql.DB) http.HandlerFunc {
 		mtu := "1380"
 		db.QueryRow("SELECT value FROM system_config WHERE key='mtu'").Scan(&mtu)
 
-		cfg := fmt.Sprintf("[Interface]\nPrivateKey = %s\nAddress = %s\nDNS = %s\nMTU = %s\n\n[Peer]\nPublicKey = %s\n",
-			privateKey, clientAddr, dns, mtu, serverPub)
+		cfg := fmt.Sprintf("[Interface]\nPrivateKey = %s\nAddress = %s\nDNS = %s\nMTU = %s\n%s\n[Peer]\nPublicKey = %s\n",
+			privateKey, clientAddr, dns, mtu, obfuscationLines(db), serverPub)
 
-		if splitTunnel == "true" {
+		if allowedOverride.Valid && allowedOverride.String != "" {
+			cfg += "AllowedIPs = " + allowedOverride.String + "\n"
+		} else if tunnelMode.String == "split" || (tunnelMode.String != "full" && splitTunnel == "true") {
 			cfg += fmt.Sprintf("AllowedIPs = %s, 192.168.0.0/16, 172.16.0.0/12, 10.0.0.0/8\n", subnetCIDR)
 		} else {
 			cfg += "AllowedIPs = 0.0.0.0/0, ::/0\n"
@@ -149,14 +151,103 @@ func GetPeerQR(db *sql.DB) http.HandlerFunc {
 		
 		cfg += fmt.Sprintf("Endpoint = %s\nPersistentKeepalive = 25\n", endpoint)
 
-		png, err := qrcode.Encode(cfg, qrcode.Medium, 256)
+		size, level := qrRenderOptions(r)
+		withLogo := r.URL.Query().Get("logo") == "true"
+		if withLogo {
+			// A center logo destroys modules; only the highest correction
+			// level keeps the code scannable underneath it
+			level = qrcode.Highest
+		}
+
+		png, err := qrcode.Encode(cfg, level, size)
 		if err != nil {
 			http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
 			return
 		}
 
+		if withLogo {
+			if branded, err := overlayQRLogo(db, png, size); err == nil {
+				png = branded
+			} else {
+				slog.Warn("QR logo overlay failed, serving plain code", "error", err)
+			}
+		}
+
 		w.Header().Set("Content-Type", "image/png")
 		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=peer-%s.png", id))
 		w.Write(png)
 	}
 }
+
+// qrRenderOptions reads the optional ?size= and ?level= params, defaulting to
+// the historical 256px / Medium
+func qrRenderOptions(r *http.Request) (int, qrcode.RecoveryLevel) {
+	size := 256
+	if v := r.URL.Query().Get("size"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 64 && n <= 2048 {
+			size = n
+		}
+	}
+
+	level := qrcode.Medium
+	switch strings.ToUpper(r.URL.Query().Get("level")) {
+	case "L":
+		level = qrcode.Low
+	case "M":
+		level = qrcode.Medium
+	case "Q":
+		level = qrcode.High
+	case "H":
+		level = qrcode.Highest
+	}
+	return size, level
+}
+
+// overlayQRLogo draws the configured PNG logo (qr_logo_path, default
+// /opt/samnet/logo.png) over the center of an encoded QR code
+func overlayQRLogo(db *sql.DB, qrPNG []byte, size int) ([]byte, error) {
+	logoPath := "/opt/samnet/logo.png"
+	db.QueryRow("SELECT value FROM system_config WHERE key='qr_logo_path'").Scan(&logoPath)
+
+	lf, err := os.Open(logoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer lf.Close()
+	logo, err := png.Decode(lf)
+	if err != nil {
+		return nil, fmt.Errorf("logo must be a PNG: %w", err)
+	}
+
+	qrImg, err := png.Decode(bytes.NewReader(qrPNG))
+	if err != nil {
+		return nil, err
+	}
+
+	out := image.NewRGBA(qrImg.Bounds())
+	draw.Draw(out, out.Bounds(), qrImg, image.Point{}, draw.Src)
+
+	// Cover roughly a fifth of the code; level H tolerates up to 30% damage
+	target := size / 5
+	scaled := scaleImage(logo, target, target)
+	offset := image.Pt((size-target)/2, (size-target)/2)
+	draw.Draw(out, image.Rectangle{Min: offset, Max: offset.Add(image.Pt(target, target))}, scaled, image.Point{}, draw.Over)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleImage does nearest-neighbour scaling; plenty for a small center logo
+func scaleImage(src image.Image, w, h int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sb := src.Bounds()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Set(x, y, src.At(sb.Min.X+x*sb.Dx()/w, sb.Min.Y+y*sb.Dy()/h))
+		}
+	}
+	return dst
+}
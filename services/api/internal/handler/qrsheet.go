@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"bytes"
+	"compress/zlib"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
+	"github.com/skip2/go-qrcode"
+)
+
+// QRSheet renders a printable PDF with a grid of peer QR codes, each labeled
+// with the peer name - the "print and hand out" onboarding workflow. Filter
+// with ?group= (name or id), control density with ?per_page= (default 6).
+// The PDF is generated by hand; like the S3 signing, one document layout is
+// not worth a new dependency.
+func QRSheet(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		perPage := 6
+		if v := r.URL.Query().Get("per_page"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= 12 {
+				perPage = n
+			}
+		}
+
+		query := `SELECT p.name, p.encrypted_private_key, p.allowed_ips,
+			COALESCE(ps.dns_profile, ''), COALESCE(ps.allowed_ips_override, ''), COALESCE(ps.server_port, 0), COALESCE(ps.tunnel_mode, '')
+			FROM peers p
+			LEFT JOIN peer_settings ps ON p.id = ps.peer_id`
+		args := []interface{}{}
+		if group := r.URL.Query().Get("group"); group != "" {
+			query += ` JOIN peer_group_members pgm ON p.id = pgm.peer_id
+				JOIN peer_groups g ON pgm.group_id = g.id`
+			if _, err := strconv.Atoi(group); err == nil {
+				query += " WHERE g.id = ?"
+			} else {
+				query += " WHERE g.name = ?"
+			}
+			args = append(args, group)
+			query += " AND COALESCE(p.disabled, 0) = 0"
+		} else {
+			query += " WHERE COALESCE(p.disabled, 0) = 0"
+		}
+		query += " ORDER BY p.name"
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		wanIP, err := resolveEndpointHost(db, r.URL.Query().Get("endpoint"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		globalPort := "51820"
+		db.QueryRow("SELECT value FROM system_config WHERE key='listen_port'").Scan(&globalPort)
+
+		type sheetEntry struct {
+			name   string
+			qr     *qrcode.QRCode
+		}
+		var entries []sheetEntry
+		for rows.Next() {
+			var name, encPriv, allowedIPs, dnsProfile, override, tunnelMode string
+			var serverPort int
+			if rows.Scan(&name, &encPriv, &allowedIPs, &dnsProfile, &override, &serverPort, &tunnelMode) != nil {
+				continue
+			}
+
+			privateKey, err := auth.Decrypt(encPriv)
+			if err != nil {
+				if len(encPriv) == 44 {
+					privateKey = encPriv // legacy plaintext key
+				} else {
+					slog.Warn("Skipping peer on QR sheet, key not recoverable", "peer", name)
+					continue
+				}
+			}
+
+			port := globalPort
+			if serverPort > 0 {
+				port = strconv.Itoa(serverPort)
+			}
+
+			cfg := BuildClientConfig(db, ClientConfigParams{
+				PrivateKey:         privateKey,
+				Address:            clientAddressFor(db, allowedIPs),
+				DNSProfile:         dnsProfile,
+				AllowedIPsOverride: override,
+				Endpoint:           wanIP + ":" + port,
+				TunnelMode:         tunnelMode,
+			})
+
+			qr, err := qrcode.New(cfg, qrcode.Medium)
+			if err != nil {
+				slog.Warn("QR encoding failed for sheet", "peer", name, "error", err)
+				continue
+			}
+			entries = append(entries, sheetEntry{name: name, qr: qr})
+		}
+
+		if len(entries) == 0 {
+			http.Error(w, "No peers matched", http.StatusNotFound)
+			return
+		}
+
+		pdf := newPDFBuilder()
+		fontNum := pdf.add("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>")
+		pagesNum := pdf.reserve()
+
+		// A4 in points, with the grid sized from per_page
+		const pageW, pageH, margin = 595.0, 842.0, 36.0
+		cols := int(math.Ceil(math.Sqrt(float64(perPage))))
+		pRows := (perPage + cols - 1) / cols
+		cellW := (pageW - 2*margin) / float64(cols)
+		cellH := (pageH - 2*margin) / float64(pRows)
+		qrSize := math.Min(cellW, cellH-24) * 0.9
+
+		var pageNums []int
+		for start := 0; start < len(entries); start += perPage {
+			end := start + perPage
+			if end > len(entries) {
+				end = len(entries)
+			}
+
+			var content strings.Builder
+			xobjects := ""
+			for i, e := range entries[start:end] {
+				col := float64(i % cols)
+				row := float64(i / cols)
+				x := margin + col*cellW + (cellW-qrSize)/2
+				y := pageH - margin - (row+1)*cellH + (cellH-24-qrSize)/2 + 24
+
+				imgNum := pdf.add(qrImageObject(e.qr))
+				imgName := fmt.Sprintf("Im%d", imgNum)
+				xobjects += fmt.Sprintf("/%s %d 0 R ", imgName, imgNum)
+
+				fmt.Fprintf(&content, "q %.2f 0 0 %.2f %.2f %.2f cm /%s Do Q\n", qrSize, qrSize, x, y, imgName)
+				labelX := x + (qrSize-5.0*float64(len(e.name)))/2
+				fmt.Fprintf(&content, "BT /F1 10 Tf %.2f %.2f Td (%s) Tj ET\n", labelX, y-14, pdfEscape(e.name))
+			}
+
+			contentNum := pdf.add(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content.String()), content.String()))
+			pageNum := pdf.add(fmt.Sprintf(
+				"<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.0f %.0f] /Contents %d 0 R /Resources << /Font << /F1 %d 0 R >> /XObject << %s>> >> >>",
+				pagesNum, pageW, pageH, contentNum, fontNum, xobjects))
+			pageNums = append(pageNums, pageNum)
+		}
+
+		kids := make([]string, len(pageNums))
+		for i, n := range pageNums {
+			kids[i] = fmt.Sprintf("%d 0 R", n)
+		}
+		pdf.set(pagesNum, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pageNums)))
+		catalogNum := pdf.add(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pagesNum))
+
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", "attachment; filename=samnet-qr-sheet.pdf")
+		w.Write(pdf.render(catalogNum))
+	}
+}
+
+// qrImageObject encodes the QR module bitmap as a 8-bit grayscale XObject.
+// The tiny module grid is embedded as-is and scaled by the page transform,
+// which keeps the PDF small and the modules crisp.
+func qrImageObject(qr *qrcode.QRCode) string {
+	bitmap := qr.Bitmap()
+	n := len(bitmap)
+	pixels := make([]byte, 0, n*n)
+	for _, row := range bitmap {
+		for _, black := range row {
+			if black {
+				pixels = append(pixels, 0x00)
+			} else {
+				pixels = append(pixels, 0xFF)
+			}
+		}
+	}
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(pixels)
+	zw.Close()
+
+	return fmt.Sprintf(
+		"<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream",
+		n, n, compressed.Len(), compressed.String())
+}
+
+// pdfEscape protects the characters with meaning inside PDF string literals
+func pdfEscape(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "(", "\\(")
+	s = strings.ReplaceAll(s, ")", "\\)")
+	return s
+}
+
+// pdfBuilder assembles a PDF from numbered objects plus the xref table
+type pdfBuilder struct {
+	objs []string // 1-indexed bodies; reserved slots filled in later
+}
+
+func newPDFBuilder() *pdfBuilder {
+	return &pdfBuilder{}
+}
+
+// add appends an object and returns its number
+func (b *pdfBuilder) add(body string) int {
+	b.objs = append(b.objs, body)
+	return len(b.objs)
+}
+
+// reserve allocates an object number whose body is set later (for objects
+// that must reference children created after them, like /Pages)
+func (b *pdfBuilder) reserve() int {
+	return b.add("")
+}
+
+func (b *pdfBuilder) set(num int, body string) {
+	b.objs[num-1] = body
+}
+
+// render assembles header, objects, xref and trailer into the final document
+func (b *pdfBuilder) render(rootNum int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+
+	offsets := make([]int, len(b.objs))
+	for i, body := range b.objs {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, body)
+	}
+
+	xrefStart := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n", len(b.objs)+1)
+	buf.WriteString("0000000000 65535 f \n")
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(b.objs)+1, rootNum, xrefStart)
+	return buf.Bytes()
+}
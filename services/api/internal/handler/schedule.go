@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ScheduleEntry is one access window for a peer. A window with
+// end_hour <= start_hour spans midnight (e.g. 22 -> 2). Timezone is an IANA
+// name like Europe/Madrid; empty means server-local time.
+type ScheduleEntry struct {
+	ID        int    `json:"id,omitempty"`
+	DayOfWeek int    `json:"day_of_week"` // 0=Sunday, 6=Saturday
+	StartHour int    `json:"start_hour"`  // 0-23
+	EndHour   int    `json:"end_hour"`    // 0-23
+	Timezone  string `json:"timezone,omitempty"`
+}
+
+// ScheduleZone resolves a stored timezone name. Empty keeps server-local
+// time; invalid names fall back to UTC with a warning so a typo degrades
+// predictably instead of silently using the server zone.
+func ScheduleZone(name string) *time.Location {
+	if name == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		slog.Warn("Invalid schedule timezone, falling back to UTC", "timezone", name)
+		return time.UTC
+	}
+	return loc
+}
+
+// ScheduleActive reports whether a window covers the given instant, evaluated
+// in the window's own timezone. Windows with start >= end span midnight: the
+// pre-midnight part belongs to the window's day, the post-midnight part to
+// the following day.
+func ScheduleActive(s ScheduleEntry, now time.Time) bool {
+	local := now.In(ScheduleZone(s.Timezone))
+	weekday := int(local.Weekday())
+	hour := local.Hour()
+
+	if s.DayOfWeek == weekday {
+		if s.StartHour == s.EndHour {
+			return true // degenerate window = whole day
+		}
+		if s.StartHour < s.EndHour {
+			return hour >= s.StartHour && hour < s.EndHour
+		}
+		return hour >= s.StartHour
+	}
+	// Previous day's wraparound window reaching into today
+	if (s.DayOfWeek+1)%7 == weekday && s.StartHour > s.EndHour {
+		return hour < s.EndHour
+	}
+	return false
+}
+
+// nextScheduleTransition scans forward hour by hour (up to 8 days) for the
+// first change in the peer's aggregate active state
+func nextScheduleTransition(schedules []ScheduleEntry, now time.Time) *time.Time {
+	if len(schedules) == 0 {
+		return nil
+	}
+	anyActive := func(t time.Time) bool {
+		for _, s := range schedules {
+			if ScheduleActive(s, t) {
+				return true
+			}
+		}
+		return false
+	}
+	current := anyActive(now)
+	probe := now.Truncate(time.Hour)
+	for i := 1; i <= 8*24; i++ {
+		t := probe.Add(time.Duration(i) * time.Hour)
+		if anyActive(t) != current {
+			return &t
+		}
+	}
+	return nil
+}
+
+// GetPeerSchedule lists a peer's access windows
+func GetPeerSchedule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		var name string
+		if err := db.QueryRow("SELECT name FROM peers WHERE id = ?", id).Scan(&name); err != nil {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+
+		rows, err := db.Query("SELECT id, day_of_week, start_hour, end_hour, COALESCE(timezone, '') FROM peer_schedules WHERE peer_id = ? ORDER BY day_of_week, start_hour", id)
+		if err != nil {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		schedules := []ScheduleEntry{}
+		for rows.Next() {
+			var s ScheduleEntry
+			if rows.Scan(&s.ID, &s.DayOfWeek, &s.StartHour, &s.EndHour, &s.Timezone) == nil {
+				schedules = append(schedules, s)
+			}
+		}
+
+		resp := map[string]interface{}{
+			"peer":      name,
+			"schedules": schedules,
+		}
+		// Resolved next enable/disable flip so users can sanity-check zones
+		if next := nextScheduleTransition(schedules, time.Now()); next != nil {
+			resp["next_transition"] = next.Format(time.RFC3339)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// UpdatePeerSchedule replaces a peer's access windows with the submitted set.
+// An empty list removes all schedules (peer stays in whatever state it's in).
+func UpdatePeerSchedule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		var name string
+		if err := db.QueryRow("SELECT name FROM peers WHERE id = ?", id).Scan(&name); err != nil {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+
+		var req struct {
+			Schedules []ScheduleEntry `json:"schedules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		for _, s := range req.Schedules {
+			if s.DayOfWeek < 0 || s.DayOfWeek > 6 {
+				http.Error(w, fmt.Sprintf("Invalid day_of_week %d (0=Sunday..6=Saturday)", s.DayOfWeek), http.StatusBadRequest)
+				return
+			}
+			if s.StartHour < 0 || s.StartHour > 23 || s.EndHour < 0 || s.EndHour > 23 {
+				http.Error(w, "Hours must be 0-23", http.StatusBadRequest)
+				return
+			}
+			if s.Timezone != "" {
+				if _, err := time.LoadLocation(s.Timezone); err != nil {
+					http.Error(w, "Invalid timezone: "+s.Timezone, http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM peer_schedules WHERE peer_id = ?", id); err != nil {
+			http.Error(w, "Failed to update schedules", http.StatusInternalServerError)
+			return
+		}
+		for _, s := range req.Schedules {
+			if _, err := tx.Exec("INSERT INTO peer_schedules (peer_id, day_of_week, start_hour, end_hour, timezone) VALUES (?, ?, ?, ?, ?)",
+				id, s.DayOfWeek, s.StartHour, s.EndHour, s.Timezone); err != nil {
+				http.Error(w, "Failed to update schedules", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		WriteAudit(db, r, "SCHEDULE_UPDATE", name, fmt.Sprintf("%d schedule windows set", len(req.Schedules)))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "updated",
+			"peer":   name,
+			"count":  len(req.Schedules),
+		})
+	}
+}
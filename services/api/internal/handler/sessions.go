@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/middleware"
+)
+
+// SessionInfo is one active session in the "manage my devices" list
+type SessionInfo struct {
+	ID        int    `json:"id"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Current   bool   `json:"current"` // the session making this request
+}
+
+// currentTokenHash extracts the caller's session token (cookie or bearer)
+// and returns its stored hash, empty if none
+func currentTokenHash(r *http.Request) string {
+	var token string
+	if cookie, err := r.Cookie("samnet_session"); err == nil {
+		token = cookie.Value
+	} else if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token == "" {
+		return ""
+	}
+	return auth.HashToken(token)
+}
+
+// dropUserSessionCache evicts a user's sessions from the Redis cache before
+// they're revoked, except the hash in keep (empty = all)
+func dropUserSessionCache(db *sql.DB, userID int, keep string) {
+	rows, err := db.Query("SELECT token_hash FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if rows.Scan(&hash) == nil && hash != keep {
+			middleware.DropCachedSession(hash)
+		}
+	}
+}
+
+// ListMySessions returns the caller's active sessions so they can spot
+// logins they don't recognize
+func ListMySessions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := middleware.GetUserID(r)
+		current := currentTokenHash(r)
+
+		rows, err := db.Query(`
+			SELECT id, token_hash, created_at, expires_at, COALESCE(ip, ''), COALESCE(user_agent, '')
+			FROM sessions
+			WHERE user_id = ? AND expires_at > CURRENT_TIMESTAMP
+			ORDER BY created_at DESC`, userID)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		sessions := []SessionInfo{}
+		for rows.Next() {
+			var s SessionInfo
+			var hash string
+			if err := rows.Scan(&s.ID, &hash, &s.CreatedAt, &s.ExpiresAt, &s.IP, &s.UserAgent); err != nil {
+				continue
+			}
+			s.Current = hash == current
+			sessions = append(sessions, s)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	}
+}
+
+// RevokeSession deletes one of the caller's own sessions by id
+func RevokeSession(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := middleware.GetUserID(r)
+		id := r.PathValue("id")
+
+		// Scoped to the caller so a user can't guess other users' session ids
+		var hash string
+		db.QueryRow("SELECT token_hash FROM sessions WHERE id = ? AND user_id = ?", id, userID).Scan(&hash)
+		res, err := db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", id, userID)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		middleware.DropCachedSession(hash)
+
+		WriteAudit(db, r, "SESSION_REVOKE", id, "User revoked one of their sessions")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+	}
+}
+
+// RevokeOtherSessions logs the caller out everywhere except this device
+func RevokeOtherSessions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := middleware.GetUserID(r)
+		current := currentTokenHash(r)
+
+		dropUserSessionCache(db, userID, current)
+		res, err := db.Exec("DELETE FROM sessions WHERE user_id = ? AND token_hash != ?", userID, current)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		revoked, _ := res.RowsAffected()
+
+		WriteAudit(db, r, "SESSION_REVOKE_ALL", "", "User logged out other devices")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "revoked",
+			"revoked": revoked,
+		})
+	}
+}
@@ -11,10 +11,13 @@ import (
 
 	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
 	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/middleware"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/reconcile"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"syscall"
 )
 
 // SubnetPreset represents a predefined subnet option
@@ -237,8 +240,8 @@ func getCurrentSubnetConfig(db *sql.DB) SubnetConfig {
 	var peerCount int
 	db.QueryRow("SELECT COUNT(*) FROM peers").Scan(&peerCount)
 
-	maxPeers := CalculateMaxPeers(cidr)
-	
+	maxPeers := CalculateMaxPeersDual(db, cidr)
+
 
 	
 	gateway, server, firstPeer, lastPeer := calculateIPRanges(cidr, maxPeers)
@@ -261,6 +264,9 @@ func getCurrentSubnetConfig(db *sql.DB) SubnetConfig {
 type ConfigureSubnetRequest struct {
 	Preset     string `json:"preset,omitempty"`
 	CustomCIDR string `json:"custom_cidr,omitempty"`
+	// Reallocate opts into moving existing peers to the same host offset
+	// in the new pool instead of rejecting an incompatible change
+	Reallocate bool `json:"reallocate,omitempty"`
 }
 
 // ConfigureSubnet sets the VPN subnet (admin only)
@@ -297,8 +303,8 @@ func ConfigureSubnet(db *sql.DB) http.HandlerFunc {
 			}
 		} else if req.CustomCIDR != "" {
 			// Validate custom CIDR
-			if err := validateCIDR(req.CustomCIDR); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+			if verr := ValidateSubnet(req.CustomCIDR); verr != nil {
+				writeSubnetError(w, verr)
 				return
 			}
 			targetCIDR = req.CustomCIDR
@@ -308,6 +314,13 @@ func ConfigureSubnet(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// Preview mode: report the impact without writing anything, so a
+		// migration can be planned instead of hitting the 409s below
+		if r.URL.Query().Get("dry_run") == "true" {
+			writeSubnetDryRun(w, db, targetCIDR)
+			return
+		}
+
 		// Check if subnet change is safe (no existing peers in different range)
 		var peerCount int
 		db.QueryRow("SELECT COUNT(*) FROM peers").Scan(&peerCount)
@@ -323,7 +336,11 @@ func ConfigureSubnet(db *sql.DB) http.HandlerFunc {
 			var currentCIDR string
 			db.QueryRow("SELECT value FROM system_config WHERE key='subnet_cidr'").Scan(&currentCIDR)
 			if currentCIDR != targetCIDR && !isCompatibleSubnetChange(currentCIDR, targetCIDR) {
-				http.Error(w, "Subnet change requires peer reallocation. Existing peers have IPs outside new range.", http.StatusConflict)
+				if req.Reallocate {
+					reallocateSubnet(w, r, db, currentCIDR, targetCIDR, presetName)
+					return
+				}
+				http.Error(w, "Subnet change requires peer reallocation. Existing peers have IPs outside new range. Pass \"reallocate\": true to move them.", http.StatusConflict)
 				return
 			}
 		}
@@ -357,38 +374,296 @@ func ConfigureSubnet(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Audit log - use middleware's GetClientIP and GetRequestID
-		clientIP := middleware.GetClientIP(r)
-		requestID := middleware.GetRequestID(r)
-		db.Exec("INSERT INTO audit_logs (user_id, action, target, details, ip_address, request_id) VALUES (?, 'CONFIGURE_SUBNET', 'system', ?, ?, ?)",
-			middleware.GetUserID(r), fmt.Sprintf("Changed subnet to %s (preset: %s)", targetCIDR, presetName), clientIP, requestID)
+		WriteAudit(db, r, "CONFIGURE_SUBNET", "system", fmt.Sprintf("Changed subnet to %s (preset: %s)", targetCIDR, presetName))
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(getCurrentSubnetConfig(db))
 	}
 }
 
-// validateCIDR validates a custom CIDR
-func validateCIDR(cidr string) error {
+// shiftAllowedIPs moves every IPv4 entry inside oldNet to the same host
+// offset in newNet (host 5 stays host 5), preserving prefix lengths and
+// passing non-matching entries (IPv6, out-of-range) through untouched
+func shiftAllowedIPs(allowed string, oldNet, newNet *net.IPNet) (string, error) {
+	oldBase := binary.BigEndian.Uint32(oldNet.IP.To4())
+	newBase := binary.BigEndian.Uint32(newNet.IP.To4())
+
+	parts := strings.Split(allowed, ",")
+	for i, part := range parts {
+		entry := strings.TrimSpace(part)
+		parts[i] = entry
+		ipStr := strings.Split(entry, "/")[0]
+		ip := net.ParseIP(ipStr)
+		if ip == nil || ip.To4() == nil || !oldNet.Contains(ip) {
+			continue
+		}
+		offset := binary.BigEndian.Uint32(ip.To4()) - oldBase
+		shifted := make(net.IP, 4)
+		binary.BigEndian.PutUint32(shifted, newBase+offset)
+		if !newNet.Contains(shifted) {
+			return "", fmt.Errorf("host offset %d does not fit in %s", offset, newNet.String())
+		}
+		suffix := ""
+		if idx := strings.Index(entry, "/"); idx >= 0 {
+			suffix = entry[idx:]
+		}
+		parts[i] = shifted.String() + suffix
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+// reallocateSubnet applies an incompatible subnet change by moving every
+// peer to the equivalent host offset in the new pool. DB updates (peer
+// allowed_ips plus the subnet config keys) run in one transaction; client
+// configs and wg0.conf are rewritten alongside it, with the originals kept
+// so a failure restores the files and rolls the transaction back. Live wg
+// updates are best effort - reconcile repairs any that miss.
+func reallocateSubnet(w http.ResponseWriter, r *http.Request, db *sql.DB, oldCIDR, newCIDR, presetName string) {
+	_, oldNet, err := net.ParseCIDR(oldCIDR)
+	if err != nil {
+		http.Error(w, "Current subnet is invalid: "+oldCIDR, http.StatusInternalServerError)
+		return
+	}
+	_, newNet, err := net.ParseCIDR(newCIDR)
+	if err != nil {
+		http.Error(w, "Invalid target CIDR", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	type peerMove struct {
+		id                     int
+		name, pub              string
+		oldAllowed, newAllowed string
+	}
+	var moves []peerMove
+
+	rows, err := tx.Query("SELECT id, name, public_key, allowed_ips FROM peers")
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var m peerMove
+		if rows.Scan(&m.id, &m.name, &m.pub, &m.oldAllowed) != nil {
+			continue
+		}
+		m.newAllowed, err = shiftAllowedIPs(m.oldAllowed, oldNet, newNet)
+		if err != nil {
+			rows.Close()
+			http.Error(w, fmt.Sprintf("Cannot reallocate peer %s: %v", m.name, err), http.StatusConflict)
+			return
+		}
+		if m.newAllowed != m.oldAllowed {
+			moves = append(moves, m)
+		}
+	}
+	rows.Close()
+
+	for _, m := range moves {
+		if _, err := tx.Exec("UPDATE peers SET allowed_ips = ? WHERE id = ?", m.newAllowed, m.id); err != nil {
+			http.Error(w, "Failed to update peer "+m.name, http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('subnet_cidr', ?)", newCIDR); err != nil {
+		http.Error(w, "Failed to save subnet", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('subnet_preset', ?)", presetName); err != nil {
+		http.Error(w, "Failed to save preset", http.StatusInternalServerError)
+		return
+	}
+
+	// File rewrites happen before the commit; originals are kept so any
+	// failure puts both the files and the DB back the way they were
+	written := map[string][]byte{}
+	restoreFiles := func() {
+		for path, original := range written {
+			os.WriteFile(path, original, 0600)
+		}
+	}
+
+	clientsDir := config.Get().ClientsDir
+	addrRe := regexp.MustCompile(`(?i)Address\s*=\s*[^\r\n]+`)
+	for _, m := range moves {
+		path := filepath.Join(clientsDir, m.name+".conf")
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue // no config on disk; it is regenerated from the DB on download
+		}
+		newContent := addrRe.ReplaceAllString(string(content), "Address = "+m.newAllowed)
+		if newContent == string(content) {
+			continue
+		}
+		if err := os.WriteFile(path, []byte(newContent), 0600); err != nil {
+			restoreFiles()
+			http.Error(w, "Failed to rewrite config for "+m.name, http.StatusInternalServerError)
+			return
+		}
+		written[path] = content
+	}
+
+	// Server-side AllowedIPs, under the same cross-process lock as MovePeer
+	wg0Path := config.Get().WGConfigPath
+	lockPath := filepath.Dir(wg0Path) + "/.wg0.lock"
+	if lockFile, lockErr := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600); lockErr == nil {
+		if syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX) == nil {
+			if content, err := os.ReadFile(wg0Path); err == nil {
+				newContent := string(content)
+				for _, m := range moves {
+					newContent = strings.Replace(newContent, "AllowedIPs = "+ServerAllowedIPs(m.oldAllowed), "AllowedIPs = "+ServerAllowedIPs(m.newAllowed), 1)
+				}
+				if newContent != string(content) {
+					if err := os.WriteFile(wg0Path, []byte(newContent), 0600); err != nil {
+						syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+						lockFile.Close()
+						restoreFiles()
+						http.Error(w, "Failed to rewrite "+wg0Path, http.StatusInternalServerError)
+						return
+					}
+					written[wg0Path] = content
+				}
+			}
+			syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		}
+		lockFile.Close()
+	}
+
+	if err := tx.Commit(); err != nil {
+		restoreFiles()
+		http.Error(w, "Failed to commit changes", http.StatusInternalServerError)
+		return
+	}
+
+	for _, m := range moves {
+		if m.pub == "" {
+			continue
+		}
+		if err := runWGSet("set", wgInterface(), "peer", m.pub, "allowed-ips", ServerAllowedIPs(m.newAllowed)); err != nil {
+			slog.Warn("Live wg update failed after reallocation, reconcile will repair", "peer", m.name, "error", err)
+		}
+	}
+
+	WriteAudit(db, r, "SUBNET_REALLOCATE", "system", fmt.Sprintf("Moved %d peers from %s to %s (preset: %s)", len(moves), oldCIDR, newCIDR, presetName))
+	reconcile.Trigger()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "reallocated",
+		"old_cidr":    oldCIDR,
+		"new_cidr":    newCIDR,
+		"peers_moved": len(moves),
+		"note":        "Clients must re-download their configs",
+		"config":      getCurrentSubnetConfig(db),
+	})
+}
+
+// writeSubnetDryRun reports what ConfigureSubnet would do for targetCIDR:
+// the change type, the new capacity, and which peers would land outside the
+// new range
+func writeSubnetDryRun(w http.ResponseWriter, db *sql.DB, targetCIDR string) {
+	var currentCIDR string
+	db.QueryRow("SELECT value FROM system_config WHERE key='subnet_cidr'").Scan(&currentCIDR)
+	if currentCIDR == "" {
+		currentCIDR = "10.100.0.0/24"
+	}
+
+	maxPeers := CalculateMaxPeers(targetCIDR)
+	var peerCount int
+	db.QueryRow("SELECT COUNT(*) FROM peers").Scan(&peerCount)
+
+	changeType := "relocation"
+	switch {
+	case currentCIDR == targetCIDR:
+		changeType = "none"
+	case isCompatibleSubnetChange(currentCIDR, targetCIDR):
+		changeType = "expansion"
+	case isCompatibleSubnetChange(targetCIDR, currentCIDR):
+		changeType = "shrink"
+	}
+
+	// Peers whose first address falls outside the new range would need
+	// reallocation before the change can apply
+	outside := []string{}
+	_, newNet, _ := net.ParseCIDR(targetCIDR)
+	rows, err := db.Query("SELECT name, allowed_ips FROM peers")
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var name, allowed string
+			if rows.Scan(&name, &allowed) != nil {
+				continue
+			}
+			ipStr := strings.Split(strings.TrimSpace(strings.Split(allowed, ",")[0]), "/")[0]
+			if ip := net.ParseIP(ipStr); ip != nil && newNet != nil && !newNet.Contains(ip) {
+				outside = append(outside, name)
+			}
+		}
+	}
+
+	// Mirrors the write path's checks: capacity plus range compatibility
+	wouldApply := peerCount <= maxPeers &&
+		(peerCount == 0 || currentCIDR == targetCIDR || isCompatibleSubnetChange(currentCIDR, targetCIDR))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run":             true,
+		"current_cidr":        currentCIDR,
+		"target_cidr":         targetCIDR,
+		"change_type":         changeType,
+		"max_peers":           maxPeers,
+		"peer_count":          peerCount,
+		"peers_outside_range": outside,
+		"would_apply":         wouldApply,
+	})
+}
+
+// SubnetValidationError names the failed constraint so the UI can highlight
+// the right form field instead of showing a generic message
+type SubnetValidationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"` // not_cidr | not_ipv4 | public_range | prefix_range
+	Message string `json:"message"`
+}
+
+func (e *SubnetValidationError) Error() string { return e.Message }
+
+// writeSubnetError sends the structured validation error as JSON
+func writeSubnetError(w http.ResponseWriter, verr *SubnetValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": verr})
+}
+
+// ValidateSubnet is the single validation path for every subnet-config
+// endpoint; both /network/subnet and ConfigureSubnet go through it
+func ValidateSubnet(cidr string) *SubnetValidationError {
 	ip, ipNet, err := net.ParseCIDR(cidr)
 	if err != nil {
-		return fmt.Errorf("invalid CIDR format: %s", cidr)
+		return &SubnetValidationError{Field: "cidr", Code: "not_cidr", Message: fmt.Sprintf("invalid CIDR format: %s", cidr)}
 	}
 
 	// Must be private IP range
 	ip4 := ip.To4()
 	if ip4 == nil {
-		return fmt.Errorf("IPv4 only supported")
+		return &SubnetValidationError{Field: "cidr", Code: "not_ipv4", Message: "IPv4 only supported"}
 	}
 
 	if !isPrivateIPRange(ip4) {
-		return fmt.Errorf("CIDR must be in private IP range (10.x, 172.16-31.x, 192.168.x)")
+		return &SubnetValidationError{Field: "cidr", Code: "public_range", Message: "CIDR must be in private IP range (10.x, 172.16-31.x, 192.168.x)"}
 	}
 
 	// Validate prefix length
 	ones, _ := ipNet.Mask.Size()
 	if ones < 16 || ones > 30 {
-		return fmt.Errorf("prefix must be between /16 and /30")
+		return &SubnetValidationError{Field: "cidr", Code: "prefix_range", Message: "prefix must be between /16 and /30"}
 	}
 
 	return nil
@@ -569,7 +844,7 @@ func AllocateIP(tx *sql.Tx, requestedIP string) (string, error) {
 		if usedIPs[reqVal] {
 			return "", fmt.Errorf("requested IP %s is already in use", reqIP.String())
 		}
-		return fmt.Sprintf("%s/%d", reqIP.String(), ones), nil
+		return withV6(tx, fmt.Sprintf("%s/%d", reqIP.String(), ones), reqVal-base), nil
 	}
 
 	// Find first free IP: skip network (0) and broadcast. offset 1 is server. 
@@ -579,7 +854,7 @@ func AllocateIP(tx *sql.Tx, requestedIP string) (string, error) {
 		if !usedIPs[target] {
 			targetIP := make(net.IP, 4)
 			binary.BigEndian.PutUint32(targetIP, target)
-			return fmt.Sprintf("%s/%d", targetIP.String(), ones), nil
+			return withV6(tx, fmt.Sprintf("%s/%d", targetIP.String(), ones), offset), nil
 		}
 	}
 
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
+)
+
+// OrphanReport lists filesystem/DB artifacts left behind by dual CLI/API
+// management: configs with no DB peer, sidecar markers whose config is gone,
+// and placeholder peers created by sync from unknown public keys
+type OrphanReport struct {
+	OrphanedConfigs  []string `json:"orphaned_configs"`  // .conf files with no matching peer row
+	OrphanedSidecars []string `json:"orphaned_sidecars"` // .disabled/.limit/.expiry markers with no .conf
+	DiscoveredPeers  []string `json:"discovered_peers"`  // discovered-* rows from failed syncs
+	Total            int      `json:"total"`
+}
+
+var sidecarSuffixes = []string{".conf.disabled", ".conf.limit", ".conf.expiry"}
+
+// findOrphans builds the report shared by the list and cleanup endpoints
+func findOrphans(db *sql.DB) OrphanReport {
+	report := OrphanReport{
+		OrphanedConfigs:  []string{},
+		OrphanedSidecars: []string{},
+		DiscoveredPeers:  []string{},
+	}
+
+	dbPeers := make(map[string]bool)
+	rows, err := db.Query("SELECT name FROM peers")
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if rows.Scan(&name) == nil {
+				dbPeers[name] = true
+				if strings.HasPrefix(name, "discovered-") {
+					report.DiscoveredPeers = append(report.DiscoveredPeers, name)
+				}
+			}
+		}
+	}
+
+	clientDir := config.Get().ClientsDir
+	files, _ := os.ReadDir(clientDir)
+	confFiles := make(map[string]bool)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(f.Name(), ".conf") {
+			confFiles[f.Name()] = true
+			name := strings.TrimSuffix(f.Name(), ".conf")
+			if !dbPeers[name] {
+				report.OrphanedConfigs = append(report.OrphanedConfigs, f.Name())
+			}
+		}
+	}
+
+	// Second pass: sidecar markers whose base .conf no longer exists
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		for _, suffix := range sidecarSuffixes {
+			if strings.HasSuffix(f.Name(), suffix) {
+				base := strings.TrimSuffix(f.Name(), suffix) + ".conf"
+				if !confFiles[base] {
+					report.OrphanedSidecars = append(report.OrphanedSidecars, f.Name())
+				}
+			}
+		}
+	}
+
+	report.Total = len(report.OrphanedConfigs) + len(report.OrphanedSidecars) + len(report.DiscoveredPeers)
+	return report
+}
+
+// ListOrphans returns orphaned artifacts without touching anything.
+// Remediation companion to the /health/sync diagnostic.
+func ListOrphans(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(findOrphans(db))
+	}
+}
+
+// CleanupOrphans archives then removes orphaned files and deletes
+// discovered-* peer rows. Files are moved into a timestamped archive
+// directory rather than deleted so mistakes are recoverable.
+func CleanupOrphans(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := findOrphans(db)
+		clientDir := config.Get().ClientsDir
+
+		archiveDir := filepath.Join(clientDir, "archive", time.Now().Format("20060102-150405"))
+		archived := 0
+		failed := 0
+
+		archive := func(fileName string) {
+			if archived == 0 && failed == 0 {
+				if err := os.MkdirAll(archiveDir, 0700); err != nil {
+					failed++
+					return
+				}
+			}
+			src := filepath.Join(clientDir, fileName)
+			if err := os.Rename(src, filepath.Join(archiveDir, fileName)); err != nil {
+				failed++
+			} else {
+				archived++
+			}
+		}
+
+		for _, f := range report.OrphanedConfigs {
+			archive(f)
+		}
+		for _, f := range report.OrphanedSidecars {
+			archive(f)
+		}
+
+		removedPeers := 0
+		for _, name := range report.DiscoveredPeers {
+			if _, err := db.Exec("DELETE FROM peers WHERE name = ? AND name LIKE 'discovered-%'", name); err == nil {
+				removedPeers++
+			}
+		}
+
+		details := fmt.Sprintf("Archived %d files, removed %d discovered peers", archived, removedPeers)
+		WriteAudit(db, r, "ORPHAN_CLEANUP", archiveDir, details)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":          "cleaned",
+			"archived":        archived,
+			"failed":          failed,
+			"removed_peers":   removedPeers,
+			"archive_dir":     archiveDir,
+			"report":          report,
+		})
+	}
+}
+
+// RepairPeerSync runs the DB/filesystem reconciliation explicitly and reports
+// what changed: peers imported from .conf files the DB didn't know, and
+// config files regenerated for DB peers that had lost theirs. Same logic
+// ListPeers applies as a side effect, exposed as an auditable action so
+// /health/sync findings can be fixed on demand.
+func RepairPeerSync(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientDir := config.Get().ClientsDir
+
+		snapshotDB := func() map[string]string {
+			peers := make(map[string]string)
+			rows, err := db.Query("SELECT public_key, name FROM peers")
+			if err == nil {
+				defer rows.Close()
+				for rows.Next() {
+					var pub, name string
+					if rows.Scan(&pub, &name) == nil {
+						peers[pub] = name
+					}
+				}
+			}
+			return peers
+		}
+		snapshotFiles := func() map[string]bool {
+			confs := make(map[string]bool)
+			files, _ := os.ReadDir(clientDir)
+			for _, f := range files {
+				if !f.IsDir() && strings.HasSuffix(f.Name(), ".conf") {
+					confs[f.Name()] = true
+				}
+			}
+			return confs
+		}
+
+		beforePeers := snapshotDB()
+		beforeConfs := snapshotFiles()
+
+		syncMu.Lock()
+		syncPeersWithFiles(db)
+		lastSyncTime = time.Now()
+		syncMu.Unlock()
+
+		imported := []string{}
+		for pub, name := range snapshotDB() {
+			if _, known := beforePeers[pub]; !known {
+				imported = append(imported, name)
+			}
+		}
+		created := []string{}
+		for conf := range snapshotFiles() {
+			if !beforeConfs[conf] {
+				created = append(created, conf)
+			}
+		}
+
+		if len(imported) > 0 || len(created) > 0 {
+			WriteAudit(db, r, "SYNC_REPAIR", "system",
+				fmt.Sprintf("Imported %d peers from files, regenerated %d configs", len(imported), len(created)))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":             "repaired",
+			"imported_peers":     imported,
+			"regenerated_files":  created,
+			"imported_count":     len(imported),
+			"regenerated_count":  len(created),
+		})
+	}
+}
+
+// DuplicateKeys scans existing peers for any sharing a public key. That
+// should be impossible through the API, but manual DB edits can get there —
+// and two peers on one key silently break routing for both.
+func DuplicateKeys(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`
+			SELECT public_key, GROUP_CONCAT(name) FROM peers
+			WHERE public_key != ''
+			GROUP BY public_key HAVING COUNT(*) > 1
+		`)
+		if err != nil {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		duplicates := []map[string]interface{}{}
+		for rows.Next() {
+			var pub, names string
+			if rows.Scan(&pub, &names) == nil {
+				duplicates = append(duplicates, map[string]interface{}{
+					"public_key": pub,
+					"peers":      strings.Split(names, ","),
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"duplicates": duplicates,
+			"count":      len(duplicates),
+		})
+	}
+}
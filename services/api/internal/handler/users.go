@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
+)
+
+// validRoles is the role matrix: admin (full), operator (write), viewer (read)
+var validRoles = map[string]bool{"admin": true, "operator": true, "viewer": true}
+
+var usernameRe = regexp.MustCompile(`^[a-zA-Z0-9_.@-]{3,64}$`)
+
+// UserInfo is one row in the user administration list
+type UserInfo struct {
+	ID           int    `json:"id"`
+	Username     string `json:"username"`
+	Role         string `json:"role"`
+	Email        string `json:"email,omitempty"`
+	AuthProvider string `json:"auth_provider"`
+	MFAEnabled   bool   `json:"mfa_enabled"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// ListUsers returns all users (admin only, enforced at the route)
+func ListUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`
+			SELECT id, username, role, COALESCE(email, ''),
+			       COALESCE(auth_provider, 'local'), COALESCE(mfa_enabled, 0), created_at
+			FROM users ORDER BY username`)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		users := []UserInfo{}
+		for rows.Next() {
+			var u UserInfo
+			var mfa int
+			if err := rows.Scan(&u.ID, &u.Username, &u.Role, &u.Email, &u.AuthProvider, &mfa, &u.CreatedAt); err != nil {
+				continue
+			}
+			u.MFAEnabled = mfa == 1
+			users = append(users, u)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+	}
+}
+
+// CreateUser provisions a local user with a role
+func CreateUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if !usernameRe.MatchString(req.Username) {
+			http.Error(w, "Invalid username (3-64 chars, alphanumeric plus _.@-)", http.StatusBadRequest)
+			return
+		}
+		if len(req.Password) < 8 {
+			http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = "viewer"
+		}
+		if !validRoles[req.Role] {
+			http.Error(w, "Invalid role (admin, operator or viewer)", http.StatusBadRequest)
+			return
+		}
+
+		hash, err := auth.HashPassword(req.Password)
+		if err != nil {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		res, err := db.Exec("INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)",
+			req.Username, hash, req.Role)
+		if err != nil {
+			http.Error(w, "Username already exists", http.StatusConflict)
+			return
+		}
+		id, _ := res.LastInsertId()
+
+		WriteAudit(db, r, "USER_CREATE", req.Username, "Created user with role "+req.Role)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "created",
+			"id":     id,
+			"role":   req.Role,
+		})
+	}
+}
+
+// DeleteUser removes a user and invalidates their sessions. The last admin
+// can't be deleted, so the instance can never lock itself out.
+func DeleteUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+
+		var username, role string
+		if err := db.QueryRow("SELECT username, role FROM users WHERE id = ?", id).Scan(&username, &role); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		if role == "admin" && countAdmins(db) <= 1 {
+			http.Error(w, "Cannot delete the last admin", http.StatusConflict)
+			return
+		}
+
+		dropUserSessionCache(db, id, "")
+		db.Exec("DELETE FROM users WHERE id = ?", id)
+		auth.InvalidateAllSessions(db, id)
+
+		WriteAudit(db, r, "USER_DELETE", username, "Deleted user (role "+role+"), sessions invalidated")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+	}
+}
+
+// ChangeUserRole updates a user's role; demotions invalidate the user's
+// sessions so stale write access dies immediately
+func ChangeUserRole(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validRoles[req.Role] {
+			http.Error(w, "Invalid role (admin, operator or viewer)", http.StatusBadRequest)
+			return
+		}
+
+		var username, oldRole string
+		if err := db.QueryRow("SELECT username, role FROM users WHERE id = ?", id).Scan(&username, &oldRole); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if oldRole == req.Role {
+			http.Error(w, "User already has this role", http.StatusBadRequest)
+			return
+		}
+		if oldRole == "admin" && countAdmins(db) <= 1 {
+			http.Error(w, "Cannot demote the last admin", http.StatusConflict)
+			return
+		}
+
+		db.Exec("UPDATE users SET role = ? WHERE id = ?", req.Role, id)
+
+		// A demoted user's open sessions still carry the old role from the
+		// Auth lookup, so cut them; promotions just need a fresh login too
+		dropUserSessionCache(db, id, "")
+		auth.InvalidateAllSessions(db, id)
+
+		WriteAudit(db, r, "USER_ROLE_CHANGE", username, "Role changed from "+oldRole+" to "+req.Role+", sessions invalidated")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":   "updated",
+			"old_role": oldRole,
+			"new_role": req.Role,
+		})
+	}
+}
+
+func countAdmins(db *sql.DB) int {
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'admin'").Scan(&n)
+	return n
+}
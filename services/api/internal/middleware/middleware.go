@@ -1,215 +1,392 @@
-package middleware
-
-import (
-	"context"
-	"crypto/rand"
-	"database/sql"
-	"encoding/hex"
-	"log/slog"
-	"net/http"
-	"strings"
-	"time"
-
-	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
-)
-
-// Context keys for user info and request correlation
-type contextKey string
-
-const (
-	UserIDKey    contextKey = "user_id"
-	UserRoleKey  contextKey = "user_role"
-	RequestIDKey contextKey = "request_id"
-)
-
-// GetUserID retrieves user ID from request context
-func GetUserID(r *http.Request) int {
-	if id, ok := r.Context().Value(UserIDKey).(int); ok {
-		return id
-	}
-	return 0
-}
-
-// GetUserRole retrieves user role from request context
-func GetUserRole(r *http.Request) string {
-	if role, ok := r.Context().Value(UserRoleKey).(string); ok {
-		return role
-	}
-	return ""
-}
-
-// GetRequestID retrieves request ID from context
-func GetRequestID(r *http.Request) string {
-	if id, ok := r.Context().Value(RequestIDKey).(string); ok {
-		return id
-	}
-	return ""
-}
-
-// generateRequestID creates a new random request ID
-func generateRequestID() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return hex.EncodeToString(b)
-}
-
-// RequestID middleware injects a unique request ID for distributed tracing
-func RequestID(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if request already has an ID (from upstream proxy/load balancer)
-		id := r.Header.Get("X-Request-ID")
-		if id == "" {
-			id = generateRequestID()
-		}
-		
-		// Add to response headers for client correlation
-		w.Header().Set("X-Request-ID", id)
-		
-		ctx := context.WithValue(r.Context(), RequestIDKey, id)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
-
-// GetClientIP extracts real client IP from request (for logging)
-func getClientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		for i := 0; i < len(xff); i++ {
-			if xff[i] == ',' {
-				return xff[:i]
-			}
-		}
-		return xff
-	}
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
-	}
-	addr := r.RemoteAddr
-	for i := len(addr) - 1; i >= 0; i-- {
-		if addr[i] == ':' {
-			return addr[:i]
-		}
-	}
-	return addr
-}
-
-// Logger middleware with structured logging including User-Agent
-func Logger(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		
-		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		next.ServeHTTP(rw, r)
-		
-		duration := time.Since(start)
-		
-		slog.Info("request",
-			"request_id", GetRequestID(r),
-			"method", r.Method,
-			"path", r.URL.Path,
-			"status", rw.statusCode,
-			"duration_ms", duration.Milliseconds(),
-			"ip", getClientIP(r),
-			"user_agent", r.Header.Get("User-Agent"),
-			"user_id", GetUserID(r),
-		)
-	})
-}
-
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
-
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
-}
-
-// Auth middleware validates session and propagates user context
-func Auth(db *sql.DB, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var token string
-		cookie, err := r.Cookie("samnet_session")
-		if err == nil {
-			token = cookie.Value
-		} else {
-			authHeader := r.Header.Get("Authorization")
-			if strings.HasPrefix(authHeader, "Bearer ") {
-				token = strings.TrimPrefix(authHeader, "Bearer ")
-			}
-		}
-
-		if token == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		tokenHash := auth.HashToken(token)
-
-		var userID int
-		var role string
-		err = db.QueryRow(`
-			SELECT s.user_id, u.role 
-			FROM sessions s 
-			JOIN users u ON s.user_id = u.id 
-			WHERE s.token_hash = ? AND s.expires_at > CURRENT_TIMESTAMP`,
-			tokenHash).Scan(&userID, &role)
-		if err != nil {
-			http.Error(w, "Unauthorized (Invalid/Expired)", http.StatusUnauthorized)
-			return
-		}
-
-
-
-		ctx := context.WithValue(r.Context(), UserIDKey, userID)
-		ctx = context.WithValue(ctx, UserRoleKey, role)
-
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
-
-// RequireAdmin middleware ensures user has admin role
-func RequireAdmin(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		role := GetUserRole(r)
-		if role != "admin" {
-			http.Error(w, "Forbidden (Admin Required)", http.StatusForbidden)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
-// SecurityHeaders adds security headers to all responses
-func SecurityHeaders(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "DENY")
-		w.Header().Set("X-XSS-Protection", "1; mode=block")
-		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
-		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'")
-		next.ServeHTTP(w, r)
-	})
-}
-
-// LocalhostOnly middleware restricts access to localhost (127.0.0.1) only
-// This is used for the internal CLI API that bypasses authentication.
-// It strictly checks RemoteAddr to prevent X-Forwarded-For spoofing.
-func LocalhostOnly(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		host := r.RemoteAddr
-		// Strip port if present
-		if i := strings.LastIndex(host, ":"); i != -1 {
-			host = host[:i]
-		}
-		
-		// Allow localhost access (IPv4 and IPv6)
-		if host == "127.0.0.1" || host == "::1" || host == "localhost" {
-			next.ServeHTTP(w, r)
-			return
-		}
-		
-		slog.Warn("Internal API access denied (Spoof Attempt?)", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
-		http.Error(w, "Forbidden - localhost only", http.StatusForbidden)
-	})
-}
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
+	dbcache "github.com/SamNet-dev/wg-orchestrator/services/api/internal/db"
+)
+
+// Context keys for user info and request correlation
+type contextKey string
+
+const (
+	UserIDKey    contextKey = "user_id"
+	UserRoleKey  contextKey = "user_role"
+	RequestIDKey contextKey = "request_id"
+)
+
+// GetUserID retrieves user ID from request context
+func GetUserID(r *http.Request) int {
+	if id, ok := r.Context().Value(UserIDKey).(int); ok {
+		return id
+	}
+	return 0
+}
+
+// GetUserRole retrieves user role from request context
+func GetUserRole(r *http.Request) string {
+	if role, ok := r.Context().Value(UserRoleKey).(string); ok {
+		return role
+	}
+	return ""
+}
+
+// GetRequestID retrieves request ID from context
+func GetRequestID(r *http.Request) string {
+	if id, ok := r.Context().Value(RequestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// generateRequestID creates a new random request ID
+func generateRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestID middleware injects a unique request ID for distributed tracing
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Check if request already has an ID (from upstream proxy/load balancer)
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = generateRequestID()
+		}
+		
+		// Add to response headers for client correlation
+		w.Header().Set("X-Request-ID", id)
+		
+		ctx := context.WithValue(r.Context(), RequestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Recover catches handler panics so one bad request (e.g. a nil pointer in a
+// config-generation path) can't take down the API for everyone; net/http's
+// default recovery just drops the connection with no useful log. Sits just
+// inside RequestID so the stack trace and the 500 body carry the same ID the
+// client saw.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				id := GetRequestID(r)
+				slog.Error("Handler panic recovered",
+					"request_id", id,
+					"method", r.Method,
+					"path", r.URL.Path,
+					"panic", rec,
+					"stack", string(debug.Stack()),
+				)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, `{"error": "Internal Server Error", "request_id": %q}`, id)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Timeout bounds one route's handler: the request context is canceled after
+// d (aborting context-aware DB queries with it) and the client gets a 503,
+// instead of a slow endpoint holding its connection for the server's whole
+// WriteTimeout. d <= 0 disables the deadline for deliberately long routes
+// like backup and export.
+func Timeout(d time.Duration, next http.Handler) http.Handler {
+	if d <= 0 {
+		return next
+	}
+	return http.TimeoutHandler(next, d, `{"error": "Request timed out"}`)
+}
+
+// GetClientIP extracts real client IP from request (for logging)
+func getClientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		for i := 0; i < len(xff); i++ {
+			if xff[i] == ',' {
+				return xff[:i]
+			}
+		}
+		return xff
+	}
+	if xri := r.Header.Get("X-Real-IP"); xri != "" {
+		return xri
+	}
+	addr := r.RemoteAddr
+	for i := len(addr) - 1; i >= 0; i-- {
+		if addr[i] == ':' {
+			return addr[:i]
+		}
+	}
+	return addr
+}
+
+// Logger middleware with structured logging including User-Agent
+func Logger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		
+		duration := time.Since(start)
+		
+		slog.Info("request",
+			"request_id", GetRequestID(r),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rw.statusCode,
+			"duration_ms", duration.Milliseconds(),
+			"ip", getClientIP(r),
+			"user_agent", r.Header.Get("User-Agent"),
+			"user_id", GetUserID(r),
+		)
+	})
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Sliding session expiry: a request inside the final fraction of a session's
+// lifetime pushes expires_at forward, so active users aren't logged out
+// mid-task. The DB write only happens near expiry, never on every request.
+const sessionLifetime = 12 * time.Hour // matches auth.CreateSession
+
+// sessionRefreshFraction is how much of the lifetime may remain before a
+// refresh triggers, via SESSION_REFRESH_PERCENT (default 25)
+func sessionRefreshFraction() float64 {
+	if v := os.Getenv("SESSION_REFRESH_PERCENT"); v != "" {
+		if pct, err := strconv.Atoi(v); err == nil && pct > 0 && pct < 100 {
+			return float64(pct) / 100
+		}
+	}
+	return 0.25
+}
+
+// sessionMaxLifetime caps how long a session can slide past its creation,
+// via SESSION_MAX_LIFETIME_HOURS (default 72)
+func sessionMaxLifetime() time.Duration {
+	if v := os.Getenv("SESSION_MAX_LIFETIME_HOURS"); v != "" {
+		if hours, err := strconv.Atoi(v); err == nil && hours > 0 {
+			return time.Duration(hours) * time.Hour
+		}
+	}
+	return 72 * time.Hour
+}
+
+// redisCache, when registered, backs session lookups and the distributed
+// rate limiter so multiple API instances behind a load balancer share state
+var redisCache *dbcache.RedisCache
+
+// SetRedisCache registers the optional Redis connection
+func SetRedisCache(c *dbcache.RedisCache) {
+	redisCache = c
+}
+
+// CacheSession stores a session in the Redis cache (no-op without Redis);
+// login calls it so the first request after login already hits the cache
+func CacheSession(tokenHash string, userID int, role string, expiresAt time.Time) {
+	if redisCache == nil {
+		return
+	}
+	redisCache.SetSession(tokenHash, dbcache.CachedSession{UserID: userID, Role: role, ExpiresAt: expiresAt})
+}
+
+// DropCachedSession evicts one session from the cache on logout or revocation
+func DropCachedSession(tokenHash string) {
+	if redisCache == nil {
+		return
+	}
+	redisCache.DeleteSession(tokenHash)
+}
+
+// Auth middleware validates session and propagates user context
+func Auth(db *sql.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		fromCookie := false
+		cookie, err := r.Cookie("samnet_session")
+		if err == nil {
+			token = cookie.Value
+			fromCookie = true
+		} else {
+			authHeader := r.Header.Get("Authorization")
+			if strings.HasPrefix(authHeader, "Bearer ") {
+				token = strings.TrimPrefix(authHeader, "Bearer ")
+			}
+		}
+
+		if token == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		tokenHash := auth.HashToken(token)
+
+		var userID int
+		var role string
+
+		// Redis first: entries still outside the refresh window skip SQLite
+		// entirely; near-expiry ones fall through so sliding refresh happens
+		cacheHit := false
+		if redisCache != nil {
+			if cached, err := redisCache.GetSession(tokenHash); err == nil && cached != nil {
+				remaining := time.Until(cached.ExpiresAt).Seconds()
+				if remaining > 0 && remaining >= sessionLifetime.Seconds()*sessionRefreshFraction() {
+					userID = cached.UserID
+					role = cached.Role
+					cacheHit = true
+				}
+			}
+		}
+
+		if !cacheHit {
+			var sessionID int
+			var expiresUnix, createdUnix int64
+			// strftime handles both datetime formats the codebase stores
+			// (RFC3339 from the driver, 'YYYY-MM-DD HH:MM:SS' from datetime('now'))
+			err = db.QueryRow(`
+				SELECT s.user_id, u.role, s.id,
+				       CAST(strftime('%s', s.expires_at) AS INTEGER),
+				       CAST(strftime('%s', s.created_at) AS INTEGER)
+				FROM sessions s
+				JOIN users u ON s.user_id = u.id
+				WHERE s.token_hash = ? AND s.expires_at > CURRENT_TIMESTAMP`,
+				tokenHash).Scan(&userID, &role, &sessionID, &expiresUnix, &createdUnix)
+			if err != nil {
+				http.Error(w, "Unauthorized (Invalid/Expired)", http.StatusUnauthorized)
+				return
+			}
+
+			// Refresh when inside the sliding window, capped at the absolute
+			// lifetime so a session can't live forever
+			now := time.Now().Unix()
+			if remaining := expiresUnix - now; remaining > 0 && float64(remaining) < sessionLifetime.Seconds()*sessionRefreshFraction() {
+				newExpiry := now + int64(sessionLifetime.Seconds())
+				if cap := createdUnix + int64(sessionMaxLifetime().Seconds()); newExpiry > cap {
+					newExpiry = cap
+				}
+				if newExpiry > expiresUnix {
+					db.Exec("UPDATE sessions SET expires_at = datetime(?, 'unixepoch') WHERE id = ?", newExpiry, sessionID)
+					expiresUnix = newExpiry
+					if fromCookie {
+						isSecure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" || os.Getenv("INSECURE_HTTP") != "true"
+						http.SetCookie(w, &http.Cookie{
+							Name:     "samnet_session",
+							Value:    token,
+							HttpOnly: true,
+							Path:     "/",
+							SameSite: http.SameSiteLaxMode,
+							Secure:   isSecure,
+							MaxAge:   int(newExpiry - now),
+						})
+					}
+				}
+			}
+
+			// Populate the cache so the next request is served from Redis
+			CacheSession(tokenHash, userID, role, time.Unix(expiresUnix, 0))
+		}
+
+		ctx := context.WithValue(r.Context(), UserIDKey, userID)
+		ctx = context.WithValue(ctx, UserRoleKey, role)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireRole allows the request through only when the user holds one of the
+// listed roles. Denials get a 403 naming the required roles and an
+// AUTHZ_DENIED audit row recording who tried what, so role-matrix violations
+// are visible in the audit log.
+func RequireRole(db *sql.DB, next http.Handler, roles ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := GetUserRole(r)
+		for _, allowed := range roles {
+			if role == allowed {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if db != nil {
+			db.Exec("INSERT INTO audit_logs (user_id, action, target, details, ip_address, request_id) VALUES (?, 'AUTHZ_DENIED', ?, ?, '', ?)",
+				GetUserID(r), r.URL.Path,
+				fmt.Sprintf("Role %q attempted %s (requires %s)", role, r.Method, strings.Join(roles, " or ")),
+				GetRequestID(r))
+		}
+		http.Error(w, "Forbidden: requires role "+strings.Join(roles, " or "), http.StatusForbidden)
+	})
+}
+
+// RequireOperator gates mutating routes: admin and operator can write,
+// viewer stays read-only
+func RequireOperator(db *sql.DB, next http.Handler) http.Handler {
+	return RequireRole(db, next, "admin", "operator")
+}
+
+// RequireAdmin middleware ensures user has admin role
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := GetUserRole(r)
+		if role != "admin" {
+			http.Error(w, "Forbidden (Admin Required)", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SecurityHeaders adds security headers to all responses
+func SecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-XSS-Protection", "1; mode=block")
+		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LocalhostOnly middleware restricts access to localhost (127.0.0.1) only
+// This is used for the internal CLI API that bypasses authentication.
+// It strictly checks RemoteAddr to prevent X-Forwarded-For spoofing.
+func LocalhostOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.RemoteAddr
+		// Strip port if present
+		if i := strings.LastIndex(host, ":"); i != -1 {
+			host = host[:i]
+		}
+		
+		// Allow localhost access (IPv4 and IPv6)
+		if host == "127.0.0.1" || host == "::1" || host == "localhost" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		
+		slog.Warn("Internal API access denied (Spoof Attempt?)", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+		http.Error(w, "Forbidden - localhost only", http.StatusForbidden)
+	})
+}
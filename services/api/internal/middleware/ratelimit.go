@@ -7,6 +7,8 @@ import (
 	"encoding/base64"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +18,9 @@ const (
 	csrfCookieName = "csrf_token"
 	csrfHeaderName = "X-CSRF-Token"
 	csrfTokenLen   = 32
+	// CSRFCookieMaxAge matches the session lifetime (12h) so a live session
+	// never outlasts its CSRF token
+	CSRFCookieMaxAge = 43200
 )
 
 // CSRFToken generates a new CSRF token
@@ -27,6 +32,50 @@ func generateCSRFToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
+// allowedOrigins is the extra Origin allow-list (comma-separated hosts) for
+// deployments where the UI is served from a different host than the API
+var allowedOrigins = parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS"))
+
+func parseAllowedOrigins(raw string) map[string]bool {
+	origins := make(map[string]bool)
+	for _, o := range strings.Split(raw, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		// Accept both bare hosts and full origins
+		if u, err := url.Parse(o); err == nil && u.Host != "" {
+			origins[u.Host] = true
+		} else {
+			origins[o] = true
+		}
+	}
+	return origins
+}
+
+// validOriginHost checks a browser-supplied Origin/Referer against the request
+// host and the configured allow-list
+func validOriginHost(r *http.Request, raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Host == r.Host || allowedOrigins[u.Host]
+}
+
+// checkOrigin is a second CSRF layer on top of double-submit: state-changing
+// browser requests must come from our own origin. Requests without either
+// header (curl, CLI) are allowed through - the token check still applies.
+func checkOrigin(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return validOriginHost(r, origin)
+	}
+	if referer := r.Header.Get("Referer"); referer != "" {
+		return validOriginHost(r, referer)
+	}
+	return true
+}
+
 // CSRF middleware implements double-submit cookie pattern
 func CSRF(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -37,6 +86,13 @@ func CSRF(next http.Handler) http.Handler {
 			return
 		}
 
+		// Origin/Referer must match our host (defends double-submit bypasses
+		// where an attacker can plant cookies from a subdomain)
+		if !checkOrigin(r) {
+			http.Error(w, "CSRF origin mismatch", http.StatusForbidden)
+			return
+		}
+
 		// For state-changing methods (POST/PUT/DELETE), validate token
 		cookie, err := r.Cookie(csrfCookieName)
 		if err != nil {
@@ -67,19 +123,32 @@ func CSRF(next http.Handler) http.Handler {
 
 func ensureCSRFCookie(w http.ResponseWriter, r *http.Request) {
 	if _, err := r.Cookie(csrfCookieName); err != nil {
-		token, _ := generateCSRFToken()
-		http.SetCookie(w, &http.Cookie{
-			Name:     csrfCookieName,
-			Value:    token,
-			Path:     "/",
-			HttpOnly: false, // Must be readable by JS
-			Secure:   r.TLS != nil,
-			SameSite: http.SameSiteStrictMode,
-			MaxAge:   86400, // 24 hours
-		})
+		setCSRFCookie(w, r)
 	}
 }
 
+func setCSRFCookie(w http.ResponseWriter, r *http.Request) string {
+	token, _ := generateCSRFToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: false, // Must be readable by JS
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   CSRFCookieMaxAge,
+	})
+	return token
+}
+
+// RefreshCSRF issues a fresh CSRF token on demand so long-lived SPA sessions
+// can recover after the cookie expires without a full re-login
+func RefreshCSRF(w http.ResponseWriter, r *http.Request) {
+	token := setCSRFCookie(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"csrf_token": "` + token + `"}`))
+}
+
 // Rate limiter with bounded memory and LRU eviction
 type boundedVisitor struct {
 	lastSeen time.Time
@@ -154,14 +223,50 @@ func (rl *BoundedRateLimiter) evictOldest() {
 	}
 }
 
-// Trusted proxy CIDRs - only trust X-Forwarded-For from these
-var trustedProxies = []string{
+// Trusted proxy CIDRs - only trust X-Forwarded-For from these.
+// Overridable via TRUSTED_PROXIES (comma-separated CIDRs or plain IPs) so
+// deployments on shared subnets can narrow this to just their load balancer.
+var trustedProxies = loadTrustedProxies()
+
+var defaultTrustedProxies = []string{
 	"10.0.0.0/8",
 	"172.16.0.0/12",
 	"192.168.0.0/16",
 	"127.0.0.0/8",
 }
 
+func loadTrustedProxies() []string {
+	raw := os.Getenv("TRUSTED_PROXIES")
+	if raw == "" {
+		return defaultTrustedProxies
+	}
+	var cidrs []string
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		// Accept bare IPs as host routes
+		if !strings.Contains(part, "/") {
+			if ip := net.ParseIP(part); ip != nil {
+				if ip.To4() != nil {
+					part += "/32"
+				} else {
+					part += "/128"
+				}
+			}
+		}
+		if _, _, err := net.ParseCIDR(part); err == nil {
+			cidrs = append(cidrs, part)
+		}
+	}
+	if len(cidrs) == 0 {
+		// Misconfigured value: fall back rather than trusting nothing silently
+		return defaultTrustedProxies
+	}
+	return cidrs
+}
+
 func isPrivateIP(ipStr string) bool {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
@@ -217,11 +322,97 @@ func StopGlobalLimiter() {
 	globalLimiter.Stop()
 }
 
+// VisitorState is a point-in-time view of one tracked IP for the admin API
+type VisitorState struct {
+	IP       string    `json:"ip"`
+	Count    int       `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+	Limited  bool      `json:"limited"`
+}
+
+// snapshot returns the current visitor map without mutating limiter state
+func (rl *BoundedRateLimiter) snapshot() []VisitorState {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	states := make([]VisitorState, 0, len(rl.visitors))
+	for ip, v := range rl.visitors {
+		states = append(states, VisitorState{
+			IP:       ip,
+			Count:    v.count,
+			LastSeen: v.lastSeen,
+			Limited:  v.count >= rl.limit && time.Since(v.lastSeen) <= rl.window,
+		})
+	}
+	return states
+}
+
+// clearIP removes a single IP's counter, returning whether it was tracked
+func (rl *BoundedRateLimiter) clearIP(ip string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if _, ok := rl.visitors[ip]; !ok {
+		return false
+	}
+	delete(rl.visitors, ip)
+	for i, tracked := range rl.order {
+		if tracked == ip {
+			rl.order = append(rl.order[:i], rl.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// RateLimiterState returns visitor state for both the global and login limiters
+func RateLimiterState() map[string]interface{} {
+	return map[string]interface{}{
+		"global": globalLimiter.snapshot(),
+		"login":  loginLimiter.snapshot(),
+	}
+}
+
+// ClearRateLimitIP clears an IP from both limiters (operational escape hatch)
+func ClearRateLimitIP(ip string) bool {
+	cleared := globalLimiter.clearIP(ip)
+	if loginLimiter.clearIP(ip) {
+		cleared = true
+	}
+	return cleared
+}
+
+// redisRateLimit tries the distributed limiter when Redis is configured.
+// handled is false (fall back to the in-memory path) when Redis is absent or
+// errors, so a Redis outage degrades to per-instance limiting instead of
+// failing open or closed. The key combines the limiter name and client IP so
+// the global and login windows stay independent.
+func redisRateLimit(name, ip string, window time.Duration, limit int) (allowed, handled bool) {
+	if redisCache == nil {
+		return false, false
+	}
+	ok, err := redisCache.IncrementRateLimit(name+":"+ip, window, limit)
+	if err != nil {
+		return false, false
+	}
+	return ok, true
+}
+
 // RateLimitMiddleware applies rate limiting to http.Handler
 func RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip := GetClientIP(r)
 
+		if allowed, handled := redisRateLimit("global", ip, globalLimiter.window, globalLimiter.limit); handled {
+			if !allowed {
+				w.Header().Set("Retry-After", "60")
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		globalLimiter.mu.Lock()
 
 		v, exists := globalLimiter.visitors[ip]
@@ -259,6 +450,16 @@ func LoginRateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip := GetClientIP(r)
 
+		if allowed, handled := redisRateLimit("login", ip, loginLimiter.window, loginLimiter.limit); handled {
+			if !allowed {
+				w.Header().Set("Retry-After", "300")
+				http.Error(w, "Too many login attempts from this network. Try again in 5 minutes.", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		loginLimiter.mu.Lock()
 		v, exists := loginLimiter.visitors[ip]
 		if !exists {
@@ -295,6 +496,16 @@ func RateLimit(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ip := GetClientIP(r)
 
+		if allowed, handled := redisRateLimit("global", ip, globalLimiter.window, globalLimiter.limit); handled {
+			if !allowed {
+				w.Header().Set("Retry-After", "60")
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			next(w, r)
+			return
+		}
+
 		globalLimiter.mu.Lock()
 
 		v, exists := globalLimiter.visitors[ip]
@@ -1,45 +1,91 @@
-package reconcile
-
-import (
-	"log/slog"
-	"os"
-	"path/filepath"
-	"syscall"
-	"time"
-
-	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
-)
-
-// Trigger updates the timestamp of the trigger file to signal systemd.
-// Uses file locking to prevent race conditions with concurrent requests.
-func Trigger() {
-	triggerFile := config.Get().TriggerFile
-	dir := filepath.Dir(triggerFile)
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		slog.Error("Failed to create trigger directory", "error", err)
-		return
-	}
-
-	// Open with secure permissions (0600, not world-writable)
-	file, err := os.OpenFile(triggerFile, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		slog.Error("Failed to open reconcile trigger", "error", err)
-		return
-	}
-	defer file.Close()
-
-	// Acquire exclusive lock (blocks if another process holds lock)
-	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
-		slog.Error("Failed to acquire file lock", "error", err)
-		return
-	}
-	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
-
-	now := time.Now()
-	if err := os.Chtimes(triggerFile, now, now); err != nil {
-		slog.Error("Failed to update trigger timestamp", "error", err)
-	} else {
-		slog.Info("Reconciliation triggered")
-	}
-}
-
+package reconcile
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
+)
+
+// Debounce window: rapid triggers inside it coalesce into one trailing touch
+// so bulk peer operations don't thrash the external reconcile consumer.
+// Overridable via RECONCILE_DEBOUNCE (Go duration, e.g. "500ms").
+var debounceWindow = loadDebounceWindow()
+
+func loadDebounceWindow() time.Duration {
+	if v := os.Getenv("RECONCILE_DEBOUNCE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return 2 * time.Second
+}
+
+var (
+	debounceMu   sync.Mutex
+	lastTrigger  time.Time
+	pendingTouch bool
+)
+
+// Trigger signals systemd that a reconcile is needed. Triggers arriving
+// within the debounce window of the last one are coalesced: the first
+// schedules a single trailing touch and the rest are dropped, so a burst of
+// changes produces exactly two signals (leading + trailing) at most.
+func Trigger() {
+	debounceMu.Lock()
+	elapsed := time.Since(lastTrigger)
+	if elapsed < debounceWindow {
+		if !pendingTouch {
+			pendingTouch = true
+			time.AfterFunc(debounceWindow-elapsed, func() {
+				debounceMu.Lock()
+				pendingTouch = false
+				lastTrigger = time.Now()
+				debounceMu.Unlock()
+				touchTriggerFile()
+			})
+		}
+		debounceMu.Unlock()
+		return
+	}
+	lastTrigger = time.Now()
+	debounceMu.Unlock()
+	touchTriggerFile()
+}
+
+// touchTriggerFile updates the timestamp of the trigger file to signal systemd.
+// Uses file locking to prevent race conditions with concurrent requests.
+func touchTriggerFile() {
+	triggerFile := config.Get().TriggerFile
+	dir := filepath.Dir(triggerFile)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		slog.Error("Failed to create trigger directory", "error", err)
+		return
+	}
+
+	// Open with secure permissions (0600, not world-writable)
+	file, err := os.OpenFile(triggerFile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		slog.Error("Failed to open reconcile trigger", "error", err)
+		return
+	}
+	defer file.Close()
+
+	// Acquire exclusive lock (blocks if another process holds lock)
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		slog.Error("Failed to acquire file lock", "error", err)
+		return
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	now := time.Now()
+	if err := os.Chtimes(triggerFile, now, now); err != nil {
+		slog.Error("Failed to update trigger timestamp", "error", err)
+	} else {
+		slog.Info("Reconciliation triggered")
+	}
+}
@@ -0,0 +1,158 @@
+// Package wgconf models wg0.conf as an [Interface] head plus a list of
+// [Peer] blocks, so the handlers and workers that add, remove or relabel
+// peers all go through one parser instead of their own line scanning.
+package wgconf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Peer is a single [Peer] block. Lines holds the block body verbatim
+// (comments included) so Render reproduces what the CLI wrote.
+type Peer struct {
+	Lines []string
+}
+
+// value returns the trimmed value of a "Key = value" line, "" when absent
+func (p *Peer) value(key string) string {
+	for _, line := range p.Lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(trimmed, "=")
+		if ok && strings.TrimSpace(k) == key {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// PublicKey returns the block's PublicKey value
+func (p *Peer) PublicKey() string {
+	return p.value("PublicKey")
+}
+
+// hasComment reports whether the block carries a "# name" label line
+func (p *Peer) hasComment(name string) bool {
+	for _, line := range p.Lines {
+		if strings.TrimSpace(line) == "# "+name {
+			return true
+		}
+	}
+	return false
+}
+
+// Config is a parsed wg0.conf. The [Interface] section (and anything else
+// before the first peer) is kept verbatim and never touched by peer edits.
+type Config struct {
+	head  []string
+	Peers []*Peer
+}
+
+// Parse splits a wg0.conf into the interface head and its [Peer] blocks.
+// Empty input is valid and yields a config with no peers.
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+	var current *Peer
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "[Peer]" {
+			current = &Peer{}
+			cfg.Peers = append(cfg.Peers, current)
+			continue
+		}
+		if current != nil {
+			current.Lines = append(current.Lines, line)
+		} else {
+			cfg.head = append(cfg.head, line)
+		}
+	}
+	return cfg, nil
+}
+
+// AddPeer appends a new block labeled with the peer name
+func (c *Config) AddPeer(name, publicKey, allowedIPs string) {
+	c.Peers = append(c.Peers, &Peer{Lines: []string{
+		"# " + name,
+		"PublicKey = " + publicKey,
+		"AllowedIPs = " + allowedIPs,
+	}})
+}
+
+// RemovePeerByPublicKey drops the block carrying the given key, reporting
+// whether anything was removed
+func (c *Config) RemovePeerByPublicKey(pub string) bool {
+	if pub == "" {
+		return false
+	}
+	return c.removePeers(func(p *Peer) bool { return p.PublicKey() == pub })
+}
+
+// RemovePeerByComment drops blocks labeled "# name", for peers whose key is
+// unknown or missing from the DB
+func (c *Config) RemovePeerByComment(name string) bool {
+	if name == "" {
+		return false
+	}
+	return c.removePeers(func(p *Peer) bool { return p.hasComment(name) })
+}
+
+func (c *Config) removePeers(match func(*Peer) bool) bool {
+	kept := c.Peers[:0]
+	removed := false
+	for _, p := range c.Peers {
+		if match(p) {
+			removed = true
+			continue
+		}
+		kept = append(kept, p)
+	}
+	c.Peers = kept
+	return removed
+}
+
+// RenamePeerComment rewrites the "# oldName" label to "# newName" on the
+// first block carrying it
+func (c *Config) RenamePeerComment(oldName, newName string) bool {
+	for _, p := range c.Peers {
+		for i, line := range p.Lines {
+			if strings.TrimSpace(line) == "# "+oldName {
+				p.Lines[i] = "# " + newName
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Render writes the config back out: interface head verbatim, then each peer
+// block separated by a single blank line
+func (c *Config) Render() []byte {
+	var b strings.Builder
+	for _, line := range trimTrailingBlank(c.head) {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	for _, p := range c.Peers {
+		b.WriteString("\n[Peer]\n")
+		for _, line := range trimTrailingBlank(p.Lines) {
+			b.WriteString(line)
+			b.WriteString("\n")
+		}
+	}
+	return []byte(b.String())
+}
+
+// String implements fmt.Stringer for logging
+func (c *Config) String() string {
+	return fmt.Sprintf("wgconf.Config{peers: %d}", len(c.Peers))
+}
+
+func trimTrailingBlank(lines []string) []string {
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	return lines[:end]
+}
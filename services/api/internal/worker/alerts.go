@@ -1,21 +1,91 @@
 package worker
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
+	"log/slog"
 	"os/exec"
 	"strings"
 	"strconv"
 	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/handler"
 )
 
-func AlertsWorker(db *sql.DB) {
+func AlertsWorker(ctx context.Context, db *sql.DB) {
 	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
 	go checkAlerts(db)
 
-	for range ticker.C {
-		checkAlerts(db)
+	for {
+		select {
+		case <-ticker.C:
+			checkAlerts(db)
+			checkSubnetCapacity(db)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// subnetAlertNotified is the highest capacity threshold already notified;
+// reset once usage drops below the warning level so the next crossing fires
+// again instead of re-alerting every tick
+var subnetAlertNotified int
+
+// checkSubnetCapacity proactively pushes the same 80%/95% capacity warnings
+// that GET /system/alerts computes on demand, to the channel configured in
+// system_config (alert_channel + alert_webhook_url)
+func checkSubnetCapacity(db *sql.DB) {
+	var channel, webhookURL string
+	db.QueryRow("SELECT value FROM system_config WHERE key='alert_channel'").Scan(&channel)
+	db.QueryRow("SELECT value FROM system_config WHERE key='alert_webhook_url'").Scan(&webhookURL)
+	if webhookURL == "" {
+		return
+	}
+	if channel == "" {
+		channel = "discord"
+	}
+
+	var subnetCIDR string
+	db.QueryRow("SELECT value FROM system_config WHERE key='subnet_cidr'").Scan(&subnetCIDR)
+	if subnetCIDR == "" {
+		subnetCIDR = "10.100.0.0/24"
+	}
+	var peerCount int
+	db.QueryRow("SELECT COUNT(*) FROM peers").Scan(&peerCount)
+	maxPeers := handler.CalculateMaxPeersDual(db, subnetCIDR)
+	if maxPeers <= 0 {
+		return
+	}
+	usagePercent := peerCount * 100 / maxPeers
+
+	threshold := 0
+	switch {
+	case usagePercent >= 95:
+		threshold = 95
+	case usagePercent >= 80:
+		threshold = 80
+	}
+
+	if threshold == 0 {
+		subnetAlertNotified = 0
+		return
+	}
+	if threshold <= subnetAlertNotified {
+		return // already notified at this level
+	}
+	subnetAlertNotified = threshold
+
+	message := fmt.Sprintf("Subnet %s at %d%% capacity (%d/%d peers)", subnetCIDR, usagePercent, peerCount, maxPeers)
+	if err := QueueNotification(db, channel, webhookURL, message); err != nil {
+		slog.Warn("Failed to queue subnet capacity alert", "error", err)
+		return
 	}
+	handler.WriteAudit(db, nil, "SUBNET_CAPACITY_ALERT", subnetCIDR, message)
+	slog.Warn("Subnet capacity alert sent", "usage_percent", usagePercent, "threshold", threshold)
 }
 
 func checkAlerts(db *sql.DB) {
@@ -25,7 +95,7 @@ func checkAlerts(db *sql.DB) {
 		return
 	}
 
-	out, err := exec.Command("wg", "show", "wg0", "dump").Output()
+	out, err := exec.Command("wg", "show", wgInterface(), "dump").Output()
 	if err != nil {
 		return
 	}
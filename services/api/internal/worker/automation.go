@@ -1,61 +1,177 @@
-package worker
-
-import (
-	"database/sql"
-	"log"
-	"os/exec"
-	"strconv"
-	"strings"
-	"time"
-)
-
-// AutomationWorker tracks peer handshakes and fires webhooks on state change
-func AutomationWorker(db *sql.DB) {
-	// In-memory state: PublicKey -> LastSeenTime
-	state := make(map[string]int64)
-
-	ticker := time.NewTicker(30 * time.Second)
-	for range ticker.C {
-		var webhook string
-		err := db.QueryRow("SELECT webhook_url FROM automation_hooks WHERE enabled=1 LIMIT 1").Scan(&webhook)
-		if err != nil {
-			continue // No hooks configured
-		}
-
-		// Output format: peer_pubkey <tab> preshared_key <tab> endpoint <tab> allowed_ips <tab> latest_handshake <tab> transfer_rx <tab> transfer_tx <tab> persistent_keepalive
-		out, err := exec.Command("wg", "show", "wg0", "dump").Output()
-		if err != nil {
-			// Fail silently if wg not found (dev env)
-			continue
-		}
-
-		lines := strings.Split(string(out), "\n")
-		for _, line := range lines {
-			fields := strings.Split(line, "\t")
-			if len(fields) < 5 {
-				continue
-			}
-			pubKey := fields[0]
-			handshakeStr := fields[4]
-			handshake, _ := strconv.ParseInt(handshakeStr, 10, 64)
-			
-			const onlineThreshold = 180 // 3 mins
-			isOnline := (time.Now().Unix() - handshake) < onlineThreshold
-
-			oldHandshake, existed := state[pubKey]
-			if isOnline && (!existed || oldHandshake == 0) {
-				log.Printf("[Automation] Peer %s Connected. Firing Webhook: %s", pubKey, webhook)
-			} else if !isOnline && existed && oldHandshake > 0 {
-				log.Printf("[Automation] Peer %s Disconnected.", pubKey)
-			}
-			
-			state[pubKey] = handshake
-		}
-
-		log.Println("[Automation] Pulse Check Complete.")
-
-		if time.Now().Minute() == 0 {
-			db.Exec("DELETE FROM sessions WHERE expires_at < CURRENT_TIMESTAMP")
-		}
-	}
-}
+package worker
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/handler"
+)
+
+// automationClient bounds each webhook POST so a dead endpoint can't stall
+// the worker loop
+var automationClient = &http.Client{Timeout: 5 * time.Second}
+
+// automationOnlineThreshold returns the seconds-since-handshake cutoff for
+// "online", configurable via the automation_online_threshold config key
+func automationOnlineThreshold(db *sql.DB) int64 {
+	var raw string
+	db.QueryRow("SELECT value FROM system_config WHERE key='automation_online_threshold'").Scan(&raw)
+	if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+		return int64(v)
+	}
+	return 180 // 3 mins
+}
+
+// AutomationWorker tracks peer handshakes and fires webhooks on state change
+func AutomationWorker(ctx context.Context, db *sql.DB) {
+	// In-memory state: PublicKey -> currently online. Tracking the boolean
+	// (not the raw handshake time) means each transition fires exactly once.
+	online := make(map[string]bool)
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Webhook is optional; per-peer connection notifications still need
+		// the transition scan even when no automation hook is configured
+		var webhook string
+		db.QueryRow("SELECT webhook_url FROM automation_hooks WHERE enabled=1 LIMIT 1").Scan(&webhook)
+
+		// Output format: peer_pubkey <tab> preshared_key <tab> endpoint <tab> allowed_ips <tab> latest_handshake <tab> transfer_rx <tab> transfer_tx <tab> persistent_keepalive
+		out, err := exec.Command("wg", "show", wgInterface(), "dump").Output()
+		if err != nil {
+			// Fail silently if wg not found (dev env)
+			continue
+		}
+
+		threshold := automationOnlineThreshold(db)
+
+		lines := strings.Split(string(out), "\n")
+		for _, line := range lines {
+			fields := strings.Split(line, "\t")
+			if len(fields) < 5 {
+				continue
+			}
+			pubKey := fields[0]
+			endpoint := fields[2]
+			handshake, _ := strconv.ParseInt(fields[4], 10, 64)
+
+			isOnline := handshake > 0 && (time.Now().Unix()-handshake) < threshold
+
+			if isOnline && !online[pubKey] {
+				slog.Info("Automation: peer connected", "peer", pubKey)
+				if webhook != "" {
+					fireAutomationWebhook(db, webhook, "connect", pubKey)
+				}
+				maybeNotifyConnection(db, "connected", pubKey, endpoint)
+			} else if !isOnline && online[pubKey] {
+				slog.Info("Automation: peer disconnected", "peer", pubKey)
+				if webhook != "" {
+					fireAutomationWebhook(db, webhook, "disconnect", pubKey)
+				}
+				maybeNotifyConnection(db, "disconnected", pubKey, endpoint)
+			}
+
+			online[pubKey] = isOnline
+		}
+
+		if time.Now().Minute() == 0 {
+			db.Exec("DELETE FROM sessions WHERE expires_at < CURRENT_TIMESTAMP")
+		}
+	}
+}
+
+// connNotifyDebounce quiets flapping peers: at most one connection
+// notification per peer inside the window, so a reconnect loop doesn't spam
+// the channel
+var (
+	connNotifyDebounce       = map[string]time.Time{}
+	connNotifyDebounceWindow = 60 * time.Second
+)
+
+// maybeNotifyConnection queues a connection alert for peers flagged with
+// notify_on_connect, including the remote address and GeoIP country when
+// available
+func maybeNotifyConnection(db *sql.DB, event, pubKey, endpoint string) {
+	var flagged int
+	db.QueryRow(`
+		SELECT COALESCE(ps.notify_on_connect, 0)
+		FROM peer_settings ps
+		JOIN peers p ON p.id = ps.peer_id
+		WHERE p.public_key = ?`, pubKey).Scan(&flagged)
+	if flagged == 0 {
+		return
+	}
+
+	if t, ok := connNotifyDebounce[pubKey]; ok && time.Since(t) < connNotifyDebounceWindow {
+		return
+	}
+	connNotifyDebounce[pubKey] = time.Now()
+
+	var name string
+	db.QueryRow("SELECT name FROM peers WHERE public_key = ?", pubKey).Scan(&name)
+	if name == "" {
+		name = pubKey
+	}
+
+	msg := "Peer " + name + " " + event
+	if endpoint != "" && endpoint != "(none)" {
+		if host, _, err := net.SplitHostPort(endpoint); err == nil {
+			msg += " from " + host
+			if country := handler.GeoIPCountry(host); country != "" {
+				msg += " (" + country + ")"
+			}
+		}
+	}
+
+	notifyEvent(db, "peer_connection", msg)
+}
+
+// fireAutomationWebhook resolves the public key to a peer name and POSTs the
+// event payload, retrying twice with a short backoff for transient failures.
+// Delivery runs in its own goroutine so a slow endpoint never delays the next
+// pulse check.
+func fireAutomationWebhook(db *sql.DB, url, event, pubKey string) {
+	var name string
+	db.QueryRow("SELECT name FROM peers WHERE public_key = ?", pubKey).Scan(&name)
+	if name == "" {
+		name = pubKey // not in the DB (externally added); report the key itself
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"event":      event,
+		"peer_name":  name,
+		"public_key": pubKey,
+		"timestamp":  time.Now().Unix(),
+	})
+
+	go func() {
+		for attempt := 0; attempt < 3; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * 2 * time.Second)
+			}
+			resp, err := automationClient.Post(url, "application/json", bytes.NewReader(payload))
+			if err != nil {
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+		}
+		slog.Warn("Automation webhook failed after retries", "event", event, "peer", name)
+	}()
+}
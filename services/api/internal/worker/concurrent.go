@@ -0,0 +1,98 @@
+package worker
+
+import (
+	"database/sql"
+	"log/slog"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/handler"
+)
+
+// Concurrent-session cap: independent of the subnet's total-peer limit, a
+// deployment may only be licensed for N *simultaneous* connections. When the
+// online count (recent handshake) exceeds max_concurrent_peers, the
+// least-recently-active peers are kicked from the live interface - or, with
+// max_concurrent_action=alert, the breach is only reported. Kicked peers stay
+// enabled in the DB and wg0.conf, so they can reconnect when a slot frees up.
+
+// concurrentOnlineThreshold matches the online detection used elsewhere
+const concurrentOnlineThreshold = 180 // seconds
+
+var (
+	concurrentMu      sync.RWMutex
+	concurrentOnline  int
+	concurrentMax     int
+	lastCapBreachWarn time.Time
+)
+
+// ConcurrentUsage returns the latest online count and the configured cap
+// (0 = unlimited) for the stats endpoints
+func ConcurrentUsage() (online, max int) {
+	concurrentMu.RLock()
+	defer concurrentMu.RUnlock()
+	return concurrentOnline, concurrentMax
+}
+
+// enforceConcurrentCap recounts online peers from the shared stats cache and
+// enforces max_concurrent_peers; runs every monitor tick
+func enforceConcurrentCap(db *sql.DB) {
+	var maxStr string
+	db.QueryRow("SELECT value FROM system_config WHERE key='max_concurrent_peers'").Scan(&maxStr)
+	max, _ := strconv.Atoi(maxStr)
+
+	type onlinePeer struct {
+		pubKey    string
+		handshake int64
+	}
+	cutoff := time.Now().Unix() - concurrentOnlineThreshold
+	var online []onlinePeer
+	for pub, stats := range handler.GetWireGuardStats() {
+		if stats.HandshakeUnix >= cutoff {
+			online = append(online, onlinePeer{pub, stats.HandshakeUnix})
+		}
+	}
+
+	concurrentMu.Lock()
+	concurrentOnline = len(online)
+	concurrentMax = max
+	concurrentMu.Unlock()
+
+	if max <= 0 || len(online) <= max {
+		return
+	}
+
+	action := "disconnect"
+	db.QueryRow("SELECT value FROM system_config WHERE key='max_concurrent_action'").Scan(&action)
+
+	if action != "disconnect" {
+		// Alert-only mode; rate-limit the warning so a sustained breach
+		// doesn't flood logs and notification channels every tick
+		concurrentMu.Lock()
+		warn := time.Since(lastCapBreachWarn) > 15*time.Minute
+		if warn {
+			lastCapBreachWarn = time.Now()
+		}
+		concurrentMu.Unlock()
+		if warn {
+			slog.Warn("Concurrent peer cap exceeded (alert mode, not enforcing)", "online", len(online), "max", max)
+			notifyLimitWarning(db, "Concurrent connection cap exceeded: "+
+				strconv.Itoa(len(online))+" peers online, licensed for "+strconv.Itoa(max))
+		}
+		return
+	}
+
+	// Kick least-recently-active peers first until back under the cap
+	sort.Slice(online, func(i, j int) bool { return online[i].handshake < online[j].handshake })
+	for _, p := range online[:len(online)-max] {
+		var name string
+		db.QueryRow("SELECT name FROM peers WHERE public_key = ?", p.pubKey).Scan(&name)
+		slog.Info("Disconnecting peer to enforce concurrent cap", "peer", name, "online", len(online), "max", max)
+		exec.Command("wg", "set", wgInterface(), "peer", p.pubKey, "remove").Run()
+		handler.WriteAudit(db, nil, "CONCURRENT_KICK", name, "Disconnected to enforce concurrent connection cap")
+	}
+	Trigger() // peers were removed from the live interface
+}
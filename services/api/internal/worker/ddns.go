@@ -2,8 +2,11 @@ package worker
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +16,8 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
@@ -20,6 +25,8 @@ import (
 	"time"
 
 	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
+	appconfig "github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/handler"
 )
 
 // DDNSConfig holds provider-specific configuration
@@ -28,14 +35,42 @@ type DDNSConfig struct {
 	Domain      string `json:"domain"`
 	Token       string `json:"token"`
 	WebhookURL  string `json:"webhook_url"`
+	ZoneID      string `json:"zone_id,omitempty"` // Cloudflare zone the record lives in
 	TTL         int    `json:"ttl"`
 	Interval    int    `json:"interval_minutes"` // Configurable check interval
+
+	// Route53
+	HostedZoneID    string `json:"hosted_zone_id,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+
+	// Custom IP detection for networks where the default echo services are
+	// unreachable; empty means the built-in source list and 4-of-6 consensus
+	IPDetectSources   []string `json:"ip_detect_sources,omitempty"`
+	IPDetectConsensus int      `json:"ip_detect_consensus,omitempty"`
+
+	// Shared secret for signing webhook payloads (stored encrypted)
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+}
+
+// decryptIfNeeded returns the decrypted value when the stored string is an
+// encrypted blob, otherwise the value as-is (plaintext credentials)
+func decryptIfNeeded(value string) string {
+	if value == "" {
+		return value
+	}
+	if decrypted, err := auth.Decrypt(value); err == nil {
+		return decrypted
+	}
+	return value
 }
 
 // DDNS worker state
 var (
 	ddnsLastUpdate       time.Time
 	ddnsConsecutiveFails int
+	ddnsLastSyncedIPv4   string
+	ddnsLastSyncedIPv6   string
 	ddnsMutex            sync.Mutex
 )
 
@@ -61,7 +96,7 @@ var secureClient = &http.Client{
 }
 
 // DDNSWorker runs the DDNS update loop with production-grade safeguards
-func DDNSWorker(db *sql.DB) {
+func DDNSWorker(ctx context.Context, db *sql.DB) {
 	// Get configurable interval from DDNS config
 	interval := defaultUpdateInterval
 	
@@ -77,11 +112,20 @@ func DDNSWorker(db *sql.DB) {
 	defer ticker.Stop()
 
 	// Initial run with delay to let system stabilize
-	time.Sleep(30 * time.Second)
+	select {
+	case <-time.After(30 * time.Second):
+	case <-ctx.Done():
+		return
+	}
 	runDDNSCheck(db)
 
-	for range ticker.C {
-		runDDNSCheck(db)
+	for {
+		select {
+		case <-ticker.C:
+			runDDNSCheck(db)
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -148,9 +192,10 @@ func runDDNSCheck(db *sql.DB) {
 		}
 	}
 
+	config.AccessKeyID = decryptIfNeeded(config.AccessKeyID)
+	config.SecretAccessKey = decryptIfNeeded(config.SecretAccessKey)
 
-
-	currentIPv4, err := detectPublicIP(false)
+	currentIPv4, err := detectPublicIP(config, false)
 	if err != nil {
 		if isTransientError(err) {
 			slog.Warn("[DDNS] Transient IP detection failure, will retry", "error", err)
@@ -163,7 +208,7 @@ func runDDNSCheck(db *sql.DB) {
 
 
 
-	currentIPv6, _ := detectPublicIP(true)
+	currentIPv6, _ := detectPublicIP(config, true)
 
 	var storedIP, storedIPv6 string
 	db.QueryRow("SELECT value FROM system_config WHERE key='wan_ip'").Scan(&storedIP)
@@ -196,8 +241,7 @@ func runDDNSCheck(db *sql.DB) {
 
 		// Alert after 3 consecutive failures
 		if ddnsConsecutiveFails == 3 {
-			db.Exec("INSERT INTO audit_logs (user_id, action, target, details) VALUES (0, 'DDNS_ALERT', ?, 'DDNS failing repeatedly - check configuration')",
-				config.Domain)
+			handler.WriteAudit(db, nil, "DDNS_ALERT", config.Domain, "DDNS failing repeatedly - check configuration")
 		}
 		return
 	}
@@ -213,14 +257,72 @@ func runDDNSCheck(db *sql.DB) {
 
 	ddnsLastUpdate = time.Now()
 	ddnsConsecutiveFails = 0
+	ddnsLastSyncedIPv4 = currentIPv4
+	ddnsLastSyncedIPv6 = currentIPv6
 	slog.Info("[DDNS] Update successful", "ipv4", currentIPv4, "ipv6", currentIPv6, "provider", config.Provider)
 
-	db.Exec("INSERT INTO audit_logs (user_id, action, target, details) VALUES (0, 'DDNS_UPDATE', ?, ?)",
-		config.Domain, "IP changed from "+storedIP+" to "+currentIPv4)
+	handler.WriteAudit(db, nil, "DDNS_UPDATE", config.Domain, "IP changed from "+storedIP+" to "+currentIPv4)
+
+	if ipChanged {
+		notifyEvent(db, "ddns_change", "WAN IP changed from "+storedIP+" to "+currentIPv4+" (DNS updated)")
+		handleStaleIPEndpoints(db, storedIP, currentIPv4)
+	}
+}
+
+// handleStaleIPEndpoints deals with client configs that hardcode the old WAN
+// IP in their Endpoint line. DDNS-hostname configs are unaffected; IP-based
+// ones silently break after a change. When ddns_rewrite_ip_endpoints=true the
+// configs are rewritten in place, otherwise we just flag how many went stale.
+func handleStaleIPEndpoints(db *sql.DB, oldIP, newIP string) {
+	if oldIP == "" || newIP == "" || oldIP == newIP {
+		return
+	}
+
+	var rewrite string
+	db.QueryRow("SELECT value FROM system_config WHERE key='ddns_rewrite_ip_endpoints'").Scan(&rewrite)
+
+	clientDir := appconfig.Get().ClientsDir
+	if clientDir == "" {
+		return
+	}
+	files, _ := os.ReadDir(clientDir)
+
+	stale := 0
+	rewritten := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".conf") {
+			continue
+		}
+		path := filepath.Join(clientDir, f.Name())
+		content, err := os.ReadFile(path)
+		if err != nil || !strings.Contains(string(content), "Endpoint = "+oldIP+":") {
+			continue
+		}
+		stale++
+		if rewrite == "true" {
+			newContent := strings.Replace(string(content), "Endpoint = "+oldIP+":", "Endpoint = "+newIP+":", 1)
+			if os.WriteFile(path, []byte(newContent), 0600) == nil {
+				rewritten++
+			}
+		}
+	}
+
+	if stale == 0 {
+		return
+	}
+	if rewrite == "true" {
+		slog.Info("[DDNS] Rewrote IP-based client endpoints", "stale", stale, "rewritten", rewritten, "new_ip", newIP)
+		handler.WriteAudit(db, nil, "DDNS_ENDPOINT_REWRITE", newIP, fmt.Sprintf("Updated %d of %d IP-based client configs", rewritten, stale))
+	} else {
+		slog.Warn("[DDNS] IP-based client configs are now stale and need regeneration", "count", stale, "old_ip", oldIP)
+		notifyEvent(db, "ddns_change", fmt.Sprintf("%d client configs still point at old IP %s and need regeneration", stale, oldIP))
+	}
 }
 
-// detectPublicIP uses multiple sources with consensus voting (3/4 required)
-func detectPublicIP(ipv6 bool) (string, error) {
+// detectPublicIP uses multiple sources with consensus voting. Defaults are
+// six public echo services with 4 agreeing; both can be overridden per
+// deployment via ip_detect_sources / ip_detect_consensus in the DDNS config.
+func detectPublicIP(config DDNSConfig, ipv6 bool) (string, error) {
 	var sources []string
 	if ipv6 {
 		sources = []string{
@@ -242,6 +344,18 @@ func detectPublicIP(ipv6 bool) (string, error) {
 		}
 	}
 
+	required := minConsensus
+	if custom := validateDetectSources(config.IPDetectSources); len(custom) > 0 {
+		sources = custom
+	}
+	if config.IPDetectConsensus > 0 {
+		required = config.IPDetectConsensus
+	}
+	// Consensus can never exceed what's reachable in theory
+	if required > len(sources) {
+		required = len(sources)
+	}
+
 	var ips []string
 	var wg sync.WaitGroup
 	var mu sync.Mutex
@@ -282,20 +396,50 @@ func detectPublicIP(ipv6 bool) (string, error) {
 
 	wg.Wait()
 
-	// Require 3/4 sources to agree (stricter than simple majority)
-	if len(ips) < minConsensus {
+	if len(ips) < required {
 		// Fallback to local interface detection
 		if !ipv6 {
 			if fallbackIP := detectLocalPublicIP(); fallbackIP != "" {
 				return fallbackIP, nil
 			}
 		}
-		return "", &DDNSError{Message: "insufficient IP sources agree (need 3/4)"}
+		return "", &DDNSError{Message: fmt.Sprintf("insufficient IP sources agree (need %d of %d)", required, len(sources))}
 	}
 
 	return majorityVote(ips), nil
 }
 
+// validateDetectSources drops custom sources that are malformed or resolve
+// to private/loopback addresses (same SSRF posture as the defaults)
+func validateDetectSources(sources []string) []string {
+	var valid []string
+	for _, src := range sources {
+		u, err := url.Parse(src)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+			slog.Warn("[DDNS] Ignoring malformed ip_detect_source", "source", src)
+			continue
+		}
+		addrs, err := net.LookupIP(u.Hostname())
+		if err != nil || len(addrs) == 0 {
+			slog.Warn("[DDNS] Ignoring unresolvable ip_detect_source", "source", src)
+			continue
+		}
+		private := false
+		for _, addr := range addrs {
+			if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+				private = true
+				break
+			}
+		}
+		if private {
+			slog.Warn("[DDNS] Ignoring ip_detect_source resolving to a private address", "source", src)
+			continue
+		}
+		valid = append(valid, src)
+	}
+	return valid
+}
+
 // detectLocalPublicIP gets public IP from local interface as fallback
 func detectLocalPublicIP() string {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
@@ -359,8 +503,14 @@ func updateDNSProvider(config DDNSConfig, ipv4, ipv6 string) error {
 	switch config.Provider {
 	case "duckdns":
 		return updateDuckDNS(config, ipv4, ipv6)
+	case "cloudflare":
+		return updateCloudflare(config, ipv4, ipv6)
+	case "route53":
+		return updateRoute53(config, ipv4, ipv6)
 	case "webhook":
 		return updateWebhook(config, ipv4, ipv6)
+	case "namecheap":
+		return updateNamecheap(config, ipv4, ipv6)
 	default:
 		slog.Warn("[DDNS] Provider not fully implemented", "provider", config.Provider)
 		return nil
@@ -395,6 +545,159 @@ func updateDuckDNS(config DDNSConfig, ipv4, ipv6 string) error {
 	return nil
 }
 
+// updateNamecheap uses Namecheap's standard dynamic-DNS update URL. The
+// configured Domain is split into host + base domain ("vpn.example.com" ->
+// host=vpn, domain=example.com; a bare domain updates "@"), and the token is
+// the per-domain DDNS password. Namecheap's dynamic DNS is IPv4-only, so a
+// configured IPv6 is skipped rather than treated as an error.
+func updateNamecheap(config DDNSConfig, ipv4, ipv6 string) error {
+	if config.Domain == "" || config.Token == "" {
+		return &DDNSError{Message: "Namecheap requires domain and the DDNS password as token", Persistent: true}
+	}
+	if ipv4 == "" {
+		if ipv6 != "" {
+			slog.Info("[DDNS] Namecheap dynamic DNS is IPv4-only, skipping IPv6 update")
+		}
+		return nil
+	}
+	if ipv6 != "" {
+		slog.Info("[DDNS] Namecheap dynamic DNS is IPv4-only, updating A record only")
+	}
+
+	host := "@"
+	domain := config.Domain
+	if parts := strings.SplitN(config.Domain, ".", 2); len(parts) == 2 && strings.Contains(parts[1], ".") {
+		host = parts[0]
+		domain = parts[1]
+	}
+
+	updateURL := "https://dynamicdns.park-your-domain.com/update?host=" + url.QueryEscape(host) +
+		"&domain=" + url.QueryEscape(domain) +
+		"&password=" + url.QueryEscape(config.Token) +
+		"&ip=" + url.QueryEscape(ipv4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", updateURL, nil)
+	resp, err := secureClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	// The XML response reports errors via <ErrCount>; anything non-zero is a
+	// config problem (bad password, unknown host) that retrying won't fix
+	if !strings.Contains(string(body), "<ErrCount>0</ErrCount>") {
+		reason := "unexpected response"
+		if m := regexp.MustCompile(`<Err1>([^<]+)</Err1>`).FindStringSubmatch(string(body)); len(m) > 1 {
+			reason = m[1]
+		}
+		return &DDNSError{Message: "Namecheap returned: " + reason, Persistent: true}
+	}
+
+	return nil
+}
+
+// updateCloudflare syncs the A (and AAAA, when present) record via the
+// Cloudflare v4 API: look up the record ID in the zone, then PATCH it
+func updateCloudflare(config DDNSConfig, ipv4, ipv6 string) error {
+	if config.ZoneID == "" || config.Token == "" {
+		return &DDNSError{Message: "Cloudflare requires zone_id and token", Persistent: true}
+	}
+
+	if ipv4 != "" {
+		if err := updateCloudflareRecord(config, "A", ipv4); err != nil {
+			return err
+		}
+	}
+	if ipv6 != "" {
+		if err := updateCloudflareRecord(config, "AAAA", ipv6); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateCloudflareRecord(config DDNSConfig, recordType, ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 1. Find the record ID for this name/type
+	listURL := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records?type=%s&name=%s",
+		config.ZoneID, recordType, config.Domain)
+	req, err := http.NewRequestWithContext(ctx, "GET", listURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.Token)
+
+	resp, err := secureClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 401 || resp.StatusCode == 403 {
+		return &DDNSError{Message: "Cloudflare rejected token (" + resp.Status + ")", Persistent: true}
+	}
+	if resp.StatusCode >= 400 {
+		return &DDNSError{Message: "Cloudflare record lookup returned " + resp.Status, Persistent: false}
+	}
+
+	var listResult struct {
+		Result []struct {
+			ID      string `json:"id"`
+			Content string `json:"content"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listResult); err != nil {
+		return err
+	}
+	if len(listResult.Result) == 0 {
+		return &DDNSError{Message: fmt.Sprintf("No %s record for %s in zone - create it once in the dashboard", recordType, config.Domain), Persistent: true}
+	}
+	record := listResult.Result[0]
+	if record.Content == ip {
+		return nil // Already current
+	}
+
+	// 2. PATCH the record with the new IP
+	ttl := config.TTL
+	if ttl == 0 {
+		ttl = 1 // Cloudflare's "automatic"
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"content": ip,
+		"ttl":     ttl,
+	})
+
+	patchURL := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records/%s", config.ZoneID, record.ID)
+	patchReq, err := http.NewRequestWithContext(ctx, "PATCH", patchURL, strings.NewReader(string(payload)))
+	if err != nil {
+		return err
+	}
+	patchReq.Header.Set("Authorization", "Bearer "+config.Token)
+	patchReq.Header.Set("Content-Type", "application/json")
+
+	patchResp, err := secureClient.Do(patchReq)
+	if err != nil {
+		return err
+	}
+	defer patchResp.Body.Close()
+
+	if patchResp.StatusCode == 401 || patchResp.StatusCode == 403 {
+		return &DDNSError{Message: "Cloudflare rejected token (" + patchResp.Status + ")", Persistent: true}
+	}
+	if patchResp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(patchResp.Body, 512))
+		return &DDNSError{Message: "Cloudflare update returned " + patchResp.Status + ": " + string(body), Persistent: false}
+	}
+
+	return nil
+}
+
 func validateWebhookURL(urlStr string) error {
 	u, err := url.Parse(urlStr)
 	if err != nil {
@@ -423,6 +726,14 @@ func validateWebhookURL(urlStr string) error {
 	return nil
 }
 
+// updateWebhook sends the new addresses as JSON. When webhook_secret is set
+// the request is signed so the receiver can verify authenticity:
+//
+//	X-Timestamp: unix seconds at send time
+//	X-Signature: sha256=hex(HMAC-SHA256(secret, "<timestamp>.<raw body>"))
+//
+// Receivers should recompute the HMAC over "<X-Timestamp>.<raw body>" with
+// the shared secret and reject stale timestamps to block replays.
 func updateWebhook(config DDNSConfig, ipv4, ipv6 string) error {
 	if err := validateWebhookURL(config.WebhookURL); err != nil {
 		return fmt.Errorf("SSRF protection: %v", err)
@@ -448,6 +759,14 @@ func updateWebhook(config DDNSConfig, ipv4, ipv6 string) error {
 		req.Header.Set("Authorization", "Bearer "+config.Token)
 	}
 
+	if secret := decryptIfNeeded(config.WebhookSecret); secret != "" {
+		timestamp := fmt.Sprintf("%d", time.Now().Unix())
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "." + string(body)))
+		req.Header.Set("X-Timestamp", timestamp)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
 	resp, err := secureClient.Do(req)
 	if err != nil {
 		return err
@@ -504,12 +823,26 @@ func ForceUpdate(db *sql.DB) error {
 		return err
 	}
 
-	currentIP, err := detectPublicIP(false)
+	// Same decryption rules as the worker loop
+	if config.Token != "" && !strings.HasPrefix(config.Token, "duk_") && !strings.HasPrefix(config.Token, "cf_") {
+		if decrypted, err := auth.Decrypt(config.Token); err == nil {
+			config.Token = decrypted
+		}
+	}
+	config.AccessKeyID = decryptIfNeeded(config.AccessKeyID)
+	config.SecretAccessKey = decryptIfNeeded(config.SecretAccessKey)
+
+	currentIP, err := detectPublicIP(config, false)
 	if err != nil {
 		return err
 	}
 
-	return updateDNSProvider(config, currentIP, "")
+	if err := updateDNSProvider(config, currentIP, ""); err != nil {
+		return err
+	}
+	ddnsLastUpdate = time.Now()
+	ddnsLastSyncedIPv4 = currentIP
+	return nil
 }
 
 // GetDDNSStatus returns current DDNS status for monitoring
@@ -522,6 +855,8 @@ func GetDDNSStatus() map[string]interface{} {
 		"consecutive_fails": ddnsConsecutiveFails,
 		"is_disabled":       ddnsConsecutiveFails >= maxConsecutiveFails,
 		"next_check_in":     GetBackoffDuration(ddnsConsecutiveFails).String(),
+		"last_synced_ipv4":  ddnsLastSyncedIPv4,
+		"last_synced_ipv6":  ddnsLastSyncedIPv6,
 	}
 }
 
@@ -534,6 +869,11 @@ func EnableDDNS() {
 }
 // RedactURL scrubs sensitive tokens from URL strings for safe logging
 func RedactURL(input string) string {
+	// Bearer tokens (Cloudflare) can leak via error bodies
+	if strings.Contains(input, "Bearer ") {
+		re := regexp.MustCompile(`Bearer\s+\S+`)
+		input = re.ReplaceAllString(input, "Bearer [REDACTED]")
+	}
 	if !strings.Contains(input, "token=") {
 		return input
 	}
@@ -1,21 +1,32 @@
 package worker
 
 import (
+	"context"
 	"database/sql"
 	"log/slog"
 	"os"
 	"os/exec"
-	"strings"
+	"path/filepath"
 	"syscall"
 	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/handler"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/reconcile"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/wgconf"
 )
 
 // ExpiryWorker checks for expired peers and disables them
-func ExpiryWorker(db *sql.DB) {
+func ExpiryWorker(ctx context.Context, db *sql.DB) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		// First, get the public keys of peers about to be expired
 		rows, err := db.Query(`
 			SELECT name, public_key FROM peers 
@@ -47,7 +58,7 @@ func ExpiryWorker(db *sql.DB) {
 			
 			// 1. Remove from live WireGuard interface
 			if p.pubKey != "" {
-				exec.Command("wg", "set", "wg0", "peer", p.pubKey, "remove").Run()
+				exec.Command("wg", "set", wgInterface(), "peer", p.pubKey, "remove").Run()
 			}
 			
 			// 2. Delete from database
@@ -62,7 +73,7 @@ func ExpiryWorker(db *sql.DB) {
 			removeFromWg0Conf(p.pubKey)
 			
 			// 4. Remove client config file
-			clientConfPath := "/opt/samnet/clients/" + p.name + ".conf"
+			clientConfPath := filepath.Join(config.Get().ClientsDir, p.name+".conf")
 			os.Remove(clientConfPath)
 			os.Remove(clientConfPath + ".disabled")
 			os.Remove(clientConfPath + ".expiry") // Remove expiry marker too
@@ -79,96 +90,120 @@ func removeFromWg0Conf(pubKey string) {
 	if pubKey == "" {
 		return
 	}
-	
-	wgConfPath := "/etc/wireguard/wg0.conf"
+
+	wgConfPath := wgConfigPath()
 	data, err := os.ReadFile(wgConfPath)
 	if err != nil {
 		return
 	}
-	
-	lines := strings.Split(string(data), "\n")
-	var result []string
-	skipBlock := false
-	
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		
-		// Start of a new [Peer] block
-		if trimmed == "[Peer]" {
-			// Check if next lines contain our public key
-			skipBlock = false
-		}
-		
-		// If this line has our public key, mark to skip this entire block
-		if strings.Contains(line, pubKey) {
-			skipBlock = true
-			// Also remove lines from result that belong to this [Peer] block
-			// by backtracking to remove the [Peer] header and any comments
-			for len(result) > 0 {
-				last := strings.TrimSpace(result[len(result)-1])
-				if last == "[Peer]" || strings.HasPrefix(last, "#") || last == "" {
-					result = result[:len(result)-1]
-				} else {
-					break
-				}
-			}
-			continue
-		}
-		
-		if skipBlock {
-			// Check if we've hit a new section (new block starts, or end of peer config)
-			if trimmed == "[Peer]" || trimmed == "[Interface]" {
-				skipBlock = false
-			} else {
-				continue // Skip this line
-			}
-		}
-		
-		result = append(result, line)
+
+	cfg, _ := wgconf.Parse(data)
+	if !cfg.RemovePeerByPublicKey(pubKey) {
+		return
 	}
-	
+
 	// Write back with exclusive lock
-	lockFile, err := os.OpenFile("/etc/wireguard/.wg0.lock", os.O_CREATE|os.O_RDWR, 0600)
+	// Same cross-process lock name the handlers and CLI use
+	lockFile, err := os.OpenFile(filepath.Dir(wgConfPath)+"/.wg0.lock", os.O_CREATE|os.O_RDWR, 0600)
 	if err == nil {
 		defer lockFile.Close()
 		syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
 		defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
-		os.WriteFile(wgConfPath, []byte(strings.Join(result, "\n")), 0600)
+		os.WriteFile(wgConfPath, cfg.Render(), 0600)
 	}
 }
 
-// ScheduleWorker enables/disables peers based on time schedules
-func ScheduleWorker(db *sql.DB) {
+// ScheduleWorker enables/disables peers based on time schedules, applying
+// the same live-interface and wg0.conf mutations as a manual disable toggle
+func ScheduleWorker(ctx context.Context, db *sql.DB) {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		now := time.Now()
-		weekday := int(now.Weekday())
-		hour := now.Hour()
-
-		// Enable peers within schedule
-		db.Exec(`
-			UPDATE peers SET disabled = 0 
-			WHERE id IN (
-				SELECT peer_id FROM peer_schedules 
-				WHERE day_of_week = ? AND start_hour <= ? AND end_hour > ?
-			) AND disabled = 1
-		`, weekday, hour, hour)
-
-		db.Exec(`
-			UPDATE peers SET disabled = 1 
-			WHERE id IN (
-				SELECT ps.peer_id FROM peer_schedules ps
-				WHERE ps.peer_id = peers.id
-				GROUP BY ps.peer_id
-				HAVING MAX(CASE WHEN ps.day_of_week = ? AND ps.start_hour <= ? AND ps.end_hour > ? THEN 1 ELSE 0 END) = 0
-			) AND disabled = 0
-		`, weekday, hour, hour)
+	for {
+		select {
+		case <-ticker.C:
+			applySchedules(db)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func applySchedules(db *sql.DB) {
+	now := time.Now()
+
+	rows, err := db.Query("SELECT peer_id, day_of_week, start_hour, end_hour, COALESCE(timezone, '') FROM peer_schedules")
+	if err != nil {
+		slog.Error("Schedule query failed", "error", err)
+		return
+	}
+	scheduled := make(map[int]bool) // peer_id -> currently within a window
+	for rows.Next() {
+		var peerID int
+		var s handler.ScheduleEntry
+		if rows.Scan(&peerID, &s.DayOfWeek, &s.StartHour, &s.EndHour, &s.Timezone) != nil {
+			continue
+		}
+		if _, seen := scheduled[peerID]; !seen {
+			scheduled[peerID] = false
+		}
+		// Evaluated in the window's own timezone
+		if handler.ScheduleActive(s, now) {
+			scheduled[peerID] = true
+		}
+	}
+	rows.Close()
+
+	if len(scheduled) == 0 {
+		return
+	}
+
+	changed := false
+	for peerID, active := range scheduled {
+		var name, pubKey, allowedIPs string
+		var disabled int
+		var reason string
+		err := db.QueryRow("SELECT name, public_key, allowed_ips, COALESCE(disabled, 0), COALESCE(disabled_reason, '') FROM peers WHERE id = ?", peerID).Scan(&name, &pubKey, &allowedIPs, &disabled, &reason)
+		if err != nil {
+			continue
+		}
+
+		if !active && disabled == 0 {
+			slog.Info("Schedule window closed, disabling peer", "peer", name)
+			// Preserve usage across the disable cycle
+			db.Exec(`UPDATE peers SET
+				total_rx_bytes = total_rx_bytes + COALESCE(rx_bytes, 0),
+				total_tx_bytes = total_tx_bytes + COALESCE(tx_bytes, 0),
+				rx_bytes = 0, tx_bytes = 0
+				WHERE id = ?`, peerID)
+			if pubKey != "" {
+				exec.Command("wg", "set", wgInterface(), "peer", pubKey, "remove").Run()
+			}
+			db.Exec("UPDATE peers SET disabled = 1, disabled_reason = 'schedule' WHERE id = ?", peerID)
+			os.Create(filepath.Join(config.Get().ClientsDir, name+".conf.disabled"))
+			removeFromWg0Conf(pubKey)
+			changed = true
+		} else if active && disabled == 1 && reason == "schedule" {
+			// Only re-enable peers this worker disabled; a manual or
+			// limit-triggered disable must survive the window opening
+			slog.Info("Schedule window open, enabling peer", "peer", name)
+			serverIP := handler.ServerAllowedIPs(allowedIPs)
+			if pubKey != "" {
+				exec.Command("wg", "set", wgInterface(), "peer", pubKey, "allowed-ips", serverIP).Run()
+			}
+			db.Exec("UPDATE peers SET disabled = 0, disabled_reason = NULL WHERE id = ?", peerID)
+			os.Remove(filepath.Join(config.Get().ClientsDir, name+".conf.disabled"))
+			// Reconcile restores the wg0.conf block from the DB
+			changed = true
+		}
+	}
+
+	if changed {
+		Trigger()
 	}
 }
 
-// Trigger signals reconciliation (placeholder - uses the existing reconcile.Trigger pattern)
+// Trigger signals reconciliation via the shared trigger file
 func Trigger() {
-	// Touch the trigger file to signal systemd path unit
+	reconcile.Trigger()
 }
@@ -3,12 +3,14 @@ package worker
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,18 +20,50 @@ import (
 
 // LimitWorker checks for peers exceeding data limits and disables them
 // Runs frequently (every 10 seconds) for fast enforcement
-func LimitWorker(db *sql.DB) {
+func LimitWorker(ctx context.Context, db *sql.DB) {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		checkLimits(db)
+	for {
+		select {
+		case <-ticker.C:
+			checkLimits(db)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// warnThresholds returns the warning percentages (ascending), configurable
+// via the limit_warn_percent key as a comma-separated list. Default 80,95.
+func warnThresholds(db *sql.DB) []int {
+	var raw string
+	db.QueryRow("SELECT value FROM system_config WHERE key='limit_warn_percent'").Scan(&raw)
+	if raw == "" {
+		return []int{80, 95}
+	}
+	var thresholds []int
+	for _, part := range strings.Split(raw, ",") {
+		if v, err := strconv.Atoi(strings.TrimSpace(part)); err == nil && v > 0 && v < 100 {
+			thresholds = append(thresholds, v)
+		}
+	}
+	if len(thresholds) == 0 {
+		return []int{80, 95}
 	}
+	sort.Ints(thresholds)
+	return thresholds
+}
+
+// notifyLimitWarning queues the warning on every channel subscribed to
+// limit_warning events
+func notifyLimitWarning(db *sql.DB, message string) {
+	notifyEvent(db, "limit_warning", message)
 }
 
 func checkLimits(db *sql.DB) {
 	// 1. Get peers with limits (limit > 0)
-	rows, err := db.Query("SELECT name, public_key, data_limit_gb, COALESCE(total_rx_bytes, 0), COALESCE(total_tx_bytes, 0) FROM peers WHERE data_limit_gb > 0 AND disabled = 0")
+	rows, err := db.Query("SELECT name, public_key, data_limit_gb, COALESCE(total_rx_bytes, 0), COALESCE(total_tx_bytes, 0), COALESCE(limit_warned_mask, 0) FROM peers WHERE data_limit_gb > 0 AND disabled = 0")
 	if err != nil {
 		slog.Error("Limit check query failed", "error", err)
 		return
@@ -37,17 +71,18 @@ func checkLimits(db *sql.DB) {
 	defer rows.Close()
 
 	type PeerLimit struct {
-		Name     string
-		PubKey   string
-		LimitGB  int
-		TotalRx  int64
-		TotalTx  int64
+		Name       string
+		PubKey     string
+		LimitGB    int
+		TotalRx    int64
+		TotalTx    int64
+		WarnedMask int
 	}
 
 	var peers []PeerLimit
 	for rows.Next() {
 		var p PeerLimit
-		if err := rows.Scan(&p.Name, &p.PubKey, &p.LimitGB, &p.TotalRx, &p.TotalTx); err == nil {
+		if err := rows.Scan(&p.Name, &p.PubKey, &p.LimitGB, &p.TotalRx, &p.TotalTx, &p.WarnedMask); err == nil {
 			peers = append(peers, p)
 		}
 	}
@@ -59,7 +94,7 @@ func checkLimits(db *sql.DB) {
 
 	// 2. Fetch live WG stats
 	liveStats := make(map[string]struct{ rx, tx int64 })
-	cmd := exec.Command("wg", "show", "wg0", "transfer")
+	cmd := exec.Command("wg", "show", wgInterface(), "transfer")
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	if err := cmd.Run(); err == nil {
@@ -78,6 +113,8 @@ func checkLimits(db *sql.DB) {
 		// slog.Debug("Failed to fetch WG stats", "error", err)
 	}
 
+	thresholds := warnThresholds(db)
+
 	// 3. Check and Enforce
 	for _, p := range peers {
 		live, ok := liveStats[p.PubKey]
@@ -94,6 +131,18 @@ func checkLimits(db *sql.DB) {
 		if totalUsage > limitBytes {
 			slog.Info("Peer exceeded data limit. Disabling...", "peer", p.Name, "limit_gb", p.LimitGB, "usage_bytes", totalUsage)
 			disablePeer(db, p.Name, p.PubKey, currentRx, currentTx)
+			continue
+		}
+
+		// Graduated warnings: notify once per crossed threshold per cycle
+		percent := int(totalUsage * 100 / limitBytes)
+		for i, t := range thresholds {
+			bit := 1 << i
+			if percent >= t && p.WarnedMask&bit == 0 {
+				slog.Info("Peer crossed data-limit warning threshold", "peer", p.Name, "threshold_pct", t, "usage_pct", percent)
+				notifyLimitWarning(db, "Peer "+p.Name+" has used "+strconv.Itoa(percent)+"% of its "+strconv.Itoa(p.LimitGB)+" GB data limit")
+				db.Exec("UPDATE peers SET limit_warned_mask = COALESCE(limit_warned_mask, 0) | ? WHERE name = ?", bit, p.Name)
+			}
 		}
 	}
 }
@@ -108,14 +157,14 @@ func disablePeer(db *sql.DB, name, pub string, liveRx, liveTx int64) {
 	}
 
 	// 2. Disable in DB
-	_, err := db.Exec("UPDATE peers SET disabled = 1 WHERE name = ?", name)
+	_, err := db.Exec("UPDATE peers SET disabled = 1, disabled_reason = 'limit' WHERE name = ?", name)
 	if err != nil {
 		slog.Error("Failed to set peer disabled in DB", "error", err)
 	}
 
 	// 3. Remove from WireGuard interface
 	if pub != "" {
-		exec.Command("wg", "set", "wg0", "peer", pub, "remove").Run()
+		exec.Command("wg", "set", wgInterface(), "peer", pub, "remove").Run()
 	}
 
 	// 4. Create marker file (for CLI compatibility)
@@ -1,50 +1,118 @@
-package worker
-
-import (
-	"database/sql"
-	"log/slog"
-	"os/exec"
-	"strconv"
-	"strings"
-	"time"
-)
-
-func MonitorWorker(db *sql.DB) {
-	ticker := time.NewTicker(30 * time.Second)
-	for range ticker.C {
-		updatePeerStats(db)
-	}
-}
-
-func updatePeerStats(db *sql.DB) {
-	// wg show all dump format:
-	// interface public_key preshared_key endpoint allowed_ips latest_handshake rx_bytes tx_bytes persistent_keepalive
-	out, err := exec.Command("wg", "show", "all", "dump").CombinedOutput()
-	if err != nil {
-		slog.Error("WireGuard command failed", "error", err, "output", string(out))
-		return
-	}
-
-	lines := strings.Split(string(out), "\n")
-	for _, line := range lines {
-		parts := strings.Fields(line)
-		if len(parts) < 8 {
-			continue
-		}
-
-		pubKey := parts[1]
-		handshake, _ := strconv.ParseInt(parts[5], 10, 64)
-		rx, _ := strconv.ParseInt(parts[6], 10, 64)
-		tx, _ := strconv.ParseInt(parts[7], 10, 64)
-
-		if handshake == 0 {
-			continue
-		}
-
-		t := time.Unix(handshake, 0)
-		_, err = db.Exec("UPDATE peers SET last_handshake = ?, rx_bytes = ?, tx_bytes = ? WHERE public_key = ?", t, rx, tx, pubKey)
-		if err != nil {
-			slog.Error("Failed to update peer stats", "error", err, "peer", pubKey)
-		}
-	}
-}
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/handler"
+)
+
+// DefaultMonitorInterval is how often peer stats are polled unless overridden
+const DefaultMonitorInterval = 30 * time.Second
+
+// monitorInterval returns the polling interval, tunable via MONITOR_INTERVAL_SECONDS
+// so near-limit peers can get fresher stats without a rebuild
+func monitorInterval() time.Duration {
+	if v := os.Getenv("MONITOR_INTERVAL_SECONDS"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return DefaultMonitorInterval
+}
+
+func MonitorWorker(ctx context.Context, db *sql.DB) {
+	interval := monitorInterval()
+	slog.Info("Monitor worker started", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			updatePeerStats(db)
+			sampleTrafficHistory(db)
+			// Refresh the shared stats cache so request handlers never shell out
+			handler.RefreshWireGuardStats()
+			enforceConcurrentCap(db)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// trafficSampleInterval spaces traffic_history snapshots; the monitor tick can
+// run much faster than the charts' one-minute resolution needs
+const trafficSampleInterval = time.Minute
+
+var lastTrafficSample time.Time
+
+// sampleTrafficHistory snapshots every peer's cumulative byte counters into
+// traffic_history so GetTrafficHistory has data to chart. Values are the
+// rolled-over totals plus the live session counters (the same sum ListPeers
+// reports), so consecutive rows diff cleanly even across reconnects.
+func sampleTrafficHistory(db *sql.DB) {
+	if time.Since(lastTrafficSample) < trafficSampleInterval {
+		return
+	}
+	lastTrafficSample = time.Now()
+
+	_, err := db.Exec(`
+		INSERT INTO traffic_history (peer_id, rx_bytes, tx_bytes)
+		SELECT id,
+		       COALESCE(total_rx_bytes, 0) + COALESCE(rx_bytes, 0),
+		       COALESCE(total_tx_bytes, 0) + COALESCE(tx_bytes, 0)
+		FROM peers
+		WHERE last_handshake IS NOT NULL`)
+	if err != nil {
+		slog.Error("Failed to sample traffic history", "error", err)
+	}
+}
+
+func updatePeerStats(db *sql.DB) {
+	// wg show all dump format:
+	// interface public_key preshared_key endpoint allowed_ips latest_handshake rx_bytes tx_bytes persistent_keepalive
+	out, err := exec.Command("wg", "show", "all", "dump").CombinedOutput()
+	if err != nil {
+		slog.Error("WireGuard command failed", "error", err, "output", string(out))
+		return
+	}
+
+	lines := strings.Split(string(out), "\n")
+	for _, line := range lines {
+		parts := strings.Fields(line)
+		if len(parts) < 8 {
+			continue
+		}
+
+		pubKey := parts[1]
+		endpoint := parts[3]
+		handshake, _ := strconv.ParseInt(parts[5], 10, 64)
+		rx, _ := strconv.ParseInt(parts[6], 10, 64)
+		tx, _ := strconv.ParseInt(parts[7], 10, 64)
+
+		if handshake == 0 {
+			continue
+		}
+
+		t := time.Unix(handshake, 0)
+		_, err = db.Exec("UPDATE peers SET last_handshake = ?, rx_bytes = ?, tx_bytes = ? WHERE public_key = ?", t, rx, tx, pubKey)
+		if err != nil {
+			slog.Error("Failed to update peer stats", "error", err, "peer", pubKey)
+		}
+
+		// Persist the remote address (sans port) for GeoIP; WireGuard prints
+		// "(none)" before the first handshake
+		if endpoint != "" && endpoint != "(none)" {
+			if host, _, err := net.SplitHostPort(endpoint); err == nil {
+				db.Exec("UPDATE peers SET last_endpoint = ? WHERE public_key = ?", host, pubKey)
+			}
+		}
+	}
+}
@@ -2,29 +2,44 @@ package worker
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 )
 
 // NotificationWorker sends alerts to Telegram/Discord
-func NotificationWorker(db *sql.DB) {
+func NotificationWorker(ctx context.Context, db *sql.DB) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		processNotificationQueue(db)
+	for {
+		select {
+		case <-ticker.C:
+			processNotificationQueue(db)
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
+// maxNotificationAttempts is when the queue gives up on a message; with the
+// exponential backoff that's a few hours of trying before failed=1
+const maxNotificationAttempts = 8
+
 func processNotificationQueue(db *sql.DB) {
 	rows, err := db.Query(`
-		SELECT id, channel, webhook_url, message 
-		FROM notification_queue 
-		WHERE sent = 0 
-		ORDER BY created_at ASC 
+		SELECT id, channel, webhook_url, message, COALESCE(attempts, 0)
+		FROM notification_queue
+		WHERE sent = 0 AND COALESCE(failed, 0) = 0
+		AND (next_attempt_at IS NULL OR next_attempt_at <= datetime('now'))
+		ORDER BY created_at ASC
 		LIMIT 10
 	`)
 	if err != nil {
@@ -33,9 +48,9 @@ func processNotificationQueue(db *sql.DB) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var id int
+		var id, attempts int
 		var channel, webhookURL, message string
-		if err := rows.Scan(&id, &channel, &webhookURL, &message); err != nil {
+		if err := rows.Scan(&id, &channel, &webhookURL, &message, &attempts); err != nil {
 			continue
 		}
 
@@ -45,15 +60,38 @@ func processNotificationQueue(db *sql.DB) {
 			sendErr = sendTelegram(webhookURL, message)
 		case "discord":
 			sendErr = sendDiscord(webhookURL, message)
+		case "slack":
+			sendErr = sendSlack(webhookURL, message)
 		default:
 			sendErr = sendGenericWebhook(webhookURL, message)
 		}
 
 		if sendErr == nil {
 			db.Exec("UPDATE notification_queue SET sent = 1, sent_at = datetime('now') WHERE id = ?", id)
-		} else {
-			slog.Warn("Notification send failed", "channel", channel, "error", sendErr)
+			continue
+		}
+
+		// A rejection retrying can't fix (bad webhook, malformed payload)
+		// skips the backoff cycle entirely
+		var perm *permanentSendError
+		if errors.As(sendErr, &perm) {
+			slog.Error("Notification rejected by destination, not retrying", "channel", channel, "error", sendErr)
+			db.Exec("UPDATE notification_queue SET attempts = ?, failed = 1 WHERE id = ?", attempts+1, id)
+			continue
+		}
+
+		attempts++
+		if attempts >= maxNotificationAttempts {
+			slog.Error("Notification permanently failed, giving up", "channel", channel, "attempts", attempts, "error", sendErr)
+			db.Exec("UPDATE notification_queue SET attempts = ?, failed = 1 WHERE id = ?", attempts, id)
+			continue
 		}
+
+		// Exponential backoff so a down webhook isn't hammered every tick
+		backoff := int(GetBackoffDuration(attempts).Seconds())
+		slog.Warn("Notification send failed, will retry", "channel", channel, "attempts", attempts, "retry_in_seconds", backoff, "error", sendErr)
+		db.Exec("UPDATE notification_queue SET attempts = ?, next_attempt_at = datetime('now', ?) WHERE id = ?",
+			attempts, fmt.Sprintf("+%d seconds", backoff), id)
 	}
 }
 
@@ -75,6 +113,33 @@ func sendDiscord(webhookURL, message string) error {
 	return postJSON(webhookURL, payload)
 }
 
+// permanentSendError marks a delivery rejection that retrying can't fix
+type permanentSendError struct{ msg string }
+
+func (e *permanentSendError) Error() string { return e.msg }
+
+// sendSlack posts to a Slack incoming webhook. Slack answers a literal "ok"
+// body on success; 429 stays a transient error so the backoff cycle absorbs
+// Slack's aggressive rate limiting, anything else is permanent.
+func sendSlack(webhookURL, message string) error {
+	body, _ := json.Marshal(map[string]string{"text": message})
+	resp, err := http.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("slack rate limited (HTTP 429)")
+	}
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(respBody)) != "ok" {
+		return &permanentSendError{fmt.Sprintf("slack webhook rejected message: HTTP %d %s",
+			resp.StatusCode, strings.TrimSpace(string(respBody)))}
+	}
+	return nil
+}
+
 func sendGenericWebhook(url, message string) error {
 	payload := map[string]string{"message": message}
 	return postJSON(url, payload)
@@ -90,6 +155,28 @@ func postJSON(url string, payload interface{}) error {
 	return nil
 }
 
+// notifyEvent queues a message on every channel subscribed to the given
+// event type in notification_settings
+func notifyEvent(db *sql.DB, event, message string) {
+	rows, err := db.Query("SELECT channel, webhook_url FROM notification_settings WHERE enabled = 1 AND events LIKE ?", "%"+event+"%")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel, webhookURL string
+		if rows.Scan(&channel, &webhookURL) == nil {
+			QueueNotification(db, channel, webhookURL, message)
+		}
+	}
+}
+
+// NotifyEvent is the exported entry point to the event fan-out, for wiring
+// outside this package (main routes ScalingMonitor alerts through it)
+func NotifyEvent(db *sql.DB, event, message string) {
+	notifyEvent(db, event, message)
+}
+
 // QueueNotification adds a notification to the queue
 func QueueNotification(db *sql.DB, channel, webhookURL, message string) error {
 	_, err := db.Exec(`
@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/handler"
+)
+
+// QuotaResetWorker resets usage counters for peers whose quota_reset_day
+// matches the current day of the month, and re-enables peers that were
+// disabled purely because they hit their data limit. Manually disabled peers
+// (disabled_reason = 'manual') are left alone. The last run date is persisted
+// in system_config so restarts within the same day don't reset twice.
+func QuotaResetWorker(ctx context.Context, db *sql.DB) {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	runQuotaResets(db)
+	for {
+		select {
+		case <-ticker.C:
+			runQuotaResets(db)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func runQuotaResets(db *sql.DB) {
+	today := time.Now().Format("2006-01-02")
+	var last string
+	db.QueryRow("SELECT value FROM system_config WHERE key = 'quota_last_reset_date'").Scan(&last)
+	if last == today {
+		return
+	}
+
+	day := time.Now().Day()
+	rows, err := db.Query(`
+		SELECT p.id, p.name, p.public_key, p.allowed_ips,
+		       COALESCE(p.disabled, 0), COALESCE(p.disabled_reason, ''),
+		       COALESCE(p.total_rx_bytes, 0) + COALESCE(p.rx_bytes, 0),
+		       COALESCE(p.total_tx_bytes, 0) + COALESCE(p.tx_bytes, 0)
+		FROM peers p
+		JOIN peer_settings ps ON ps.peer_id = p.id
+		WHERE ps.quota_reset_day = ?`, day)
+	if err != nil {
+		slog.Error("Quota reset query failed", "error", err)
+		return
+	}
+
+	type resetPeer struct {
+		id                 int
+		name, pubKey       string
+		allowedIPs, reason string
+		disabled           int
+		rx, tx             int64
+	}
+	var peers []resetPeer
+	for rows.Next() {
+		var p resetPeer
+		if err := rows.Scan(&p.id, &p.name, &p.pubKey, &p.allowedIPs, &p.disabled, &p.reason, &p.rx, &p.tx); err == nil {
+			peers = append(peers, p)
+		}
+	}
+	rows.Close()
+
+	reEnabled := false
+	for _, p := range peers {
+		// Archive the cycle's usage before zeroing, same as the manual reset
+		db.Exec("INSERT INTO historical_usage (peer_name, public_key, rx_bytes, tx_bytes) VALUES (?, ?, ?, ?)",
+			p.name, p.pubKey, p.rx, p.tx)
+		db.Exec(`UPDATE peers SET
+			rx_bytes = 0, tx_bytes = 0,
+			total_rx_bytes = 0, total_tx_bytes = 0,
+			limit_warned_mask = 0
+			WHERE id = ?`, p.id)
+
+		restored := false
+		if p.disabled == 1 && p.reason == "limit" {
+			if p.pubKey != "" {
+				exec.Command("wg", "set", wgInterface(), "peer", p.pubKey, "allowed-ips", handler.ServerAllowedIPs(p.allowedIPs)).Run()
+			}
+			db.Exec("UPDATE peers SET disabled = 0, disabled_reason = NULL WHERE id = ?", p.id)
+			if dir := config.Get().ClientsDir; dir != "" {
+				os.Remove(dir + "/" + p.name + ".conf.disabled")
+			}
+			restored = true
+			reEnabled = true
+		}
+
+		handler.WriteAudit(db, nil, "QUOTA_RESET", p.name,
+			fmt.Sprintf("Monthly quota reset (day %d), archived %d RX / %d TX bytes, re-enabled: %t", day, p.rx, p.tx, restored))
+		slog.Info("Monthly quota reset", "peer", p.name, "re_enabled", restored)
+	}
+
+	db.Exec(`INSERT INTO system_config (key, value) VALUES ('quota_last_reset_date', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, today)
+
+	if reEnabled {
+		Trigger()
+	}
+}
@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+// RollupWorker aggregates the per-minute traffic_history samples into
+// bandwidth_hourly and bandwidth_daily so long-range graphs don't depend on
+// per-minute rows surviving the retention cleanup. Runs once per hour; each
+// rollup is an idempotent upsert, so a restart mid-hour just recomputes the
+// same buckets.
+func RollupWorker(ctx context.Context, db *sql.DB) {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	// Roll up once on start so a freshly restarted instance doesn't leave a
+	// gap until the first tick
+	rollupBandwidth(db)
+	for {
+		select {
+		case <-ticker.C:
+			rollupBandwidth(db)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func rollupBandwidth(db *sql.DB) {
+	// Previous completed hour plus the current partial one, so today's graph
+	// stays live instead of trailing by an hour
+	now := time.Now().UTC().Truncate(time.Hour)
+	for _, bucket := range []time.Time{now.Add(-time.Hour), now} {
+		rollupHour(db, bucket)
+	}
+	rollupDay(db, now.Add(-time.Hour))
+	rollupDay(db, now)
+	rollupTotals(db)
+}
+
+// rollupHour upserts one peer-hour row per peer with samples in the bucket.
+// traffic_history stores cumulative counters, so the hour's usage is the
+// spread between the first and last sample.
+func rollupHour(db *sql.DB, bucket time.Time) {
+	start := bucket.Format("2006-01-02 15:04:05")
+	end := bucket.Add(time.Hour).Format("2006-01-02 15:04:05")
+	_, err := db.Exec(`
+		INSERT INTO bandwidth_hourly (peer_id, peer_name, bucket, rx_bytes, tx_bytes)
+		SELECT th.peer_id, p.name, ?,
+		       MAX(th.rx_bytes) - MIN(th.rx_bytes),
+		       MAX(th.tx_bytes) - MIN(th.tx_bytes)
+		FROM traffic_history th
+		JOIN peers p ON p.id = th.peer_id
+		WHERE th.timestamp >= ? AND th.timestamp < ?
+		GROUP BY th.peer_id
+		ON CONFLICT(peer_id, bucket) DO UPDATE SET
+			rx_bytes = excluded.rx_bytes,
+			tx_bytes = excluded.tx_bytes`,
+		start, start, end)
+	if err != nil {
+		slog.Error("Hourly bandwidth rollup failed", "bucket", start, "error", err)
+	}
+}
+
+// rollupDay sums a day's hourly rows into bandwidth_daily
+func rollupDay(db *sql.DB, t time.Time) {
+	day := t.Format("2006-01-02")
+	_, err := db.Exec(`
+		INSERT INTO bandwidth_daily (peer_id, peer_name, bucket, rx_bytes, tx_bytes)
+		SELECT peer_id, peer_name, ?, SUM(rx_bytes), SUM(tx_bytes)
+		FROM bandwidth_hourly
+		WHERE date(bucket) = ?
+		GROUP BY peer_id
+		ON CONFLICT(peer_id, bucket) DO UPDATE SET
+			rx_bytes = excluded.rx_bytes,
+			tx_bytes = excluded.tx_bytes`,
+		day, day)
+	if err != nil {
+		slog.Error("Daily bandwidth rollup failed", "day", day, "error", err)
+	}
+}
+
+// rollupTotals recomputes lifetime totals from the hourly table; recomputing
+// keeps it correct if an hour is ever re-rolled
+func rollupTotals(db *sql.DB) {
+	_, err := db.Exec(`
+		INSERT INTO bandwidth_total (peer_id, peer_name, rx_bytes, tx_bytes, updated_at)
+		SELECT peer_id, peer_name, SUM(rx_bytes), SUM(tx_bytes), CURRENT_TIMESTAMP
+		FROM bandwidth_hourly
+		GROUP BY peer_id
+		ON CONFLICT(peer_id) DO UPDATE SET
+			peer_name = excluded.peer_name,
+			rx_bytes = excluded.rx_bytes,
+			tx_bytes = excluded.tx_bytes,
+			updated_at = excluded.updated_at`)
+	if err != nil {
+		slog.Error("Bandwidth totals rollup failed", "error", err)
+	}
+}
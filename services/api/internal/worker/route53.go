@@ -0,0 +1,153 @@
+package worker
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Route53 is a global service; SigV4 signs against us-east-1
+const (
+	route53Host    = "route53.amazonaws.com"
+	route53Region  = "us-east-1"
+	route53Service = "route53"
+)
+
+// updateRoute53 UPSERTs the A (and AAAA, when present) record via
+// ChangeResourceRecordSets with a manually built SigV4 signature, avoiding
+// the full AWS SDK dependency for one API call
+func updateRoute53(config DDNSConfig, ipv4, ipv6 string) error {
+	if config.HostedZoneID == "" || config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return &DDNSError{Message: "Route53 requires hosted_zone_id, access_key_id and secret_access_key", Persistent: true}
+	}
+
+	ttl := config.TTL
+	if ttl == 0 {
+		ttl = 300
+	}
+
+	var changes strings.Builder
+	if ipv4 != "" {
+		changes.WriteString(route53Change(config.Domain, "A", ipv4, ttl))
+	}
+	if ipv6 != "" {
+		changes.WriteString(route53Change(config.Domain, "AAAA", ipv6, ttl))
+	}
+	if changes.Len() == 0 {
+		return nil
+	}
+
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<ChangeResourceRecordSetsRequest xmlns="https://route53.amazonaws.com/doc/2013-04-01/"><ChangeBatch><Changes>%s</Changes></ChangeBatch></ChangeResourceRecordSetsRequest>`, changes.String())
+
+	zoneID := strings.TrimPrefix(config.HostedZoneID, "/hostedzone/")
+	path := "/2013-04-01/hostedzone/" + zoneID + "/rrset/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+route53Host+path, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	signRoute53Request(req, path, body, config.AccessKeyID, config.SecretAccessKey, time.Now().UTC())
+
+	resp, err := secureClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		code, message := parseRoute53Error(respBody)
+		// Auth/validation failures are permanent; throttling and outages are not
+		persistent := resp.StatusCode == 401 || resp.StatusCode == 403 ||
+			(resp.StatusCode < 500 && code != "Throttling" && code != "PriorRequestNotComplete")
+		if message == "" {
+			message = resp.Status
+		}
+		return &DDNSError{Message: "Route53: " + message, Persistent: persistent}
+	}
+
+	return nil
+}
+
+func route53Change(domain, recordType, ip string, ttl int) string {
+	return fmt.Sprintf(`<Change><Action>UPSERT</Action><ResourceRecordSet><Name>%s</Name><Type>%s</Type><TTL>%d</TTL><ResourceRecords><ResourceRecord><Value>%s</Value></ResourceRecord></ResourceRecords></ResourceRecordSet></Change>`,
+		domain, recordType, ttl, ip)
+}
+
+func parseRoute53Error(body []byte) (code, message string) {
+	var errResp struct {
+		Error struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Error"`
+	}
+	if xml.Unmarshal(body, &errResp) == nil {
+		return errResp.Error.Code, errResp.Error.Message
+	}
+	return "", ""
+}
+
+// signRoute53Request adds the AWS SigV4 Authorization header
+func signRoute53Request(req *http.Request, path, body, accessKey, secretKey string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+
+	req.Header.Set("Host", route53Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	payloadHash := sha256Hex([]byte(body))
+
+	canonicalHeaders := "host:" + route53Host + "\n" + "x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-date"
+
+	canonicalRequest := strings.Join([]string{
+		"POST",
+		path,
+		"", // no query string
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	credentialScope := strings.Join([]string{dateStamp, route53Region, route53Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		credentialScope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	// Derive the signing key: date -> region -> service -> aws4_request
+	kDate := hmacSHA256([]byte("AWS4"+secretKey), dateStamp)
+	kRegion := hmacSHA256(kDate, route53Region)
+	kService := hmacSHA256(kRegion, route53Service)
+	kSigning := hmacSHA256(kService, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(kSigning, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, credentialScope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -1,6 +1,7 @@
 package worker
 
 import (
+	"context"
 	"database/sql"
 	"log/slog"
 	"os/exec"
@@ -9,11 +10,16 @@ import (
 )
 
 // SelfHealingWorker monitors system health and auto-recovers failed components
-func SelfHealingWorker(db *sql.DB) {
+func SelfHealingWorker(ctx context.Context, db *sql.DB) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
 		checkWireGuard()
 
@@ -27,10 +33,10 @@ func SelfHealingWorker(db *sql.DB) {
 }
 
 func checkWireGuard() {
-	out, err := exec.Command("wg", "show", "wg0").Output()
+	out, err := exec.Command("wg", "show", wgInterface()).Output()
 	if err != nil || len(out) == 0 {
 		slog.Warn("WireGuard interface down, attempting recovery...")
-		exec.Command("systemctl", "restart", "wg-quick@wg0").Run()
+		exec.Command("systemctl", "restart", "wg-quick@"+wgInterface()).Run()
 		slog.Info("WireGuard restart triggered")
 	}
 }
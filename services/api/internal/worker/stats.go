@@ -1,6 +1,7 @@
 package worker
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -42,10 +43,16 @@ func GetSystemStats() SystemStats {
 }
 
 // StatsWorker collects system metrics every second
-func StatsWorker() {
+func StatsWorker(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Second)
-	for range ticker.C {
-		collectStats()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			collectStats()
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -105,8 +112,8 @@ func collectStats() {
 		var totalRX, totalTX int64
 		for _, line := range strings.Split(string(data), "\n") {
 			line = strings.TrimSpace(line)
-			// Monitor common network interfaces: wg0, eth0, eno1, ens*, enp*
-			if strings.HasPrefix(line, "wg0:") || 
+			// Monitor the WG interface plus common NICs: eth0, eno1, ens*, enp*
+			if strings.HasPrefix(line, wgInterface()+":") ||
 			   strings.HasPrefix(line, "eth0:") || 
 			   strings.HasPrefix(line, "eno1:") || 
 			   strings.HasPrefix(line, "ens") || 
@@ -0,0 +1,14 @@
+package worker
+
+import "github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
+
+// wgInterface is the managed WireGuard interface name (WG_INTERFACE, default
+// wg0), shared by every worker that shells out to wg
+func wgInterface() string {
+	return config.Get().WGInterface
+}
+
+// wgConfigPath is the on-disk config file for that interface
+func wgConfigPath() string {
+	return config.Get().WGConfigPath
+}
@@ -1,556 +1,796 @@
-package main
-
-import (
-	"context"
-	"database/sql"
-	"encoding/json"
-	"flag"
-	"fmt"
-	"log/slog"
-	"net/http"
-	"os"
-	"os/signal"
-	"path/filepath"
-	"runtime/debug"
-	"strings"
-	"syscall"
-	"time"
-
-	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
-	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
-	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/db"
-	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/handler"
-	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/middleware"
-	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/worker"
-)
-
-func main() {
-	// Early logging to stderr for container troubleshooting
-	fmt.Fprintf(os.Stderr, "[BOOT] API starting... (Time: %s)\n", time.Now().Format(time.RFC3339))
-	
-	createAdmin := flag.String("create-admin", "", "Create admin user with this username")
-	adminPass := flag.String("password", "", "Password for the admin user")
-	decryptFlag := flag.String("decrypt", "", "Decrypt a base64 string using the master key")
-	encryptFlag := flag.String("encrypt", "", "Encrypt a plaintext string using the master key")
-	flag.Parse()
-
-	// CLI Mode: Crypt utility (for samnet.sh integration)
-	if *decryptFlag != "" || *encryptFlag != "" {
-		// Initialize config just to get paths (don't validate full stack)
-		_ = config.Load()
-		
-		if *decryptFlag != "" {
-			fmt.Fprintf(os.Stderr, "[BOOT] Running in decrypt mode\n")
-			plaintext, err := auth.Decrypt(*decryptFlag)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Decryption failed: %v\n", err)
-				os.Exit(1)
-			}
-			fmt.Print(plaintext)
-		} else {
-			fmt.Fprintf(os.Stderr, "[BOOT] Running in encrypt mode\n")
-			ciphertext, err := auth.Encrypt(*encryptFlag)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Encryption failed: %v\n", err)
-				os.Exit(1)
-			}
-			fmt.Print(ciphertext)
-		}
-		os.Exit(0)
-	}
-
-	fmt.Fprintf(os.Stderr, "[BOOT] Loading configuration...\n")
-	cfg := config.Load()
-	if err := cfg.Validate(); err != nil {
-		slog.Error("Invalid config", "error", err)
-		os.Exit(1)
-	}
-
-	fmt.Fprintf(os.Stderr, "[BOOT] Connecting to database at %s...\n", cfg.DBPath)
-	database, err := db.Connect(cfg.DBPath)
-	if err != nil {
-		slog.Error("Failed to connect to DB", "error", err)
-		os.Exit(1)
-	}
-	defer database.Close()
-
-	fmt.Fprintf(os.Stderr, "[BOOT] Running database migrations...\n")
-	if err := db.RunMigrations(cfg.DBPath); err != nil {
-		slog.Error("Failed to run migrations", "error", err)
-		os.Exit(1)
-	}
-
-	fmt.Fprintf(os.Stderr, "[BOOT] Validating database schema...\n")
-	// Validate schema integrity before starting workers
-	if err := db.ValidateSchema(database); err != nil {
-		slog.Error("Database schema validation failed", "error", err)
-		os.Exit(1)
-	}
-
-	fmt.Fprintf(os.Stderr, "[BOOT] Initializing JSON logger and starting workers...\n")
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
-
-	// CLI Mode: Create admin user
-	if *createAdmin != "" && *adminPass != "" {
-		hash, err := auth.HashPassword(*adminPass)
-		if err != nil {
-			slog.Error("Failed to hash password", "error", err)
-			os.Exit(1)
-		}
-		_, err = database.Exec("INSERT OR REPLACE INTO users (username, password_hash, role, failed_attempts) VALUES (?, ?, 'admin', 0)", *createAdmin, hash)
-		if err != nil {
-			slog.Error("Failed to create user", "error", err)
-			os.Exit(1)
-		}
-		slog.Info("User created successfully", "username", *createAdmin)
-		os.Exit(0)
-	}
-
-	// Start background workers with panic recovery
-	var safeWorker func(name string, workerFunc func(*sql.DB))
-	safeWorker = func(name string, workerFunc func(*sql.DB)) {
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					slog.Error("Worker crashed - restarting", "worker", name, "panic", r, "stack", string(debug.Stack()))
-					time.Sleep(10 * time.Second)
-					safeWorker(name, workerFunc) // Restart with backoff
-				}
-			}()
-			workerFunc(database)
-		}()
-	}
-
-	safeWorker("limits", worker.LimitWorker)
-	safeWorker("expiry", worker.ExpiryWorker)
-	safeWorker("schedule", worker.ScheduleWorker) // If ScheduleWorker is exported
-	safeWorker("ddns", worker.DDNSWorker)
-	safeWorker("alerts", worker.AlertsWorker)
-	safeWorker("monitor", worker.MonitorWorker)
-	safeWorker("automation", worker.AutomationWorker)
-	
-	// Start System Stats Worker (1s ticker, no database needed)
-	go worker.StatsWorker()
-
-	// Run DB maintenance every hour
-	go func() {
-		ticker := time.NewTicker(1 * time.Hour)
-		defer ticker.Stop()
-		for range ticker.C {
-			db.RunMaintenance(database)
-		}
-	}()
-
-	mux := http.NewServeMux()
-
-	// Public endpoints (no auth, no CSRF)
-	mux.HandleFunc("/health/live", handler.HealthLive)
-	mux.HandleFunc("/health/ready", handler.HealthReady(database))
-	mux.HandleFunc("/metrics", handler.Metrics(database))
-	
-	// Sync health check (Hardening: Single Source of Truth verification)
-	mux.HandleFunc("/health/sync", func(w http.ResponseWriter, r *http.Request) {
-		clientDir := config.Get().ClientsDir
-		files, _ := filepath.Glob(filepath.Join(clientDir, "*.conf"))
-		
-		dbPeers := make(map[string]bool)
-		rows, err := database.Query("SELECT name FROM peers")
-		if err == nil {
-			defer rows.Close()
-			for rows.Next() {
-				var name string
-				if rows.Scan(&name) == nil {
-					dbPeers[name] = true
-				}
-			}
-		}
-		
-		filePeers := make(map[string]bool)
-		for _, f := range files {
-			name := strings.TrimSuffix(filepath.Base(f), ".conf")
-			filePeers[name] = true
-		}
-		
-		missingFiles := []string{}
-		for name := range dbPeers {
-			if !filePeers[name] {
-				missingFiles = append(missingFiles, name)
-			}
-		}
-		
-		missingDB := []string{}
-		for name := range filePeers {
-			if !dbPeers[name] {
-				missingDB = append(missingDB, name)
-			}
-		}
-		
-		status := "OK"
-		if len(missingFiles) > 0 || len(missingDB) > 0 {
-			status = "DESYNC"
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status":            status,
-			"database_peers":    len(dbPeers),
-			"filesystem_peers":  len(filePeers),
-			"missing_files":     missingFiles,
-			"missing_database":  missingDB,
-			"timestamp":         time.Now().Unix(),
-		})
-	})
-
-	// Public login endpoint (rate limited but no auth/CSRF)
-	publicAPI := http.NewServeMux()
-	publicAPI.HandleFunc("POST /login", handler.Login(database))
-	mux.Handle("/api/v1/login", http.StripPrefix("/api/v1", middleware.LoginRateLimitMiddleware(publicAPI)))
-
-	// Internal API - localhost only, no auth (for CLI cross-engine mode)
-	// This is safe because it only accepts connections from 127.0.0.1
-	internalAPI := http.NewServeMux()
-	internalAPI.HandleFunc("DELETE /peers/{id}", handler.DeletePeer(database))
-	internalAPI.HandleFunc("PUT /peers/{id}", handler.UpdatePeer(database))
-	internalAPI.HandleFunc("GET /peers/config", handler.DownloadPeerConfig(database))
-	mux.Handle("/internal/", http.StripPrefix("/internal", middleware.LocalhostOnly(internalAPI)))
-
-	// Protected endpoints (auth + CSRF)
-	protectedAPI := http.NewServeMux()
-	protectedAPI.HandleFunc("POST /logout", handler.Logout(database))
-	protectedAPI.HandleFunc("GET /peers", handler.ListPeers(database))
-	protectedAPI.HandleFunc("POST /peers", handler.CreatePeer(database))
-	protectedAPI.HandleFunc("GET /peers/config", handler.DownloadPeerConfig(database))
-	protectedAPI.HandleFunc("GET /peers/qr", handler.GetPeerQR(database))
-	protectedAPI.HandleFunc("DELETE /peers/{id}", handler.DeletePeer(database))
-	protectedAPI.HandleFunc("PUT /peers/{id}", handler.UpdatePeer(database))
-	protectedAPI.HandleFunc("GET /peers/export", handler.ExportAllPeers(database))
-
-	// Backup endpoint
-	protectedAPI.HandleFunc("GET /backup", handler.CreateBackup(database))
-
-	// Subnet configuration
-	protectedAPI.HandleFunc("GET /network/subnet", func(w http.ResponseWriter, r *http.Request) {
-		var subnet, preset string
-		database.QueryRow("SELECT value FROM system_config WHERE key='subnet_cidr'").Scan(&subnet)
-		database.QueryRow("SELECT value FROM system_config WHERE key='subnet_preset'").Scan(&preset)
-		if subnet == "" {
-			subnet = "10.100.0.0/24"
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"subnet": subnet,
-			"preset": preset,
-		})
-	})
-	protectedAPI.HandleFunc("POST /network/subnet", func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Subnet string `json:"subnet"`
-			Preset string `json:"preset"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
-			return
-		}
-		// Validate subnet format
-		if !strings.Contains(req.Subnet, "/") {
-			http.Error(w, "Invalid subnet format (must be CIDR)", http.StatusBadRequest)
-			return
-		}
-		database.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('subnet_cidr', ?)", req.Subnet)
-		database.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('subnet_preset', ?)", req.Preset)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"status": "configured"}`))
-	})
-
-	// DDNS management
-	protectedAPI.HandleFunc("GET /ddns/config", func(w http.ResponseWriter, r *http.Request) {
-		var config struct {
-			Enabled  bool   `json:"enabled"`
-			Provider string `json:"provider"`
-			Domain   string `json:"domain"`
-		}
-		var enabledStr, configJSON string
-		database.QueryRow("SELECT value FROM system_config WHERE key='ddns_enabled'").Scan(&enabledStr)
-		database.QueryRow("SELECT value FROM system_config WHERE key='ddns_config'").Scan(&configJSON)
-		config.Enabled = enabledStr == "true" || enabledStr == "1"
-		if configJSON != "" {
-			json.Unmarshal([]byte(configJSON), &config)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(config)
-	})
-	protectedAPI.HandleFunc("POST /ddns/config", func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Enabled  bool   `json:"enabled"`
-			Provider string `json:"provider"`
-			Domain   string `json:"domain"`
-			Token    string `json:"token"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
-			return
-		}
-		enabledStr := "false"
-		if req.Enabled {
-			enabledStr = "true"
-		}
-		database.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('ddns_enabled', ?)", enabledStr)
-		configJSON, _ := json.Marshal(map[string]string{
-			"provider": req.Provider,
-			"domain":   req.Domain,
-			"token":    req.Token,
-		})
-		database.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('ddns_config', ?)", string(configJSON))
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"status": "saved"}`))
-	})
-	protectedAPI.HandleFunc("POST /ddns/force-update", func(w http.ResponseWriter, r *http.Request) {
-		if err := worker.ForceUpdate(database); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"status": "update triggered"}`))
-	})
-	protectedAPI.HandleFunc("GET /ddns/status", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		status := worker.GetDDNSStatus()
-		json.NewEncoder(w).Encode(status)
-	})
-
-	// Subnet management
-	protectedAPI.HandleFunc("GET /subnets/presets", handler.GetSubnetPresets(database))
-	protectedAPI.HandleFunc("GET /subnets/current", handler.GetCurrentSubnet(database))
-	protectedAPI.HandleFunc("POST /subnets/configure", handler.ConfigureSubnet(database))
-	protectedAPI.HandleFunc("GET /network/stats", handler.SubnetStats(database))
-
-	// Database scaling monitor
-	protectedAPI.HandleFunc("GET /db/metrics", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"backend": "sqlite",
-			"status":  "operational",
-		})
-	})
-
-	// Audit logs endpoint
-	protectedAPI.HandleFunc("GET /audit-logs", func(w http.ResponseWriter, r *http.Request) {
-		rows, err := database.Query(`
-			SELECT a.created_at, COALESCE(u.username, 'system') as username, a.action, a.target, a.ip_address 
-			FROM audit_logs a 
-			LEFT JOIN users u ON a.user_id = u.id 
-			ORDER BY a.created_at DESC LIMIT 20
-		`)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode([]interface{}{})
-			return
-		}
-		defer rows.Close()
-
-		var logs []map[string]interface{}
-		for rows.Next() {
-			var createdAt, username, action string
-			var target, ip sql.NullString
-			rows.Scan(&createdAt, &username, &action, &target, &ip)
-			logs = append(logs, map[string]interface{}{
-				"created_at": createdAt,
-				"username":   username,
-				"action":     action,
-				"target":     target.String,
-				"ip_address": ip.String,
-			})
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(logs)
-	})
-
-	// Network settings
-	protectedAPI.HandleFunc("GET /network/settings", handler.GetNetworkSettings(database))
-	protectedAPI.HandleFunc("POST /network/settings", handler.UpdateNetworkSettings(database))
-	protectedAPI.HandleFunc("GET /network/global", handler.GetGlobalSettings(database))
-	protectedAPI.HandleFunc("POST /network/global", handler.UpdateGlobalSettings(database))
-
-	// User stats
-	protectedAPI.HandleFunc("GET /users/stats", func(w http.ResponseWriter, r *http.Request) {
-		var adminCount, userCount int
-		database.QueryRow("SELECT COUNT(*) FROM users WHERE role='admin'").Scan(&adminCount)
-		database.QueryRow("SELECT COUNT(*) FROM users WHERE role!='admin'").Scan(&userCount)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]int{
-			"admin_count": adminCount,
-			"user_count":  userCount,
-		})
-	})
-
-	// System stats endpoint for Web UI dashboard
-	protectedAPI.HandleFunc("GET /system/stats", func(w http.ResponseWriter, r *http.Request) {
-		stats := worker.GetSystemStats()
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(stats)
-	})
-
-	// Password change endpoint
-	protectedAPI.HandleFunc("POST /users/password", func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			CurrentPassword string `json:"current_password"`
-			NewPassword     string `json:"new_password"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
-			return
-		}
-		if len(req.NewPassword) < 8 {
-			http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
-			return
-		}
-
-		// Get user ID from session
-		userID := middleware.GetUserID(r)
-		if userID == 0 {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		// Verify current password
-		var storedHash string
-		err := database.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&storedHash)
-		if err != nil {
-			http.Error(w, "User not found", http.StatusNotFound)
-			return
-		}
-		valid, err := auth.CheckPassword(storedHash, req.CurrentPassword)
-		if err != nil || !valid {
-			http.Error(w, "Current password is incorrect", http.StatusForbidden)
-			return
-		}
-
-		// Hash and update new password
-		newHash, err := auth.HashPassword(req.NewPassword)
-		if err != nil {
-			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
-			return
-		}
-		_, err = database.Exec("UPDATE users SET password_hash = ? WHERE id = ?", newHash, userID)
-		if err != nil {
-			http.Error(w, "Failed to update password", http.StatusInternalServerError)
-			return
-		}
-
-	w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"status": "password_updated"}`))
-	})
-
-	// Observability Alerts endpoint - returns actionable system warnings
-	protectedAPI.HandleFunc("GET /system/alerts", func(w http.ResponseWriter, r *http.Request) {
-		alerts := []map[string]interface{}{}
-		
-		// 1. Stale handshake check (>5 minutes without handshake = potential issue)
-		rows, err := database.Query("SELECT name, public_key FROM peers WHERE disabled = 0 OR disabled IS NULL")
-		if err == nil {
-			defer rows.Close()
-			wgStats := handler.GetWireGuardStats()
-			for rows.Next() {
-				var name, pubKey string
-				if rows.Scan(&name, &pubKey) == nil {
-					if stats, ok := wgStats[pubKey]; ok {
-						if stats.LastHandshake == "never" || stats.LastHandshake == "" {
-							alerts = append(alerts, map[string]interface{}{
-								"type":    "stale_handshake",
-								"level":   "warning",
-								"peer":    name,
-								"message": "Peer has never established connection",
-							})
-						}
-					}
-				}
-			}
-		}
-		
-		// 2. Subnet capacity check (warn at 80%)
-		var subnetCIDR string
-		database.QueryRow("SELECT value FROM system_config WHERE key='subnet_cidr'").Scan(&subnetCIDR)
-		if subnetCIDR == "" {
-			subnetCIDR = "10.100.0.0/24"
-		}
-		var peerCount, maxPeers int
-		database.QueryRow("SELECT COUNT(*) FROM peers").Scan(&peerCount)
-		maxPeers = handler.CalculateMaxPeers(subnetCIDR)
-		usagePercent := float64(peerCount) / float64(maxPeers) * 100
-		if usagePercent >= 80 {
-			level := "warning"
-			if usagePercent >= 95 {
-				level = "critical"
-			}
-			alerts = append(alerts, map[string]interface{}{
-				"type":    "subnet_capacity",
-				"level":   level,
-				"message": fmt.Sprintf("Subnet at %.0f%% capacity (%d/%d peers)", usagePercent, peerCount, maxPeers),
-			})
-		}
-		
-		// 3. Disabled peers count (informational)
-		var disabledCount int
-		database.QueryRow("SELECT COUNT(*) FROM peers WHERE disabled = 1").Scan(&disabledCount)
-		if disabledCount > 0 {
-			alerts = append(alerts, map[string]interface{}{
-				"type":    "disabled_peers",
-				"level":   "info",
-				"message": fmt.Sprintf("%d peer(s) are currently disabled", disabledCount),
-			})
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"alerts":      alerts,
-			"alert_count": len(alerts),
-			"timestamp":   time.Now().Unix(),
-		})
-	})
-
-	// Apply middleware in correct order: Auth -> CSRF -> RateLimit
-	authProtected := middleware.Auth(database, protectedAPI)
-	csrfProtected := middleware.CSRF(authProtected)
-	rateLimited := middleware.RateLimitMiddleware(csrfProtected) // Rate limit ALL protected routes
-
-	mux.Handle("/api/v1/", http.StripPrefix("/api/v1", rateLimited))
-
-	// Apply security headers and request ID to all routes
-	secureHandler := middleware.SecurityHeaders(middleware.RequestID(middleware.Logger(mux)))
-
-	srv := &http.Server{
-		Addr:         ":" + cfg.Port,
-		Handler:      secureHandler,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
-	}
-
-	go func() {
-		slog.Info("Starting API", "port", cfg.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			slog.Error("Server failure", "error", err)
-			os.Exit(1)
-		}
-	}()
-
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	slog.Info("Shutting down server...")
-
-	// Stop rate limiter cleanup goroutine
-	middleware.StopGlobalLimiter()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if err := srv.Shutdown(ctx); err != nil {
-		slog.Error("Server forced to shutdown", "error", err)
-		os.Exit(1)
-	}
-
-	slog.Info("Server stopped gracefully")
-}
-
-// getSystemStats removed (logic moved to internal/worker/stats.go)
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/auth"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/config"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/db"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/handler"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/middleware"
+	"github.com/SamNet-dev/wg-orchestrator/services/api/internal/worker"
+)
+
+func main() {
+	// Early logging to stderr for container troubleshooting
+	fmt.Fprintf(os.Stderr, "[BOOT] API starting... (Time: %s)\n", time.Now().Format(time.RFC3339))
+
+	createAdmin := flag.String("create-admin", "", "Create admin user with this username")
+	adminPass := flag.String("password", "", "Password for the admin user")
+	decryptFlag := flag.String("decrypt", "", "Decrypt a base64 string using the master key")
+	encryptFlag := flag.String("encrypt", "", "Encrypt a plaintext string using the master key")
+	migrateStatus := flag.Bool("migrate-status", false, "List applied/pending migrations and exit")
+	migrateTo := flag.Int("migrate-to", -1, "Migrate to a specific schema version and exit (0 = latest)")
+	migrateUp := flag.Int("migrate-up", 0, "Apply N pending migrations and exit")
+	migrateDown := flag.Int("migrate-down", 0, "Roll back N migrations (requires NNN_down.sql files) and exit")
+	flag.Parse()
+
+	// CLI Mode: Crypt utility (for samnet.sh integration)
+	if *decryptFlag != "" || *encryptFlag != "" {
+		// Initialize config just to get paths (don't validate full stack)
+		_ = config.Load()
+
+		if *decryptFlag != "" {
+			fmt.Fprintf(os.Stderr, "[BOOT] Running in decrypt mode\n")
+			plaintext, err := auth.Decrypt(*decryptFlag)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Decryption failed: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Print(plaintext)
+		} else {
+			fmt.Fprintf(os.Stderr, "[BOOT] Running in encrypt mode\n")
+			ciphertext, err := auth.Encrypt(*encryptFlag)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Encryption failed: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Print(ciphertext)
+		}
+		os.Exit(0)
+	}
+
+	fmt.Fprintf(os.Stderr, "[BOOT] Loading configuration...\n")
+	cfg := config.Load()
+	if err := cfg.Validate(); err != nil {
+		slog.Error("Invalid config", "error", err)
+		os.Exit(1)
+	}
+
+	// CLI Mode: Migration control (operator tooling, runs and exits)
+	if *migrateStatus || *migrateTo >= 0 || *migrateUp > 0 || *migrateDown > 0 {
+		switch {
+		case *migrateStatus:
+			infos, err := db.MigrationStatus(cfg.DBPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Migration status failed: %v\n", err)
+				os.Exit(1)
+			}
+			for _, m := range infos {
+				state := "pending"
+				if m.Applied {
+					state = "applied"
+				}
+				fmt.Printf("%3d  %-40s %s\n", m.Version, m.File, state)
+			}
+		case *migrateTo >= 0:
+			if err := db.MigrateTo(cfg.DBPath, *migrateTo); err != nil {
+				fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("Migration complete")
+		case *migrateUp > 0:
+			if err := db.MigrateSteps(cfg.DBPath, *migrateUp); err != nil {
+				fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("Migration complete")
+		case *migrateDown > 0:
+			if err := db.MigrateSteps(cfg.DBPath, -*migrateDown); err != nil {
+				fmt.Fprintf(os.Stderr, "Rollback failed: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("Rollback complete")
+		}
+		os.Exit(0)
+	}
+
+	fmt.Fprintf(os.Stderr, "[BOOT] Connecting to database at %s...\n", cfg.DBPath)
+	// Open through the metrics-tracking driver so the ScalingMonitor below
+	// sees real write counts (DB_BACKEND=postgres + DB_DSN selects Postgres)
+	dbDriver, err := db.NewMonitorDriver(cfg.DBPath)
+	if err != nil {
+		slog.Error("Failed to connect to DB", "error", err)
+		os.Exit(1)
+	}
+	database := dbDriver.RawDB()
+	defer database.Close()
+	dbDriver.StartMetricsReset(context.Background())
+	handler.SetWriteMetricsSource(func() (int64, float64, int64) {
+		m := dbDriver.GetWriteMetrics()
+		return m.TotalWrites, m.WritesPerSecond, m.PeakWrites
+	})
+
+	if os.Getenv("DB_BACKEND") != "postgres" {
+		// Postgres migrations and schema checks run inside the driver;
+		// these two are SQLite-specific
+		fmt.Fprintf(os.Stderr, "[BOOT] Running database migrations...\n")
+		if err := db.RunMigrations(cfg.DBPath); err != nil {
+			slog.Error("Failed to run migrations", "error", err)
+			os.Exit(1)
+		}
+
+		fmt.Fprintf(os.Stderr, "[BOOT] Validating database schema...\n")
+		// Validate schema integrity before starting workers
+		if err := db.ValidateSchema(database); err != nil {
+			slog.Error("Database schema validation failed", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "[BOOT] Initializing JSON logger and starting workers...\n")
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	// CLI Mode: Create admin user
+	if *createAdmin != "" && *adminPass != "" {
+		hash, err := auth.HashPassword(*adminPass)
+		if err != nil {
+			slog.Error("Failed to hash password", "error", err)
+			os.Exit(1)
+		}
+		_, err = database.Exec("INSERT OR REPLACE INTO users (username, password_hash, role, failed_attempts) VALUES (?, ?, 'admin', 0)", *createAdmin, hash)
+		if err != nil {
+			slog.Error("Failed to create user", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("User created successfully", "username", *createAdmin)
+		os.Exit(0)
+	}
+
+	// Detect wg binary / enable mock backend before anything shells out to it
+	handler.InitWGBackend(database)
+
+	// Register the primary tunnel and adopt peers from pre-multi-interface
+	// schemas
+	handler.EnsurePrimaryInterface(database)
+
+	// Optional local GeoIP database (GEOIP_DB_PATH) for offline lookups
+	handler.InitGeoIPDB()
+
+	// Root context for background workers; cancelled on SIGINT/SIGTERM so
+	// loops stop mutating the DB and WireGuard before the server drains
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+
+	// Start background workers with panic recovery
+	var safeWorker func(name string, workerFunc func(context.Context, *sql.DB))
+	safeWorker = func(name string, workerFunc func(context.Context, *sql.DB)) {
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Worker crashed - restarting", "worker", name, "panic", r, "stack", string(debug.Stack()))
+					time.Sleep(10 * time.Second)
+					if workerCtx.Err() == nil {
+						safeWorker(name, workerFunc) // Restart with backoff
+					}
+				}
+			}()
+			workerFunc(workerCtx, database)
+		}()
+	}
+
+	safeWorker("limits", worker.LimitWorker)
+	safeWorker("expiry", worker.ExpiryWorker)
+	safeWorker("schedule", worker.ScheduleWorker) // If ScheduleWorker is exported
+	safeWorker("ddns", worker.DDNSWorker)
+	safeWorker("alerts", worker.AlertsWorker)
+	safeWorker("monitor", worker.MonitorWorker)
+	safeWorker("automation", worker.AutomationWorker)
+	safeWorker("rollup", worker.RollupWorker)
+	safeWorker("quota", worker.QuotaResetWorker)
+
+	// Start System Stats Worker (1s ticker, no database needed)
+	go worker.StatsWorker(workerCtx)
+
+	// Run DB maintenance every hour
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				db.RunMaintenance(database)
+			case <-workerCtx.Done():
+				return
+			}
+		}
+	}()
+
+	// Watch write load; sustained load above the threshold writes an audit
+	// alert and notifies subscribed channels that it's time to scale out
+	dbCfg := db.LoadConfigFromEnv()
+	scalingMonitor := db.NewScalingMonitor(dbDriver, dbCfg.WriteThreshold)
+	scalingMonitor.SetAlertCallback(func(m db.WriteMetrics) {
+		worker.NotifyEvent(database, "high_load",
+			fmt.Sprintf("Database write load high: %.1f writes/sec (threshold %d)", m.WritesPerSecond, dbCfg.WriteThreshold))
+	})
+	scalingMonitor.Start()
+
+	// Optional Redis cache for sessions/rate limiting. Once configured it is a
+	// hard dependency, so register it with the readiness check.
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		redisCache := db.NewRedisCache(redisURL)
+		if err := redisCache.Connect(); err != nil {
+			slog.Error("Redis connection failed, readiness will report it down", "error", err)
+		}
+		defer redisCache.Close()
+		handler.SetHealthRedis(redisCache)
+		middleware.SetRedisCache(redisCache)
+		scalingMonitor.SetRedis(redisCache)
+	}
+
+	mux := http.NewServeMux()
+
+	// Public endpoints (no auth, no CSRF)
+	mux.HandleFunc("/health/live", handler.HealthLive)
+	mux.HandleFunc("/health/ready", handler.HealthReady(database))
+
+	// Metrics stay public unless METRICS_TOKEN is set (per-peer metrics leak
+	// topology, so deployments with an exposed port can require a bearer token)
+	metricsToken := os.Getenv("METRICS_TOKEN")
+	metricsHandler := handler.Metrics(database)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if metricsToken != "" && r.Header.Get("Authorization") != "Bearer "+metricsToken {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		metricsHandler(w, r)
+	})
+
+	// Sync health check (Hardening: Single Source of Truth verification)
+	mux.HandleFunc("/health/sync", func(w http.ResponseWriter, r *http.Request) {
+		clientDir := config.Get().ClientsDir
+		files, _ := filepath.Glob(filepath.Join(clientDir, "*.conf"))
+
+		dbPeers := make(map[string]bool)
+		rows, err := database.Query("SELECT name FROM peers")
+		if err == nil {
+			defer rows.Close()
+			for rows.Next() {
+				var name string
+				if rows.Scan(&name) == nil {
+					dbPeers[name] = true
+				}
+			}
+		}
+
+		filePeers := make(map[string]bool)
+		for _, f := range files {
+			name := strings.TrimSuffix(filepath.Base(f), ".conf")
+			filePeers[name] = true
+		}
+
+		missingFiles := []string{}
+		for name := range dbPeers {
+			if !filePeers[name] {
+				missingFiles = append(missingFiles, name)
+			}
+		}
+
+		missingDB := []string{}
+		for name := range filePeers {
+			if !dbPeers[name] {
+				missingDB = append(missingDB, name)
+			}
+		}
+
+		status := "OK"
+		if len(missingFiles) > 0 || len(missingDB) > 0 {
+			status = "DESYNC"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":           status,
+			"database_peers":   len(dbPeers),
+			"filesystem_peers": len(filePeers),
+			"missing_files":    missingFiles,
+			"missing_database": missingDB,
+			"timestamp":        time.Now().Unix(),
+		})
+	})
+
+	// Public login endpoint (rate limited but no auth/CSRF)
+	publicAPI := http.NewServeMux()
+	publicAPI.HandleFunc("POST /login", handler.Login(database))
+	publicAPI.HandleFunc("GET /onboarding", handler.RedeemOnboardingToken(database))
+	mux.Handle("/api/v1/login", http.StripPrefix("/api/v1", middleware.LoginRateLimitMiddleware(publicAPI)))
+	mux.Handle("/api/v1/onboarding", http.StripPrefix("/api/v1", middleware.LoginRateLimitMiddleware(publicAPI)))
+
+	// Internal API - localhost only, no auth (for CLI cross-engine mode)
+	// This is safe because it only accepts connections from 127.0.0.1
+	internalAPI := http.NewServeMux()
+	internalAPI.HandleFunc("DELETE /peers/{id}", handler.DeletePeer(database))
+	internalAPI.HandleFunc("PUT /peers/{id}", handler.UpdatePeer(database))
+	internalAPI.HandleFunc("GET /peers/config", handler.DownloadPeerConfig(database))
+	mux.Handle("/internal/", http.StripPrefix("/internal", middleware.LocalhostOnly(internalAPI)))
+
+	// Protected endpoints (auth + CSRF)
+	protectedAPI := http.NewServeMux()
+	protectedAPI.HandleFunc("POST /logout", handler.Logout(database))
+	protectedAPI.HandleFunc("GET /csrf", middleware.RefreshCSRF)
+	// Per-route deadlines: cheap dashboard endpoints get a tight ceiling so a
+	// stuck file sync can't hold connections; backup and export stream for as
+	// long as they need under the server's own timeouts
+	protectedAPI.Handle("GET /peers", middleware.Timeout(10*time.Second, handler.ListPeers(database)))
+	protectedAPI.Handle("POST /peers", middleware.RequireOperator(database, handler.CreatePeer(database)))
+	protectedAPI.HandleFunc("POST /peers/config-preview", handler.ConfigPreview(database))
+	protectedAPI.HandleFunc("GET /peers/qr-sheet", handler.QRSheet(database))
+	protectedAPI.Handle("GET /peers/online", middleware.Timeout(5*time.Second, handler.OnlinePeers(database)))
+	protectedAPI.HandleFunc("GET /peers/config", handler.DownloadPeerConfig(database))
+	protectedAPI.HandleFunc("GET /peers/qr", handler.GetPeerQR(database))
+	protectedAPI.Handle("DELETE /peers/{id}", middleware.RequireOperator(database, handler.DeletePeer(database)))
+	protectedAPI.Handle("PUT /peers/{id}", middleware.RequireOperator(database, handler.UpdatePeer(database)))
+	protectedAPI.Handle("POST /peers/{id}/rotate", middleware.RequireOperator(database, handler.RotatePeer(database)))
+	protectedAPI.Handle("POST /peers/{id}/move", middleware.RequireOperator(database, handler.MovePeer(database)))
+	protectedAPI.HandleFunc("GET /peers/{id}/schedule", handler.GetPeerSchedule(database))
+	protectedAPI.Handle("POST /peers/{id}/schedule", middleware.RequireOperator(database, handler.UpdatePeerSchedule(database)))
+	protectedAPI.HandleFunc("GET /peers/{id}/effective-settings", handler.GetEffectiveSettings(database))
+	protectedAPI.HandleFunc("GET /peers/{id}/bandwidth", handler.GetPeerBandwidth(database))
+	protectedAPI.HandleFunc("GET /peers/{id}/acl", handler.GetPeerACL(database))
+	protectedAPI.Handle("POST /peers/{id}/acl", middleware.RequireOperator(database, handler.UpdatePeerACL(database)))
+	protectedAPI.Handle("GET /peers/export", middleware.Timeout(0, handler.ExportAllPeers(database)))
+	protectedAPI.Handle("POST /peers/sync/repair", middleware.RequireRole(database, handler.RepairPeerSync(database), "admin"))
+	protectedAPI.HandleFunc("POST /peers/{id}/reset-usage", func(w http.ResponseWriter, r *http.Request) {
+		if middleware.GetUserRole(r) != "admin" {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		handler.ResetPeerUsage(database)(w, r)
+	})
+	protectedAPI.HandleFunc("POST /onboarding/tokens", func(w http.ResponseWriter, r *http.Request) {
+		if middleware.GetUserRole(r) != "admin" {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		handler.CreateOnboardingToken(database)(w, r)
+	})
+
+	// Staging-only: simulate usage/expiry to exercise the workers.
+	// Not registered at all unless explicitly enabled, so production
+	// deployments can't reach it.
+	if os.Getenv("ENABLE_TEST_ENDPOINTS") == "true" {
+		slog.Warn("Test endpoints enabled - do not use in production")
+		protectedAPI.HandleFunc("POST /peers/{id}/simulate", func(w http.ResponseWriter, r *http.Request) {
+			if middleware.GetUserRole(r) != "admin" {
+				http.Error(w, "Admin access required", http.StatusForbidden)
+				return
+			}
+			handler.SimulatePeer(database)(w, r)
+		})
+	}
+
+	// Backup endpoint
+	protectedAPI.Handle("GET /backup", middleware.Timeout(0, handler.CreateBackup(database)))
+	protectedAPI.Handle("POST /backup/test", middleware.RequireOperator(database, handler.TestBackupDestination(database)))
+
+	// Subnet configuration
+	protectedAPI.HandleFunc("GET /network/subnet", func(w http.ResponseWriter, r *http.Request) {
+		var subnet, preset string
+		database.QueryRow("SELECT value FROM system_config WHERE key='subnet_cidr'").Scan(&subnet)
+		database.QueryRow("SELECT value FROM system_config WHERE key='subnet_preset'").Scan(&preset)
+		if subnet == "" {
+			subnet = "10.100.0.0/24"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"subnet": subnet,
+			"preset": preset,
+		})
+	})
+	protectedAPI.HandleFunc("POST /network/subnet", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Subnet string `json:"subnet"`
+			Preset string `json:"preset"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		// Same validation path as ConfigureSubnet, so both endpoints
+		// accept and reject identically
+		if verr := handler.ValidateSubnet(req.Subnet); verr != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": verr})
+			return
+		}
+		database.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('subnet_cidr', ?)", req.Subnet)
+		database.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('subnet_preset', ?)", req.Preset)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "configured"}`))
+	})
+
+	// DDNS management
+	protectedAPI.HandleFunc("GET /ddns/config", func(w http.ResponseWriter, r *http.Request) {
+		var config struct {
+			Enabled  bool   `json:"enabled"`
+			Provider string `json:"provider"`
+			Domain   string `json:"domain"`
+		}
+		var enabledStr, configJSON string
+		database.QueryRow("SELECT value FROM system_config WHERE key='ddns_enabled'").Scan(&enabledStr)
+		database.QueryRow("SELECT value FROM system_config WHERE key='ddns_config'").Scan(&configJSON)
+		config.Enabled = enabledStr == "true" || enabledStr == "1"
+		if configJSON != "" {
+			json.Unmarshal([]byte(configJSON), &config)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config)
+	})
+	protectedAPI.HandleFunc("POST /ddns/config", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Enabled  bool   `json:"enabled"`
+			Provider string `json:"provider"`
+			Domain   string `json:"domain"`
+			Token    string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		enabledStr := "false"
+		if req.Enabled {
+			enabledStr = "true"
+		}
+		database.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('ddns_enabled', ?)", enabledStr)
+		configJSON, _ := json.Marshal(map[string]string{
+			"provider": req.Provider,
+			"domain":   req.Domain,
+			"token":    req.Token,
+		})
+		database.Exec("INSERT OR REPLACE INTO system_config (key, value) VALUES ('ddns_config', ?)", string(configJSON))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "saved"}`))
+	})
+	protectedAPI.HandleFunc("POST /ddns/force-update", func(w http.ResponseWriter, r *http.Request) {
+		if err := worker.ForceUpdate(database); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "update triggered"}`))
+	})
+	protectedAPI.HandleFunc("GET /ddns/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		status := worker.GetDDNSStatus()
+		json.NewEncoder(w).Encode(status)
+	})
+
+	// Subnet management
+	protectedAPI.HandleFunc("GET /subnets/presets", handler.GetSubnetPresets(database))
+	protectedAPI.HandleFunc("GET /subnets/current", handler.GetCurrentSubnet(database))
+	protectedAPI.Handle("POST /subnets/configure", middleware.RequireOperator(database, handler.ConfigureSubnet(database)))
+	protectedAPI.HandleFunc("GET /network/stats", handler.SubnetStats(database))
+	protectedAPI.HandleFunc("GET /network/interface-stats", handler.InterfaceStats(database))
+
+	// Database scaling monitor
+	protectedAPI.HandleFunc("GET /db/metrics", func(w http.ResponseWriter, r *http.Request) {
+		backend := "sqlite"
+		if os.Getenv("DB_BACKEND") == "postgres" {
+			backend = "postgres"
+		}
+		m := dbDriver.GetWriteMetrics()
+		pool := database.Stats()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"backend":           backend,
+			"status":            "operational",
+			"writes_per_second": m.WritesPerSecond,
+			"peak_writes":       m.PeakWrites,
+			"total_writes":      m.TotalWrites,
+			"pool": map[string]interface{}{
+				"open_connections": pool.OpenConnections,
+				"in_use":           pool.InUse,
+				"idle":             pool.Idle,
+				"wait_count":       pool.WaitCount,
+				"max_open":         pool.MaxOpenConnections,
+			},
+			"write_threshold":     dbCfg.WriteThreshold,
+			"scaling_recommended": m.WritesPerSecond > float64(dbCfg.WriteThreshold),
+		})
+	})
+
+	// Audit logs endpoint
+	protectedAPI.HandleFunc("GET /audit-logs", handler.QueryAuditLogs(database))
+
+	// Network settings
+	protectedAPI.HandleFunc("GET /network/settings", handler.GetNetworkSettings(database))
+	protectedAPI.Handle("POST /network/settings", middleware.RequireOperator(database, handler.UpdateNetworkSettings(database)))
+	protectedAPI.HandleFunc("GET /network/endpoint-hostname", handler.GetEndpointHostname(database))
+	protectedAPI.Handle("POST /network/endpoint-hostname", middleware.RequireOperator(database, handler.UpdateEndpointHostname(database)))
+	protectedAPI.HandleFunc("GET /dns-profiles", handler.ListDNSProfiles(database))
+	protectedAPI.Handle("POST /dns-profiles", middleware.RequireOperator(database, handler.CreateDNSProfile(database)))
+	protectedAPI.HandleFunc("GET /network/global", handler.GetGlobalSettings(database))
+	protectedAPI.Handle("POST /network/global", middleware.RequireOperator(database, handler.UpdateGlobalSettings(database)))
+	protectedAPI.HandleFunc("GET /network/propagation-status", handler.GetPropagationStatus(database))
+	protectedAPI.HandleFunc("GET /network/obfuscation", handler.GetObfuscation(database))
+	protectedAPI.Handle("POST /network/obfuscation", middleware.RequireOperator(database, handler.UpdateObfuscation(database)))
+	protectedAPI.HandleFunc("GET /network/endpoints", handler.GetFailoverEndpoints(database))
+	protectedAPI.Handle("POST /network/endpoints", middleware.RequireOperator(database, handler.UpdateFailoverEndpoints(database)))
+
+	// User stats
+	// WireGuard interfaces (multi-tunnel); registering a new one is admin-only
+	protectedAPI.HandleFunc("GET /interfaces", handler.ListWGInterfaces(database))
+	protectedAPI.Handle("POST /interfaces", middleware.RequireRole(database, handler.CreateWGInterface(database), "admin"))
+
+	protectedAPI.Handle("GET /users", middleware.RequireRole(database, handler.ListUsers(database), "admin"))
+	protectedAPI.Handle("POST /users", middleware.RequireRole(database, handler.CreateUser(database), "admin"))
+	protectedAPI.Handle("DELETE /users/{id}", middleware.RequireRole(database, handler.DeleteUser(database), "admin"))
+	protectedAPI.Handle("PUT /users/{id}/role", middleware.RequireRole(database, handler.ChangeUserRole(database), "admin"))
+	protectedAPI.HandleFunc("GET /users/stats", func(w http.ResponseWriter, r *http.Request) {
+		var adminCount, userCount int
+		database.QueryRow("SELECT COUNT(*) FROM users WHERE role='admin'").Scan(&adminCount)
+		database.QueryRow("SELECT COUNT(*) FROM users WHERE role!='admin'").Scan(&userCount)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{
+			"admin_count": adminCount,
+			"user_count":  userCount,
+		})
+	})
+
+	// Rate limiter inspection and reset (admin only - operational escape hatch)
+	protectedAPI.HandleFunc("GET /system/duplicate-keys", func(w http.ResponseWriter, r *http.Request) {
+		if middleware.GetUserRole(r) != "admin" {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		handler.DuplicateKeys(database)(w, r)
+	})
+	protectedAPI.HandleFunc("GET /system/orphans", func(w http.ResponseWriter, r *http.Request) {
+		if middleware.GetUserRole(r) != "admin" {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		handler.ListOrphans(database)(w, r)
+	})
+	protectedAPI.HandleFunc("POST /system/orphans/cleanup", func(w http.ResponseWriter, r *http.Request) {
+		if middleware.GetUserRole(r) != "admin" {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		handler.CleanupOrphans(database)(w, r)
+	})
+	protectedAPI.HandleFunc("GET /system/rate-limits", func(w http.ResponseWriter, r *http.Request) {
+		if middleware.GetUserRole(r) != "admin" {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(middleware.RateLimiterState())
+	})
+	protectedAPI.HandleFunc("DELETE /system/rate-limits/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		if middleware.GetUserRole(r) != "admin" {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		ip := r.PathValue("ip")
+		if ip == "" {
+			http.Error(w, "Missing IP", http.StatusBadRequest)
+			return
+		}
+		cleared := middleware.ClearRateLimitIP(ip)
+		handler.WriteAudit(database, r, "CLEAR_RATE_LIMIT", ip, "Rate limit counters cleared")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "cleared",
+			"ip":      ip,
+			"tracked": cleared,
+		})
+	})
+
+	// System stats endpoint for Web UI dashboard
+	protectedAPI.HandleFunc("GET /system/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := worker.GetSystemStats()
+		online, maxConcurrent := worker.ConcurrentUsage()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			worker.SystemStats
+			OnlineCount   int `json:"online_count"`
+			MaxConcurrent int `json:"max_concurrent"` // 0 = unlimited
+		}{stats, online, maxConcurrent})
+	})
+
+	// Password change endpoint
+	protectedAPI.HandleFunc("POST /users/password", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if len(req.NewPassword) < 8 {
+			http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+			return
+		}
+
+		// Get user ID from session
+		userID := middleware.GetUserID(r)
+		if userID == 0 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Verify current password
+		var storedHash string
+		err := database.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&storedHash)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		valid, err := auth.CheckPassword(storedHash, req.CurrentPassword)
+		if err != nil || !valid {
+			http.Error(w, "Current password is incorrect", http.StatusForbidden)
+			return
+		}
+
+		// Hash and update new password
+		newHash, err := auth.HashPassword(req.NewPassword)
+		if err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+		_, err = database.Exec("UPDATE users SET password_hash = ? WHERE id = ?", newHash, userID)
+		if err != nil {
+			http.Error(w, "Failed to update password", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "password_updated"}`))
+	})
+
+	// MFA enrollment (two-step: setup stores a pending secret, verify activates it)
+	protectedAPI.HandleFunc("GET /users/sessions", handler.ListMySessions(database))
+	protectedAPI.HandleFunc("DELETE /users/sessions/{id}", handler.RevokeSession(database))
+	protectedAPI.HandleFunc("POST /users/sessions/revoke-all", handler.RevokeOtherSessions(database))
+	protectedAPI.HandleFunc("POST /users/mfa/setup", handler.SetupMFA(database))
+	protectedAPI.HandleFunc("POST /users/mfa/verify", handler.VerifyMFA(database))
+	protectedAPI.HandleFunc("POST /users/mfa/disable", handler.DisableMFA(database))
+	protectedAPI.HandleFunc("POST /users/mfa/recovery-codes/regenerate", handler.RegenerateRecoveryCodes(database))
+
+	// Observability Alerts endpoint - returns actionable system warnings
+	protectedAPI.HandleFunc("GET /system/alerts", func(w http.ResponseWriter, r *http.Request) {
+		alerts := []map[string]interface{}{}
+
+		// 1. Stale handshake check (>5 minutes without handshake = potential issue)
+		rows, err := database.Query("SELECT name, public_key FROM peers WHERE disabled = 0 OR disabled IS NULL")
+		if err == nil {
+			defer rows.Close()
+			wgStats := handler.GetWireGuardStats()
+			for rows.Next() {
+				var name, pubKey string
+				if rows.Scan(&name, &pubKey) == nil {
+					if stats, ok := wgStats[pubKey]; ok {
+						if stats.LastHandshake == "never" || stats.LastHandshake == "" {
+							alerts = append(alerts, map[string]interface{}{
+								"type":    "stale_handshake",
+								"level":   "warning",
+								"peer":    name,
+								"message": "Peer has never established connection",
+							})
+						}
+					}
+				}
+			}
+		}
+
+		// 2. Subnet capacity check (warn at 80%)
+		var subnetCIDR string
+		database.QueryRow("SELECT value FROM system_config WHERE key='subnet_cidr'").Scan(&subnetCIDR)
+		if subnetCIDR == "" {
+			subnetCIDR = "10.100.0.0/24"
+		}
+		var peerCount, maxPeers int
+		database.QueryRow("SELECT COUNT(*) FROM peers").Scan(&peerCount)
+		maxPeers = handler.CalculateMaxPeersDual(database, subnetCIDR)
+		usagePercent := float64(peerCount) / float64(maxPeers) * 100
+		if usagePercent >= 80 {
+			level := "warning"
+			if usagePercent >= 95 {
+				level = "critical"
+			}
+			alerts = append(alerts, map[string]interface{}{
+				"type":    "subnet_capacity",
+				"level":   level,
+				"message": fmt.Sprintf("Subnet at %.0f%% capacity (%d/%d peers)", usagePercent, peerCount, maxPeers),
+			})
+		}
+
+		// 3. Disabled peers count (informational)
+		var disabledCount int
+		database.QueryRow("SELECT COUNT(*) FROM peers WHERE disabled = 1").Scan(&disabledCount)
+		if disabledCount > 0 {
+			alerts = append(alerts, map[string]interface{}{
+				"type":    "disabled_peers",
+				"level":   "info",
+				"message": fmt.Sprintf("%d peer(s) are currently disabled", disabledCount),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"alerts":      alerts,
+			"alert_count": len(alerts),
+			"timestamp":   time.Now().Unix(),
+		})
+	})
+
+	// Apply middleware in correct order: Auth -> CSRF -> RateLimit
+	authProtected := middleware.Auth(database, protectedAPI)
+	csrfProtected := middleware.CSRF(authProtected)
+	rateLimited := middleware.RateLimitMiddleware(csrfProtected) // Rate limit ALL protected routes
+
+	mux.Handle("/api/v1/", http.StripPrefix("/api/v1", rateLimited))
+
+	// Apply security headers, request ID and panic recovery to all routes
+	secureHandler := middleware.SecurityHeaders(middleware.RequestID(middleware.Recover(middleware.Logger(mux))))
+
+	srv := &http.Server{
+		Addr:         ":" + cfg.Port,
+		Handler:      secureHandler,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+
+	go func() {
+		slog.Info("Starting API", "port", cfg.Port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Server failure", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	slog.Info("Shutting down server...")
+
+	// Stop background workers first so nothing writes to the DB or the
+	// WireGuard interface while the server drains
+	stopWorkers()
+
+	// Stop rate limiter cleanup goroutine
+	middleware.StopGlobalLimiter()
+
+	// Stop the write-load monitor
+	scalingMonitor.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("Server forced to shutdown", "error", err)
+		os.Exit(1)
+	}
+
+	slog.Info("Server stopped gracefully")
+}
+
+// getSystemStats removed (logic moved to internal/worker/stats.go)
@@ -0,0 +1,5 @@
+-- Migration: Track client platform per peer
+-- Set from the ?os= hint when a config/QR is generated, used for fleet metadata
+
+ALTER TABLE peers ADD COLUMN platform TEXT;
+ALTER TABLE peers ADD COLUMN client_version TEXT;
@@ -0,0 +1,5 @@
+-- Migration: Graduated data-limit warnings
+-- Bitmask of warning thresholds a peer has already crossed this quota cycle,
+-- so each threshold notifies exactly once
+
+ALTER TABLE peers ADD COLUMN limit_warned_mask INTEGER DEFAULT 0;
@@ -0,0 +1,5 @@
+-- Migration: Per-peer AllowedIPs overrides
+-- Comma-separated CIDR list; when set, config generation uses it instead of
+-- the global split/full-tunnel route set
+
+ALTER TABLE peer_settings ADD COLUMN allowed_ips_override TEXT;
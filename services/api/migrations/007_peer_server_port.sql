@@ -0,0 +1,5 @@
+-- Migration: Per-peer endpoint port override
+-- Lets peers behind restrictive firewalls dial an alternate listener
+-- (e.g. 443) while the rest keep the default listen_port
+
+ALTER TABLE peer_settings ADD COLUMN server_port INTEGER;
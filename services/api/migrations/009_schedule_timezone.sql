@@ -0,0 +1,2 @@
+-- IANA timezone per schedule window (empty = server-local time)
+ALTER TABLE peer_schedules ADD COLUMN timezone TEXT DEFAULT '';
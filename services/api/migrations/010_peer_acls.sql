@@ -0,0 +1,12 @@
+-- Server-side per-peer ACLs, enforced via nftables on the peer's /32 source
+CREATE TABLE IF NOT EXISTS peer_acls (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    peer_id INTEGER NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0, -- evaluation order, first match wins
+    action TEXT NOT NULL,                -- 'allow' or 'deny'
+    cidr TEXT NOT NULL,                  -- destination CIDR the rule covers
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (peer_id) REFERENCES peers(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_peer_acls_peer ON peer_acls(peer_id);
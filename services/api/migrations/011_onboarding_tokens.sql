@@ -0,0 +1,16 @@
+-- One-time onboarding tokens for self-service peer provisioning
+CREATE TABLE IF NOT EXISTS onboarding_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_hash TEXT NOT NULL UNIQUE,     -- SHA-256 of the raw token, same scheme as sessions
+    name_prefix TEXT NOT NULL,           -- redeemed peer is named <prefix>-<random suffix>
+    group_id INTEGER,                    -- optional group the new peer joins
+    data_limit_gb INTEGER DEFAULT 0,     -- applied to the new peer, 0 = unlimited
+    expires_at DATETIME NOT NULL,
+    used INTEGER DEFAULT 0,
+    used_peer TEXT,                      -- name of the peer the token produced
+    used_at DATETIME,
+    created_by INTEGER,                  -- admin user who minted the token
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_onboarding_tokens_hash ON onboarding_tokens(token_hash);
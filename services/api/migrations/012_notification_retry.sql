@@ -0,0 +1,4 @@
+-- Retry bookkeeping for the notification queue
+ALTER TABLE notification_queue ADD COLUMN attempts INTEGER DEFAULT 0;
+ALTER TABLE notification_queue ADD COLUMN next_attempt_at DATETIME;
+ALTER TABLE notification_queue ADD COLUMN failed INTEGER DEFAULT 0; -- gave up after max attempts
@@ -0,0 +1,3 @@
+-- Per-peer tunnel mode: 'full', 'split' or 'inherit' (follow the global
+-- split_tunnel flag, the pre-existing behavior)
+ALTER TABLE peer_settings ADD COLUMN tunnel_mode TEXT DEFAULT 'inherit';
@@ -0,0 +1,34 @@
+-- Migration: Aggregated bandwidth rollups for long-term graphs
+-- Populated by the rollup worker from traffic_history deltas; peer_name is
+-- denormalized so rows survive (and cleanup works) after a peer is deleted
+
+CREATE TABLE IF NOT EXISTS bandwidth_hourly (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    peer_id INTEGER NOT NULL,
+    peer_name TEXT NOT NULL,
+    bucket DATETIME NOT NULL,     -- start of the hour (UTC)
+    rx_bytes INTEGER DEFAULT 0,
+    tx_bytes INTEGER DEFAULT 0,
+    UNIQUE (peer_id, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS bandwidth_daily (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    peer_id INTEGER NOT NULL,
+    peer_name TEXT NOT NULL,
+    bucket DATE NOT NULL,         -- day (UTC)
+    rx_bytes INTEGER DEFAULT 0,
+    tx_bytes INTEGER DEFAULT 0,
+    UNIQUE (peer_id, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS bandwidth_total (
+    peer_id INTEGER PRIMARY KEY,
+    peer_name TEXT NOT NULL,
+    rx_bytes INTEGER DEFAULT 0,
+    tx_bytes INTEGER DEFAULT 0,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_bandwidth_hourly_bucket ON bandwidth_hourly(bucket);
+CREATE INDEX IF NOT EXISTS idx_bandwidth_daily_bucket ON bandwidth_daily(bucket);
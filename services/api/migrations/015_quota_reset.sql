@@ -0,0 +1,7 @@
+-- Migration: Automatic monthly quota resets
+-- quota_reset_day: day of the month (1-28) the peer's usage counters reset
+-- disabled_reason: why a peer is disabled ('limit', 'manual', 'schedule'),
+-- so the quota worker only re-enables peers that the limit itself disabled
+
+ALTER TABLE peer_settings ADD COLUMN quota_reset_day INTEGER;
+ALTER TABLE peers ADD COLUMN disabled_reason TEXT;
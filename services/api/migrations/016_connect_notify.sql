@@ -0,0 +1,5 @@
+-- Migration: Per-peer connection-event notifications
+-- Peers flagged with notify_on_connect get connect/disconnect alerts queued
+-- on channels subscribed to the peer_connection event
+
+ALTER TABLE peer_settings ADD COLUMN notify_on_connect INTEGER DEFAULT 0;
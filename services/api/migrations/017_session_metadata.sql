@@ -0,0 +1,5 @@
+-- Migration: Session metadata for the "manage my devices" view
+-- IP and User-Agent are captured at login so users can recognize sessions
+
+ALTER TABLE sessions ADD COLUMN ip TEXT;
+ALTER TABLE sessions ADD COLUMN user_agent TEXT;
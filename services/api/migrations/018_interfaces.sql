@@ -0,0 +1,15 @@
+-- Multi-tunnel support: each managed WireGuard interface gets a row, and
+-- peers are scoped to one interface. The primary (WG_INTERFACE) is
+-- registered at startup and adopts pre-existing peers.
+CREATE TABLE IF NOT EXISTS interfaces (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    config_path TEXT NOT NULL,
+    subnet TEXT,
+    listen_port INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE peers ADD COLUMN interface_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_peers_interface_id ON peers(interface_id);
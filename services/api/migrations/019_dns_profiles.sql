@@ -0,0 +1,16 @@
+-- Migration: Configurable DNS profiles
+-- Replaces the hardcoded adblock/family resolver map so admins can define
+-- custom profiles (e.g. a local Pi-hole) without code changes
+
+CREATE TABLE IF NOT EXISTS dns_profiles (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    servers TEXT NOT NULL,
+    description TEXT,
+    created_at DATETIME DEFAULT (datetime('now'))
+);
+
+-- Seed the previously hardcoded built-ins
+INSERT OR IGNORE INTO dns_profiles (name, servers, description) VALUES
+    ('adblock', '94.140.14.14', 'AdGuard DNS - blocks ads and trackers'),
+    ('family', '1.1.1.3', 'Cloudflare family - blocks malware and adult content');
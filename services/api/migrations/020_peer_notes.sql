@@ -0,0 +1,5 @@
+-- Migration: Free-form operator notes per peer
+-- Context like "John's laptop" or a ticket reference, searchable via
+-- the peers list ?search= filter
+
+ALTER TABLE peers ADD COLUMN notes TEXT DEFAULT '';